@@ -0,0 +1,607 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/joshuaschlichting/loadmaster/internal/acme"
+	"github.com/joshuaschlichting/loadmaster/internal/config"
+	"github.com/joshuaschlichting/loadmaster/internal/status"
+	"github.com/joshuaschlichting/loadmaster/manager"
+)
+
+// command is a loadmaster subcommand. It receives the arguments following its name and
+// returns the process exit code.
+type command func(args []string) int
+
+var commands = map[string]command{
+	"export-pfx":      exportPFXCommand,
+	"import":          importCommand,
+	"check-storage":   checkStorageCommand,
+	"config-dump":     configDumpCommand,
+	"decommission":    decommissionCommand,
+	"list":            listCommand,
+	"renew-all":       renewAllCommand,
+	"rollback":        rollbackCommand,
+	"inspect":         inspectCommand,
+	"validate-config": validateConfigCommand,
+	"version":         versionCommand,
+}
+
+// commandFlags returns a FlagSet for a subcommand with the -config-dir, -config and -domains
+// flags every subcommand shares.
+func commandFlags(name string) (fs *flag.FlagSet, configFile, domainsFile *string) {
+	fs = flag.NewFlagSet(name, flag.ExitOnError)
+	configFile, domainsFile = pathFlags(fs)
+	return fs, configFile, domainsFile
+}
+
+// pathFlags defines -config-dir, -config and -domains on fs. Unless given explicitly, the config
+// and domains files are config.json and domains.json in the config directory, whatever order
+// the flags appear in.
+func pathFlags(fs *flag.FlagSet) (configFile, domainsFile *string) {
+	configFile, domainsFile = new(string), new(string)
+	var configSet, domainsSet bool
+	setDefaults := func() {
+		if !configSet {
+			*configFile = filepath.Join(config.Dir, "config.json")
+		}
+		if !domainsSet {
+			*domainsFile = filepath.Join(config.Dir, "domains.json")
+		}
+	}
+	setDefaults()
+	fs.Func("config-dir", fmt.Sprintf("Base directory for the config and domains files, certificates and ACME accounts (default $%s or ~/.loadmaster)", config.ConfigDirEnv), func(dir string) error {
+		config.Dir = dir
+		setDefaults()
+		return nil
+	})
+	fs.Func("config", "Path to application configuration file (default <config-dir>/config.json)", func(path string) error {
+		*configFile, configSet = path, true
+		return nil
+	})
+	fs.Func("domains", "Path to domains configuration file, or a directory of *.json domains files (default <config-dir>/domains.json)", func(path string) error {
+		*domainsFile, domainsSet = path, true
+		return nil
+	})
+	fs.BoolVar(&config.AllowUnknownFields, "lax", false, "Ignore unknown fields in the config and domains files instead of rejecting them")
+	return configFile, domainsFile
+}
+
+// loadStorage loads the application config and builds the storage backend it selects.
+func loadStorage(configFile string) (*config.AppConfig, acme.ACMEStorage, error) {
+	appConfig, err := config.LoadAppConfig(configFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error loading application config: %w", err)
+	}
+	if err := manager.ApplyACMEConfig(appConfig); err != nil {
+		return nil, nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	storage, err := manager.NewStorage(appConfig)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating storage: %w", err)
+	}
+	return appConfig, storage, nil
+}
+
+// exportPFXCommand writes a domain's certificate, chain and key as a PKCS#12 bundle.
+func exportPFXCommand(args []string) int {
+	fs, configFile, _ := commandFlags("export-pfx")
+	password := fs.String("password", os.Getenv("LOADMASTER_PFX_PASSWORD"), "PKCS#12 password (default $LOADMASTER_PFX_PASSWORD; may be empty)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: loadmaster export-pfx [flags] <domain> <outfile>")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return 2
+	}
+	domain, outFile := fs.Arg(0), fs.Arg(1)
+
+	_, storage, err := loadStorage(*configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	certData, keyData, err := storage.DownloadCert(domain)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error loading certificate for %s: %v\n", domain, err)
+		return 1
+	}
+	pfxData, err := acme.EncodePKCS12(certData, keyData, *password)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error exporting %s: %v\n", domain, err)
+		return 1
+	}
+	if err := os.WriteFile(outFile, pfxData, 0600); err != nil {
+		fmt.Fprintf(os.Stderr, "error writing %s: %v\n", outFile, err)
+		return 1
+	}
+	fmt.Printf("Wrote %s\n", outFile)
+	return 0
+}
+
+// listCommand prints every managed domain group with its certificate's location, issuer and
+// remaining validity.
+func listCommand(args []string) int {
+	fs, configFile, domainsFile := commandFlags("list")
+	expiringWithin := fs.Int("expiring-within", -1, "Only list certificates expiring within this many days (missing certificates are always listed)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: loadmaster list [flags]")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	_, storage, err := loadStorage(*configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	domains, err := config.LoadDomains(*domainsFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error loading domains: %v\n", err)
+		return 1
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "DOMAINS\tLOCATION\tISSUER\tDAYS LEFT\tLAST ATTEMPT\tATTEMPTS\tLAST ERROR")
+	for _, st := range status.Statuses(storage, domains.Domains) {
+		issuer, daysLeft := "-", "missing"
+		if !st.NotAfter.IsZero() {
+			if *expiringWithin >= 0 && st.DaysRemaining > *expiringWithin {
+				continue
+			}
+			issuer, daysLeft = st.Issuer, fmt.Sprint(st.DaysRemaining)
+		}
+		lastAttempt, attempts, lastError := "-", "0", "-"
+		if st.Renewal != nil {
+			if !st.Renewal.LastAttempt.IsZero() {
+				lastAttempt = st.Renewal.LastAttempt.Local().Format(time.DateTime)
+			}
+			attempts = fmt.Sprint(st.Renewal.AttemptCount)
+			if st.Renewal.LastError != "" {
+				lastError = st.Renewal.LastError
+			}
+		}
+		location, _ := storage.CertLocation(st.DomainRoot)
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", strings.Join(st.Domains, ","), location, issuer, daysLeft, lastAttempt, attempts, lastError)
+	}
+	if err := tw.Flush(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// renewAllCommand runs one sweep over every domain group, optionally renewing regardless of
+// expiry, and prints the outcome of each group.
+func renewAllCommand(args []string) int {
+	fs, configFile, domainsFile := commandFlags("renew-all")
+	force := fs.Bool("force", false, "Renew every certificate regardless of its expiry")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: loadmaster renew-all [flags]")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	appConfig, err := config.LoadAppConfig(*configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error loading application config: %v\n", err)
+		return 1
+	}
+	domains, err := config.LoadDomains(*domainsFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error loading domains: %v\n", err)
+		return 1
+	}
+	m, err := manager.New(appConfig, domains)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	acme.ForceRenewal = *force
+
+	results := m.RenewAll(context.Background())
+	slices.SortFunc(results, func(a, b manager.SweepResult) int {
+		return strings.Compare(acme.DomainRoot(a.Group), acme.DomainRoot(b.Group))
+	})
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "DOMAINS\tRESULT\tERROR")
+	for _, result := range results {
+		outcome, errText := "ok", "-"
+		if result.Err != nil {
+			outcome, errText = "failed", result.Err.Error()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", strings.Join(result.Group, ","), outcome, errText)
+	}
+	if err := tw.Flush(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if failed := manager.CountFailed(results); failed > 0 {
+		fmt.Fprintf(os.Stderr, "%d of %d domain group(s) failed\n", failed, len(results))
+		return 1
+	}
+	return 0
+}
+
+// validateConfigCommand checks the config and domains files without creating or changing
+// anything, printing every problem found.
+func validateConfigCommand(args []string) int {
+	fs, configFile, domainsFile := commandFlags("validate-config")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: loadmaster validate-config [flags]")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	var problems []error
+	appConfig, err := config.LoadAppConfig(*configFile)
+	if err != nil {
+		problems = append(problems, fmt.Errorf("%s: %w", *configFile, err))
+	} else {
+		if err := appConfig.Validate(); err != nil {
+			problems = append(problems, unjoin(err)...)
+		} else if err := manager.ApplyACMEConfig(appConfig); err != nil {
+			problems = append(problems, err)
+		}
+		storage, err := manager.NewStorage(appConfig)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("storage: %w", err))
+		} else if checker, ok := storage.(acme.AccessChecker); ok {
+			problems = append(problems, unjoin(checker.CheckAccess())...)
+		}
+	}
+
+	domains, err := config.LoadDomains(*domainsFile)
+	if err != nil {
+		problems = append(problems, fmt.Errorf("%s: %w", *domainsFile, err))
+	} else {
+		problems = append(problems, unjoin(domains.Validate())...)
+	}
+
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			fmt.Fprintf(os.Stderr, "- %v\n", problem)
+		}
+		fmt.Fprintf(os.Stderr, "%d problem(s) found\n", len(problems))
+		return 1
+	}
+	fmt.Println("Configuration OK")
+	return 0
+}
+
+// checkStorageCommand verifies that the configured storage is reachable, readable and writable
+// by writing, reading back and deleting a test object.
+func checkStorageCommand(args []string) int {
+	fs, configFile, _ := commandFlags("check-storage")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: loadmaster check-storage [flags]")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	_, storage, err := loadStorage(*configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	var problems []error
+	if checker, ok := storage.(acme.AccessChecker); ok {
+		if err := checker.CheckAccess(); err != nil {
+			problems = append(problems, unjoin(err)...)
+		}
+	}
+	if checker, ok := storage.(acme.WriteChecker); ok {
+		if err := checker.CheckWrite(); err != nil {
+			problems = append(problems, unjoin(err)...)
+		}
+	} else {
+		problems = append(problems, fmt.Errorf("storage %T can't be checked for write access", storage))
+	}
+
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			fmt.Fprintf(os.Stderr, "- %v\n", problem)
+		}
+		fmt.Fprintf(os.Stderr, "%d problem(s) found\n", len(problems))
+		return 1
+	}
+	fmt.Println("Storage OK")
+	return 0
+}
+
+// unjoin splits an error built with errors.Join back into its parts.
+func unjoin(err error) []error {
+	if err == nil {
+		return nil
+	}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		return joined.Unwrap()
+	}
+	return []error{err}
+}
+
+// inspectCommand prints the certificate, renewal history and stapling state of the domain group
+// containing a domain.
+func inspectCommand(args []string) int {
+	fs, configFile, domainsFile := commandFlags("inspect")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: loadmaster inspect [flags] <domain>")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	domain, err := config.NormalizeDomain(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	_, storage, err := loadStorage(*configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	st := status.Statuses(storage, [][]string{domainGroupFor(*domainsFile, domain)})[0]
+	certPath, keyPath := storage.CertLocation(st.DomainRoot)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Domains:\t%s\n", strings.Join(st.Domains, ", "))
+	fmt.Fprintf(tw, "Certificate:\t%s\n", certPath)
+	fmt.Fprintf(tw, "Private key:\t%s\n", keyPath)
+	if st.Error != "" {
+		fmt.Fprintf(tw, "Error:\t%s\n", st.Error)
+	} else {
+		fmt.Fprintf(tw, "Issuer:\t%s\n", st.Issuer)
+		fmt.Fprintf(tw, "Not after:\t%s (%d days)\n", st.NotAfter.Local().Format(time.DateTime), st.DaysRemaining)
+	}
+	if st.Renewal != nil {
+		fmt.Fprintf(tw, "Last attempt:\t%s\n", st.Renewal.LastAttempt.Local().Format(time.DateTime))
+		fmt.Fprintf(tw, "Attempts:\t%d\n", st.Renewal.AttemptCount)
+		if st.Renewal.LastError != "" {
+			fmt.Fprintf(tw, "Last error:\t%s\n", st.Renewal.LastError)
+		}
+		if st.Renewal.ConsecutiveFailures > 0 {
+			fmt.Fprintf(tw, "Consecutive failures:\t%d\n", st.Renewal.ConsecutiveFailures)
+		}
+		if time.Now().Before(st.Renewal.NextAttempt) {
+			fmt.Fprintf(tw, "Backing off until:\t%s\n", st.Renewal.NextAttempt.Local().Format(time.DateTime))
+		}
+	}
+	fmt.Fprintf(tw, "Must-Staple:\t%t\n", st.OCSP.MustStaple)
+	switch {
+	case !st.OCSP.CachedResponse:
+		fmt.Fprintf(tw, "OCSP response:\tnone cached\n")
+	case st.OCSP.Status != "":
+		fmt.Fprintf(tw, "OCSP response:\t%s, next update %s, valid: %t\n", st.OCSP.Status, st.OCSP.NextUpdate.Local().Format(time.DateTime), st.OCSP.Valid)
+	}
+	if st.OCSP.Error != "" {
+		fmt.Fprintf(tw, "OCSP error:\t%s\n", st.OCSP.Error)
+	}
+	if err := tw.Flush(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// domainGroupFor returns the group in the domains file containing domain, or a group of just
+// domain when it is not listed.
+func domainGroupFor(domainsFile, domain string) []string {
+	if domains, err := config.LoadDomains(domainsFile); err == nil {
+		for _, group := range domains.Domains {
+			if slices.Contains(group, domain) {
+				return group
+			}
+		}
+	}
+	return []string{domain}
+}
+
+// configDumpCommand prints the configuration in effect after defaults, environment overrides
+// and migrations are applied, with secrets redacted.
+func configDumpCommand(args []string) int {
+	fs, configFile, domainsFile := commandFlags("config-dump")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: loadmaster config-dump [flags]")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	appConfig, err := config.LoadAppConfig(*configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error loading application config: %v\n", err)
+		return 1
+	}
+	config.CertPerDomain = appConfig.CertPerDomain
+	domains, err := config.LoadDomains(*domainsFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error loading domains: %v\n", err)
+		return 1
+	}
+	dump := struct {
+		ConfigFile   string                `json:"configFile"`
+		DomainsFile  string                `json:"domainsFile"`
+		LocalCertDir string                `json:"localCertDir"`
+		Config       config.AppConfig      `json:"config"`
+		Domains      *config.DomainsConfig `json:"domains"`
+	}{*configFile, *domainsFile, appConfig.LocalCertDir, appConfig.Redacted(), domains}
+	if config.DomainsFromEnv() {
+		dump.DomainsFile = "$" + config.DomainsEnv
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(dump); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// decommissionCommand retires a domain group: it is removed from the domains file and its
+// certificate deleted from storage.
+func decommissionCommand(args []string) int {
+	fs, configFile, domainsFile := commandFlags("decommission")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: loadmaster decommission [flags] <domain>")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	domain, err := config.NormalizeDomain(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	_, storage, err := loadStorage(*configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if acme.Distribute {
+		fmt.Fprintln(os.Stderr, "this instance is in mode \"distribute\"; decommission the domain on the issuing instance")
+		return 1
+	}
+	group, err := config.RemoveDomainGroup(*domainsFile, domain)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error removing %s from the domains file: %v\n", domain, err)
+		return 1
+	}
+	fmt.Printf("Removed %s from %s\n", strings.Join(group, ", "), *domainsFile)
+
+	domainRoot := acme.DomainRoot(group)
+	if err := storage.DeleteCert(domainRoot); err != nil {
+		fmt.Fprintf(os.Stderr, "error deleting certificate for %s: %v\n", domainRoot, err)
+		return 1
+	}
+	if history, err := storage.LoadRenewalHistory(); err == nil {
+		if _, ok := history[domainRoot]; ok {
+			delete(history, domainRoot)
+			if err := storage.SaveRenewalHistory(history); err != nil {
+				fmt.Fprintf(os.Stderr, "error removing %s from the renewal history: %v\n", domainRoot, err)
+			}
+		}
+	}
+	fmt.Printf("Deleted certificate for %s\n", domainRoot)
+	return 0
+}
+
+// importCommand stores an existing certificate and key, e.g. from certbot, so it is served and
+// renewed like one loadmaster issued.
+func importCommand(args []string) int {
+	fs, configFile, domainsFile := commandFlags("import")
+	certFile := fs.String("cert", "", "PEM certificate (with its chain) to import")
+	keyFile := fs.String("key", "", "PEM private key of the certificate")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: loadmaster import <domain> -cert cert.pem -key privkey.pem [flags]")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	// Allow the flags to follow the domain as well as precede it.
+	positional := fs.Args()
+	if len(positional) > 1 {
+		_ = fs.Parse(positional[1:])
+		positional = slices.Concat(positional[:1], fs.Args())
+	}
+	if len(positional) != 1 || *certFile == "" || *keyFile == "" {
+		fs.Usage()
+		return 2
+	}
+	domain, err := config.NormalizeDomain(positional[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	certData, err := os.ReadFile(*certFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	keyData, err := os.ReadFile(*keyFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	appConfig, storage, err := loadStorage(*configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	group := domainGroupFor(*domainsFile, domain)
+	if err := acme.ImportCert(storage, appConfig.LocalCertDir, group, certData, keyData); err != nil {
+		fmt.Fprintf(os.Stderr, "error importing certificate for %s: %v\n", domain, err)
+		return 1
+	}
+	fmt.Printf("Imported certificate for %s\n", strings.Join(group, ", "))
+	return 0
+}
+
+// rollbackCommand makes an archived version of a domain's certificate current again, or lists
+// the archived versions when none is given.
+func rollbackCommand(args []string) int {
+	fs, configFile, domainsFile := commandFlags("rollback")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: loadmaster rollback [flags] <domain> [<version>]")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		fs.Usage()
+		return 2
+	}
+	domain, err := config.NormalizeDomain(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	appConfig, storage, err := loadStorage(*configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	archiver, ok := storage.(acme.CertArchiver)
+	if !ok {
+		fmt.Fprintln(os.Stderr, "storage does not keep archived certificates; archives are kept in S3 storage")
+		return 1
+	}
+	domainRoot := acme.DomainRoot(domainGroupFor(*domainsFile, domain))
+	if fs.NArg() == 1 {
+		versions, err := archiver.ListArchivedCerts(domainRoot)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if len(versions) == 0 {
+			fmt.Fprintf(os.Stderr, "no archived certificates for %s\n", domainRoot)
+			return 1
+		}
+		for _, version := range versions {
+			fmt.Println(version)
+		}
+		return 0
+	}
+	if err := acme.RollbackCert(storage, appConfig.LocalCertDir, domainRoot, fs.Arg(1)); err != nil {
+		fmt.Fprintf(os.Stderr, "error rolling back certificate for %s: %v\n", domainRoot, err)
+		return 1
+	}
+	fmt.Printf("Rolled back certificate for %s to %s\n", domainRoot, fs.Arg(1))
+	return 0
+}
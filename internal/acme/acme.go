@@ -4,17 +4,22 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
 	"time"
 
 	"log/slog"
 
 	"github.com/go-acme/lego/v4/certcrypto"
 	"github.com/go-acme/lego/v4/certificate"
-	"github.com/go-acme/lego/v4/challenge/http01"
-
-	// TODO Implement TLS-ALPN-01 challenge
-	// "github.com/go-acme/lego/v4/challenge/tlsalpn01"
 	"github.com/go-acme/lego/v4/lego"
 	"github.com/go-acme/lego/v4/registration"
 )
@@ -22,16 +27,101 @@ import (
 const CAAuthorityLetsEncryptStaging = "https://acme-staging-v02.api.letsencrypt.org/directory"
 const CAAuthorityLetsEncryptProduction = "https://acme-v02.api.letsencrypt.org/directory"
 
+// Directory URLs of other public ACME CAs. Any https directory URL works as a CA authority;
+// these are provided for convenience.
+const (
+	CAAuthorityBuypassStaging    = "https://api.test4.buypass.no/acme/directory"
+	CAAuthorityBuypassProduction = "https://api.buypass.com/acme/directory"
+	CAAuthorityGoogleStaging     = "https://dv.acme-v02.test-api.pki.goog/directory"
+	CAAuthorityGoogleProduction  = "https://dv.acme-v02.api.pki.goog/directory"
+	CAAuthorityZeroSSL           = "https://acme.zerossl.com/v2/DV90"
+)
+
 var HTTPChallengePort = 5002
 
+// Certificate bundling modes for CertBundle.
+const (
+	// CertBundleFull writes the leaf and issuer chain together in cert.pem.
+	CertBundleFull = "bundle"
+	// CertBundleLeafAndChain writes the leaf to cert.pem and the issuer chain to chain.pem.
+	CertBundleLeafAndChain = "leaf+chain"
+	// CertBundleLeaf writes only the leaf to cert.pem.
+	CertBundleLeaf = "leaf"
+)
+
+// CertBundle selects how issued certificates and their chain are written. See the CertBundle* constants.
+var CertBundle = CertBundleFull
+
+// validateCAAuthority checks that caAuthority looks like an ACME directory URL.
+func validateCAAuthority(caAuthority string) error {
+	u, err := url.Parse(caAuthority)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("%q is not an https URL", caAuthority)
+	}
+	return nil
+}
+
+// logCAAuthority logs which CA certificates will be requested from, warning only when the
+// directory URL is malformed.
+func logCAAuthority(caAuthority string) {
+	switch caAuthority {
+	case CAAuthorityLetsEncryptProduction:
+		slog.Warn("Using Let's Encrypt PRODUCTION CA Authority", "CAAuthority", caAuthority)
+	case CAAuthorityLetsEncryptStaging:
+		slog.Info("Using Let's Encrypt Staging CA Authority", "CAAuthority", caAuthority)
+	default:
+		if err := validateCAAuthority(caAuthority); err != nil {
+			slog.Warn("CA Authority is not a valid ACME directory URL", "CAAuthority", caAuthority, "error", err)
+			return
+		}
+		slog.Info("Using CA Authority", "CAAuthority", caAuthority)
+	}
+}
+
+// ErrCertNotFound is returned (wrapped) by DownloadCert when storage holds no certificate for
+// the domain yet, which means it needs its initial issuance rather than that storage failed.
+var ErrCertNotFound = errors.New("certificate not found")
+
 type ACMEStorage interface {
 	SaveCert(domainRoot string, cert, privateKey []byte) error
+	SaveOCSP(domainRoot string, ocspResp []byte) error
+	SaveChain(domainRoot string, chain []byte) error
 	DownloadCert(domainRoot string) ([]byte, []byte, error)
 	LoadUser(emailAddress string) (DomainUser, error)
 	SaveUser(user DomainUser) error
 	SaveRegistration(reg *registration.Resource) error
 	LoadRegistration() (*registration.Resource, error)
+	// LoadRenewalHistory returns an empty history if none has been saved yet.
+	LoadRenewalHistory() (RenewalHistory, error)
+	SaveRenewalHistory(history RenewalHistory) error
 	UpdateTLS(domainGroup []string) error
+	// DeleteCert removes everything stored for domainRoot: certificate, key, chain and OCSP
+	// response, including the installed copy. Deleting a certificate that doesn't exist is not
+	// an error.
+	DeleteCert(domainRoot string) error
+	// CertLocation returns the paths that servers should read the certificate and key for domainRoot from.
+	CertLocation(domainRoot string) (certPath, keyPath string)
+}
+
+// AccessChecker is implemented by storages that can verify they are reachable and usable
+// without changing anything.
+type AccessChecker interface {
+	CheckAccess() error
+}
+
+// WriteChecker is implemented by storages that can verify they are writable, by writing,
+// reading back and deleting a test object or file.
+type WriteChecker interface {
+	CheckWrite() error
+}
+
+// CertLister is implemented by storages that can enumerate the domain roots they hold a
+// certificate for, in storage or installed in the cert directory.
+type CertLister interface {
+	ListCerts() ([]string, error)
 }
 
 type resource struct {
@@ -44,6 +134,17 @@ type resource struct {
 	CSR               []byte `json:"-"`
 }
 
+// accountNamespace returns a path element identifying caAuthority, so that accounts and
+// registrations for different CAs (e.g. Let's Encrypt staging and production) never collide.
+func accountNamespace(caAuthority string) string {
+	sum := sha256.Sum256([]byte(caAuthority))
+	hash := hex.EncodeToString(sum[:])[:12]
+	if u, err := url.Parse(caAuthority); err == nil && u.Host != "" {
+		return u.Host + "-" + hash
+	}
+	return hash
+}
+
 func createNewACMEUser(emailAddress string) (DomainUser, error) {
 	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
@@ -96,11 +197,47 @@ func getACMERegistration(client *lego.Client, storage ACMEStorage) (*registratio
 	return reg, nil
 }
 
+// CARootCerts, when set, is the pool used to verify the ACME server's TLS certificate, for
+// private CAs whose root is not publicly trusted.
+var CARootCerts *x509.CertPool
+
+// UserAgent is sent to the ACME server, after lego's own user agent, to identify the instance.
+var UserAgent = ""
+
+// ClientCertificate, when set, is presented to the ACME server for mutual TLS.
+var ClientCertificate *tls.Certificate
+
+// LoadCARootCerts returns the system roots plus the PEM certificates in filename.
+func LoadCARootCerts(filename string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading CA root certificate file: %w", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no PEM certificates found in %s", filename)
+	}
+	return pool, nil
+}
+
 func getACMEClient(user DomainUser, caAuthority string) (*lego.Client, error) {
 	config := lego.NewConfig(&user)
 
 	config.CADirURL = caAuthority
 	config.Certificate.KeyType = certcrypto.RSA2048
+	config.UserAgent = UserAgent
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxyFunc()
+	if CARootCerts != nil || ClientCertificate != nil {
+		transport.TLSClientConfig = &tls.Config{RootCAs: CARootCerts}
+		if ClientCertificate != nil {
+			transport.TLSClientConfig.Certificates = []tls.Certificate{*ClientCertificate}
+		}
+	}
+	config.HTTPClient = &http.Client{Timeout: config.HTTPClient.Timeout, Transport: transport}
 
 	// A client facilitates communication with the CA server.
 	client, err := lego.NewClient(config)
@@ -121,18 +258,10 @@ func getRegisteredACMEClient(domainUserEmail string, storage ACMEStorage, caAuth
 		return nil, fmt.Errorf("error getting ACME client: %w", err)
 	}
 
-	// Proxy challenge traffic to port <HTTPChallengePort>.
-	err = client.Challenge.SetHTTP01Provider(http01.NewProviderServer("", fmt.Sprint(HTTPChallengePort)))
-	if err != nil {
-		return nil, fmt.Errorf("error setting http01 provider: %w", err)
+	if err := setChallengeProviders(client, storage); err != nil {
+		return nil, err
 	}
 
-	// TODO: Implement TLS-ALPN-01 challenge
-	// err = client.Challenge.SetTLSALPN01Provider(tlsalpn01.NewProviderServer("", "5001"))
-	// if err != nil {
-	// 	return nil, fmt.Errorf("error setting tlsalpn01 provider: %w", err)
-	// }
-
 	// Load the registration information
 	if myUser.Registration == nil {
 		reg, err := getACMERegistration(client, storage)
@@ -146,22 +275,53 @@ func getRegisteredACMEClient(domainUserEmail string, storage ACMEStorage, caAuth
 	return client, nil
 }
 
+// PreferredChain selects among the alternate chains a CA offers: the chain whose top
+// certificate's issuer common name matches is used. When empty, the CA's default chain is used.
+var PreferredChain = ""
+
+// acmeMu serializes loading or creating the ACME account; see generateTLS.
+var acmeMu sync.Mutex
+
 func generateTLS(domainUserEmail string, domains []string, acmeStorage ACMEStorage, caAuthority string) (*resource, error) {
 	slog.Debug("Generating TLS certificate", "userEmail", domainUserEmail, "domains", domains)
+	if err := validateIPSANs(domains, caAuthority); err != nil {
+		return nil, err
+	}
+	if CAACheck {
+		if err := checkCAA(domains, caAuthority); err != nil {
+			slog.Error("CAA pre-check failed; not requesting certificate", "domains", domains, "error", err)
+			return nil, fmt.Errorf("CAA pre-check failed: %w", err)
+		}
+	}
+	// The account is shared by all domain groups, so concurrent UpdateTLS calls take turns
+	// loading or creating it. Orders then proceed in parallel; their HTTP-01 tokens are all
+	// served by sharedChallengeServer.
+	acmeMu.Lock()
 	client, err := getRegisteredACMEClient(domainUserEmail, acmeStorage, caAuthority)
+	acmeMu.Unlock()
 	if err != nil {
 		return nil, fmt.Errorf("error getting ACME client: %w", err)
 	}
 
-	request := certificate.ObtainRequest{
-		Domains: domains,
-		Bundle:  true,
-	}
-	certificates, err := client.Certificate.Obtain(request)
+	certificates, err := obtainWithTimeout(domains, func() (*certificate.Resource, error) {
+		if subject, ok := subjectFor(domains); ok {
+			return obtainWithSubject(client, domains, subject, caAuthority)
+		}
+		return client.Certificate.Obtain(certificate.ObtainRequest{
+			Domains:        domains,
+			Bundle:         CertBundle == CertBundleFull,
+			MustStaple:     MustStaple,
+			PreferredChain: PreferredChain,
+		})
+	})
 	if err != nil {
 		return nil, fmt.Errorf("error obtaining certificate: %w", err)
 	}
-	domainRoot := domains[0]
+	if issuers, err := parseCertificateBundle(certificates.IssuerCertificate); err == nil {
+		top := issuers[len(issuers)-1]
+		slog.Info("Certificate chain selected", "domains", domains, "chainTopIssuer", top.Issuer.CommonName, "preferredChain", PreferredChain)
+	}
+	domainRoot := DomainRoot(domains)
 	return &resource{
 		Domain:            domainRoot,
 		CertURL:           certificates.CertURL,
@@ -180,30 +340,42 @@ type renewACMECertificateParams struct {
 	s              ACMEStorage
 }
 
-// renewACMECertificate renews the certificate in the given folder.
-func renewACMECertificate(p renewACMECertificateParams) (certificate, privateKey []byte, err error) {
+// renewACMECertificate renews the certificate in the given folder. chain is only returned
+// when CertBundle is CertBundleLeafAndChain.
+func renewACMECertificate(p renewACMECertificateParams) (certificate, privateKey, chain []byte, err error) {
 	slog.Info("Renewing ACME certificate", "domains", p.domains)
 
+	domainRoot := DomainRoot(p.domains)
+	if retryAfter, ok := rateLimitBackoff(domainRoot); ok {
+		return nil, nil, nil, fmt.Errorf("not renewing %s: rate limited by the CA until %s", domainRoot, retryAfter.Format(time.RFC3339))
+	}
+
+	if VerifyWithStaging {
+		if err := verifyWithStaging(p.email, p.domains, p.s, p.caAuthorityURL); err != nil {
+			return nil, nil, nil, fmt.Errorf("staging verification failed for %s; production was not attempted: %v", p.domains, err)
+		}
+	}
+
 	certificateData, err := generateTLS(p.email, p.domains, p.s, p.caAuthorityURL)
 	if err != nil {
-		return nil, nil, fmt.Errorf("error while generating TLS certificate for %s: %v", p.domains, err)
+		recordRateLimit(domainRoot, err)
+		return nil, nil, nil, fmt.Errorf("error while generating TLS certificate for %s: %v", p.domains, err)
 	}
 
 	// Parse the renewed certificate
 	slog.Debug("Parsing renewed certificate")
-	cert, err := parseCertificate(certificateData.Certificate)
+	cert, err := ParseCertificate(certificateData.Certificate)
 	if err != nil {
-		return nil, nil, fmt.Errorf("error while parsing certificate %s", err)
+		return nil, nil, nil, fmt.Errorf("error while parsing certificate %s", err)
 	}
 
-	// Get the expiration date of the certificate
-	expirationDate := cert.NotAfter
-
-	slog.Info("Certificate renewed successfully")
-	// Calculate the remaining days until expiration
-	remainingDays := int(time.Until(expirationDate).Hours() / 24)
-
-	slog.Info("The certificate was renewed", "daysRemainingUntilExpiry", remainingDays)
+	slog.Info("The certificate was renewed", "daysRemainingUntilExpiry", CertRemainingDays(cert))
+	if SCTCheck {
+		checkSCTs(cert)
+	}
 
-	return certificateData.Certificate, certificateData.PrivateKey, nil
+	if CertBundle == CertBundleLeafAndChain {
+		chain = certificateData.IssuerCertificate
+	}
+	return certificateData.Certificate, certificateData.PrivateKey, chain, nil
 }
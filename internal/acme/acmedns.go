@@ -0,0 +1,123 @@
+package acme
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/go-acme/lego/v4/challenge/dns01"
+	"github.com/nrdcg/goacmedns"
+)
+
+// ACMEDNSAccount is an acme-dns account: the credentials updating the TXT record of FullDomain,
+// to which the domain's _acme-challenge name is delegated by CNAME.
+type ACMEDNSAccount = goacmedns.Account
+
+// ACMEDNSAccountStore is implemented by storages that keep the acme-dns accounts registered by
+// loadmaster, keyed by domain, so they survive restarts and are shared by the instances using
+// the storage.
+type ACMEDNSAccountStore interface {
+	// LoadACMEDNSAccounts returns an empty map if no account has been saved yet.
+	LoadACMEDNSAccounts() (map[string]ACMEDNSAccount, error)
+	SaveACMEDNSAccounts(accounts map[string]ACMEDNSAccount) error
+}
+
+// acmeDNSRegisterMu serializes the registration of acme-dns accounts, so concurrent sweeps of
+// two domain groups don't overwrite each other's new account in storage.
+var acmeDNSRegisterMu sync.Mutex
+
+// acmeDNSProvider solves DNS-01 challenges by updating the TXT record of an acme-dns server,
+// for domains whose _acme-challenge name is a CNAME to the account's subdomain there.
+type acmeDNSProvider struct {
+	client    *goacmedns.Client
+	apiBase   string
+	allowFrom []string
+	// accounts are the configured accounts, tried before the ones kept in storage.
+	accounts map[string]ACMEDNSAccount
+	storage  ACMEStorage
+}
+
+// ACMEDNSChallengeProvider returns a DNS-01 solver updating TXT records through the acme-dns
+// server at apiBase, with the configured accounts by domain. Domains without one get an account
+// registered on first use, restricted to the allowFrom CIDRs and saved in storage; issuance
+// fails until the CNAME logged for it is created.
+func ACMEDNSChallengeProvider(apiBase string, allowFrom []string, accounts map[string]ACMEDNSAccount) (ChallengeProvider, error) {
+	client, err := goacmedns.NewClient(apiBase)
+	if err != nil {
+		return nil, fmt.Errorf("error creating acme-dns client: %w", err)
+	}
+	return &acmeDNSProvider{
+		client:    client,
+		apiBase:   apiBase,
+		allowFrom: allowFrom,
+		accounts:  accounts,
+	}, nil
+}
+
+func (p *acmeDNSProvider) ChallengeType() challenge.Type { return challenge.DNS01 }
+
+// withStorage returns a copy of p keeping registered accounts in storage.
+func (p *acmeDNSProvider) withStorage(storage ACMEStorage) *acmeDNSProvider {
+	bound := *p
+	bound.storage = storage
+	return &bound
+}
+
+func (p *acmeDNSProvider) Present(domain, _, keyAuth string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	info := dns01.GetChallengeInfo(domain, keyAuth)
+	account, err := p.account(ctx, domain, info.FQDN)
+	if err != nil {
+		return err
+	}
+	if err := p.client.UpdateTXTRecord(ctx, account, info.Value); err != nil {
+		return fmt.Errorf("error updating acme-dns TXT record for %s: %w", domain, err)
+	}
+	return nil
+}
+
+// CleanUp does nothing: acme-dns keeps the last two TXT values of an account and the next
+// challenge replaces them.
+func (p *acmeDNSProvider) CleanUp(_, _, _ string) error {
+	return nil
+}
+
+// account returns domain's configured or stored account, registering one if there is none.
+func (p *acmeDNSProvider) account(ctx context.Context, domain, fqdn string) (ACMEDNSAccount, error) {
+	if account, ok := p.accounts[domain]; ok {
+		return account, nil
+	}
+	store, ok := p.storage.(ACMEDNSAccountStore)
+	if !ok {
+		return ACMEDNSAccount{}, fmt.Errorf("no acme-dns account configured for %s, and the storage can't keep registered ones", domain)
+	}
+	acmeDNSRegisterMu.Lock()
+	defer acmeDNSRegisterMu.Unlock()
+	accounts, err := store.LoadACMEDNSAccounts()
+	if err != nil {
+		return ACMEDNSAccount{}, fmt.Errorf("error loading acme-dns accounts: %w", err)
+	}
+	if account, ok := accounts[domain]; ok {
+		return account, nil
+	}
+	account, err := p.client.RegisterAccount(ctx, p.allowFrom)
+	if err != nil {
+		return ACMEDNSAccount{}, fmt.Errorf("error registering acme-dns account for %s: %w", domain, err)
+	}
+	account.ServerURL = p.apiBase
+	if accounts == nil {
+		accounts = map[string]ACMEDNSAccount{}
+	}
+	accounts[domain] = account
+	if err := store.SaveACMEDNSAccounts(accounts); err != nil {
+		return ACMEDNSAccount{}, fmt.Errorf("error saving acme-dns account for %s: %w", domain, err)
+	}
+	slog.Warn("Registered acme-dns account; create the CNAME record before the next attempt",
+		"domain", domain, "record", dns01.UnFqdn(fqdn), "target", account.FullDomain)
+	return ACMEDNSAccount{}, fmt.Errorf("registered acme-dns account for %s: create the DNS record %q CNAME %q, then retry",
+		domain, dns01.UnFqdn(fqdn), account.FullDomain)
+}
@@ -0,0 +1,61 @@
+package acme
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/go-acme/lego/v4/challenge/tlsalpn01"
+)
+
+// TLSALPNChallenge enables the TLS-ALPN-01 challenge, which lego prefers over HTTP-01 when the
+// CA offers both. It has no listener of its own: the challenge certificates are served by the
+// callback from GetCertificateFunc, i.e. by the proxy's TLS listener, which must be reachable on
+// port 443.
+var TLSALPNChallenge = false
+
+// alpnChallengeProvider holds the TLS-ALPN-01 challenge certificates of all in-flight orders,
+// keyed by domain.
+type alpnChallengeProvider struct {
+	mu    sync.Mutex
+	certs map[string]*tls.Certificate
+}
+
+var sharedALPNProvider = &alpnChallengeProvider{certs: make(map[string]*tls.Certificate)}
+
+func (p *alpnChallengeProvider) Present(domain, token, keyAuth string) error {
+	cert, err := tlsalpn01.ChallengeCert(domain, keyAuth)
+	if err != nil {
+		return fmt.Errorf("error creating TLS-ALPN-01 challenge certificate for %s: %w", domain, err)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.certs[strings.ToLower(domain)] = cert
+	slog.Debug("Presenting TLS-ALPN-01 challenge", "domain", domain)
+	return nil
+}
+
+func (p *alpnChallengeProvider) CleanUp(domain, token, keyAuth string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.certs, strings.ToLower(domain))
+	return nil
+}
+
+// challengeCertificate returns the challenge certificate for a TLS-ALPN-01 validation
+// handshake. ok is false when hello is an ordinary client handshake.
+func (p *alpnChallengeProvider) challengeCertificate(hello *tls.ClientHelloInfo) (cert *tls.Certificate, ok bool, err error) {
+	if !slices.Contains(hello.SupportedProtos, tlsalpn01.ACMETLS1Protocol) {
+		return nil, false, nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	cert, found := p.certs[strings.ToLower(hello.ServerName)]
+	if !found {
+		return nil, true, fmt.Errorf("no TLS-ALPN-01 challenge pending for %q", hello.ServerName)
+	}
+	return cert, true, nil
+}
@@ -0,0 +1,167 @@
+package acme
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// CertArchiver is implemented by storages that keep a copy of every certificate saved, so a
+// previous one can be restored.
+type CertArchiver interface {
+	// ListArchivedCerts returns the archived versions of domainRoot's certificate, oldest first.
+	ListArchivedCerts(domainRoot string) ([]string, error)
+	// LoadArchivedCert returns the certificate and key archived as version.
+	LoadArchivedCert(domainRoot, version string) ([]byte, []byte, error)
+}
+
+// archiveVersionFormat names archived versions by the UTC time they were saved, so they sort
+// chronologically.
+const archiveVersionFormat = "20060102T150405Z"
+
+// archivePrefix is the S3 prefix holding the archived versions of domainRoot's certificate.
+func (s *S3ACMEStorage) archivePrefix(domainRoot string) string {
+	return path.Join(s.serviceName, "certs", domainRoot, "archive") + "/"
+}
+
+// archiveCert uploads a copy of the certificate and key saved for domainRoot under a new
+// archive version, then prunes the oldest versions beyond maxArchiveVersions.
+func (s *S3ACMEStorage) archiveCert(ctx context.Context, domainRoot string, cert, privateKey []byte, tagging string) error {
+	version := time.Now().UTC().Format(archiveVersionFormat)
+	prefix := s.archivePrefix(domainRoot) + version
+	for name, data := range map[string][]byte{"cert.pem": cert, "privkey.pem": privateKey} {
+		_, err := s.uploader.Upload(ctx, &s3.PutObjectInput{
+			Bucket:   aws.String(s.bucketName),
+			Key:      aws.String(path.Join(prefix, name)),
+			Body:     bytes.NewReader(data),
+			Tagging:  aws.String(tagging),
+			Metadata: checksumMetadata(data),
+		})
+		if err != nil {
+			return fmt.Errorf("error archiving %s: %w", path.Join(prefix, name), err)
+		}
+	}
+	slog.Debug("Archived certificate", "domain", domainRoot, "version", version)
+	if s.maxArchiveVersions <= 0 {
+		return nil
+	}
+	versions, err := s.listArchivedCerts(ctx, domainRoot)
+	if err != nil {
+		return err
+	}
+	if len(versions) <= s.maxArchiveVersions {
+		return nil
+	}
+	var objects []types.ObjectIdentifier
+	for _, old := range versions[:len(versions)-s.maxArchiveVersions] {
+		for _, name := range []string{"cert.pem", "privkey.pem"} {
+			objects = append(objects, types.ObjectIdentifier{Key: aws.String(s.archivePrefix(domainRoot) + old + "/" + name)})
+		}
+	}
+	out, err := s.s3Client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+		Bucket: aws.String(s.bucketName),
+		Delete: &types.Delete{Objects: objects, Quiet: aws.Bool(true)},
+	})
+	if err != nil {
+		return fmt.Errorf("error pruning archived certificates of %s: %w", domainRoot, err)
+	}
+	if len(out.Errors) > 0 {
+		first := out.Errors[0]
+		return fmt.Errorf("error pruning %d archived object(s) of %s, e.g. %s: %s", len(out.Errors), domainRoot, aws.ToString(first.Key), aws.ToString(first.Message))
+	}
+	slog.Info("Pruned archived certificates", "domain", domainRoot, "versions", len(versions)-s.maxArchiveVersions)
+	return nil
+}
+
+// ListArchivedCerts returns the archived versions of domainRoot's certificate in the bucket,
+// oldest first.
+func (s *S3ACMEStorage) ListArchivedCerts(domainRoot string) ([]string, error) {
+	ctx, cancel := s.opContext()
+	defer cancel()
+	return s.listArchivedCerts(ctx, domainRoot)
+}
+
+func (s *S3ACMEStorage) listArchivedCerts(ctx context.Context, domainRoot string) ([]string, error) {
+	prefix := s.archivePrefix(domainRoot)
+	var versions []string
+	pages := s3.NewListObjectsV2Paginator(s.s3Client, &s3.ListObjectsV2Input{
+		Bucket:    aws.String(s.bucketName),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error listing archived certificates under %s: %w", prefix, err)
+		}
+		for _, common := range page.CommonPrefixes {
+			versions = append(versions, strings.TrimSuffix(strings.TrimPrefix(aws.ToString(common.Prefix), prefix), "/"))
+		}
+	}
+	slices.Sort(versions)
+	return versions, nil
+}
+
+// LoadArchivedCert downloads the certificate and key archived for domainRoot as version.
+func (s *S3ACMEStorage) LoadArchivedCert(domainRoot, version string) ([]byte, []byte, error) {
+	if _, err := time.Parse(archiveVersionFormat, version); err != nil {
+		return nil, nil, fmt.Errorf("invalid archive version %q: must look like %s", version, archiveVersionFormat)
+	}
+	ctx, cancel := s.opContext()
+	defer cancel()
+	prefix := s.archivePrefix(domainRoot) + version
+	var data [2][]byte
+	for i, name := range []string{"cert.pem", "privkey.pem"} {
+		var err error
+		data[i], err = s.getObject(ctx, path.Join(prefix, name))
+		if isNotFound(err) {
+			return nil, nil, fmt.Errorf("%w: no archived version %s for %s", ErrCertNotFound, version, domainRoot)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("error downloading %s: %w", path.Join(prefix, name), err)
+		}
+	}
+	return data[0], data[1], nil
+}
+
+// RollbackCert makes the certificate archived for domainRoot as version current again: it is
+// saved to storage, which archives it as a new version, and installed in certDir. The
+// certificate must still be valid.
+func RollbackCert(storage ACMEStorage, certDir, domainRoot, version string) error {
+	archiver, ok := storage.(CertArchiver)
+	if !ok {
+		return fmt.Errorf("storage does not keep archived certificates")
+	}
+	certPEM, keyPEM, err := archiver.LoadArchivedCert(domainRoot, version)
+	if err != nil {
+		return err
+	}
+	if err := verifyKeyMatchesCert(certPEM, keyPEM); err != nil {
+		return err
+	}
+	cert, err := ParseLeafCertificate(certPEM, domainRoot)
+	if err != nil {
+		return err
+	}
+	if time.Now().After(cert.NotAfter) {
+		return fmt.Errorf("archived certificate expired on %s", cert.NotAfter.Format(time.DateOnly))
+	}
+	if err := storage.SaveCert(domainRoot, certPEM, keyPEM); err != nil {
+		return fmt.Errorf("error saving cert to storage: %w", err)
+	}
+	if err := writeCertToFilesToDisk(certDir, domainRoot, certPEM, keyPEM); err != nil {
+		return fmt.Errorf("error writing certificate to disk: %w", err)
+	}
+	runPostRenewHook(certDir, domainRoot)
+	slog.Info("Rolled back certificate", "domain", domainRoot, "version", version, "notAfter", cert.NotAfter)
+	return nil
+}
@@ -0,0 +1,148 @@
+package acme
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// CAACheck enables a DNS CAA pre-flight in generateTLS so that domains whose CAA records do not
+// permit the configured CA are skipped before spending ACME rate-limit budget.
+var CAACheck = false
+
+// CAAIdentity is the CAA issuer domain of the configured CA (e.g. "letsencrypt.org"). When empty
+// it is derived from the CA authority URL for known CAs.
+var CAAIdentity = ""
+
+// caaIdentities maps known ACME directory URLs to the issuer domain they publish for CAA.
+var caaIdentities = map[string]string{
+	CAAuthorityLetsEncryptProduction: "letsencrypt.org",
+	CAAuthorityLetsEncryptStaging:    "letsencrypt.org",
+	CAAuthorityBuypassProduction:     "buypass.com",
+	CAAuthorityBuypassStaging:        "buypass.com",
+	CAAuthorityGoogleProduction:      "pki.goog",
+	CAAuthorityGoogleStaging:         "pki.goog",
+	CAAuthorityZeroSSL:               "sectigo.com",
+}
+
+var (
+	caaCacheMu sync.Mutex
+	// caaCache holds the CAA records found for a domain, keyed by domain.
+	caaCache = make(map[string][]*dns.CAA)
+)
+
+// ResetCAACache forgets all cached CAA lookups. It is called at the start of each sweep so
+// results are reused within a sweep but DNS changes are picked up by the next one.
+func ResetCAACache() {
+	caaCacheMu.Lock()
+	defer caaCacheMu.Unlock()
+	caaCache = make(map[string][]*dns.CAA)
+}
+
+// checkCAA verifies that the CAA records for every domain permit the configured CA.
+func checkCAA(domains []string, caAuthority string) error {
+	identity := CAAIdentity
+	if identity == "" {
+		identity = caaIdentities[caAuthority]
+	}
+	if identity == "" {
+		slog.Warn("CAA check skipped: no CAA identity known for CA authority; set caaIdentity", "CAAuthority", caAuthority)
+		return nil
+	}
+	for _, domain := range domains {
+		// CAA only applies to DNS names.
+		if isIPAddress(domain) {
+			continue
+		}
+		wildcard := strings.HasPrefix(domain, "*.")
+		records, err := lookupCAA(strings.TrimPrefix(domain, "*."))
+		if err != nil {
+			return fmt.Errorf("error looking up CAA records for %s: %w", domain, err)
+		}
+		if !caaPermits(records, identity, wildcard) {
+			var found []string
+			for _, rr := range records {
+				found = append(found, rr.String())
+			}
+			return fmt.Errorf("CAA records for %s do not permit %s: %s", domain, identity, strings.Join(found, "; "))
+		}
+	}
+	return nil
+}
+
+// caaPermits applies the RFC 8659 issue/issuewild rules to the relevant CAA record set.
+func caaPermits(records []*dns.CAA, identity string, wildcard bool) bool {
+	var issue, issueWild []*dns.CAA
+	for _, rr := range records {
+		switch strings.ToLower(rr.Tag) {
+		case "issue":
+			issue = append(issue, rr)
+		case "issuewild":
+			issueWild = append(issueWild, rr)
+		}
+	}
+	relevant := issue
+	if wildcard && len(issueWild) > 0 {
+		relevant = issueWild
+	}
+	if len(relevant) == 0 {
+		return true
+	}
+	for _, rr := range relevant {
+		issuer, _, _ := strings.Cut(rr.Value, ";")
+		if strings.EqualFold(strings.TrimSpace(issuer), identity) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupCAA returns the CAA record set that applies to domain, climbing towards the root until
+// one is found. An empty result means no CAA restrictions apply.
+func lookupCAA(domain string) ([]*dns.CAA, error) {
+	caaCacheMu.Lock()
+	records, ok := caaCache[domain]
+	caaCacheMu.Unlock()
+	if ok {
+		return records, nil
+	}
+
+	clientConfig, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+	if err != nil || len(clientConfig.Servers) == 0 {
+		return nil, fmt.Errorf("error reading resolver configuration: %v", err)
+	}
+	server := net.JoinHostPort(clientConfig.Servers[0], clientConfig.Port)
+
+	client := new(dns.Client)
+	labels := dns.SplitDomainName(domain)
+	for i := range labels {
+		name := dns.Fqdn(strings.Join(labels[i:], "."))
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeCAA)
+		msg.RecursionDesired = true
+		resp, _, err := client.Exchange(msg, server)
+		if err != nil {
+			return nil, err
+		}
+		if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+			return nil, fmt.Errorf("CAA query for %s returned %s", name, dns.RcodeToString[resp.Rcode])
+		}
+		for _, rr := range resp.Answer {
+			if caa, ok := rr.(*dns.CAA); ok {
+				records = append(records, caa)
+			}
+		}
+		if len(records) > 0 {
+			break
+		}
+	}
+
+	caaCacheMu.Lock()
+	caaCache[domain] = records
+	caaCacheMu.Unlock()
+	return records, nil
+}
@@ -1,19 +1,28 @@
 package acme
 
 import (
+	"bytes"
+	"crypto/tls"
 	"crypto/x509"
-	"encoding/pem"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"log/slog"
 	"os"
-	"path"
 	"path/filepath"
-	"strconv"
+	"slices"
+	"strings"
 	"time"
+
+	"github.com/joshuaschlichting/loadmaster/internal/config"
+	"github.com/joshuaschlichting/loadmaster/internal/metrics"
 )
 
-var loadmasterHomeDir = path.Join(os.Getenv("HOME"), ".loadmaster")
-var localCertDir = filepath.Join(loadmasterHomeDir, "certs")
+// defaultCertDir is the cert directory used by storages constructed without one: certs under
+// config.Dir.
+func defaultCertDir() string {
+	return filepath.Join(config.Dir, "certs")
+}
 
 // MaxRemainingDaysBeforeCertExpiry is the maximum number of days before a certificate expires that it should be renewed.
 var MaxRemainingDaysBeforeCertExpiry = 60
@@ -26,98 +35,441 @@ func init() {
 	}
 }
 
-func removeExisting(domain string) {
-	filepath := filepath.Join(localCertDir, domain)
-	err := os.RemoveAll(filepath)
-	if err != nil {
-		slog.Debug(fmt.Sprintf("Failed to remove %s: %v", filepath, err))
-	}
+// ParseCertificate parses a PEM-encoded certificate. For a bundle, the leaf certificate is
+// returned; see ParseLeafCertificate.
+func ParseCertificate(certBytes []byte) (*x509.Certificate, error) {
+	return ParseLeafCertificate(certBytes, "")
 }
 
-// parseCertificate parses a PEM-encoded certificate.
-func parseCertificate(certBytes []byte) (*x509.Certificate, error) {
-	block, _ := pem.Decode(certBytes)
-	if block == nil {
+// ParseLeafCertificate decodes every certificate in the PEM bundle certBytes, in whatever order
+// they are listed, and returns the leaf: the certificate valid for domain when domain is set
+// and one is, and otherwise the one that isn't a CA and didn't issue another certificate of the
+// bundle.
+func ParseLeafCertificate(certBytes []byte, domain string) (*x509.Certificate, error) {
+	if len(certBytes) == 0 {
 		return nil, fmt.Errorf("failed to decode PEM certificate: cert bytes == nil")
 	}
-	if block.Type != "CERTIFICATE" {
-		return nil, fmt.Errorf("failed to decode PEM certificate. block type is not 'CERTIFICATE'")
+	certs, err := parseCertificateBundle(certBytes)
+	if err != nil {
+		return nil, err
 	}
+	return leafCertificate(certs, domain), nil
+}
 
-	cert, err := x509.ParseCertificate(block.Bytes)
-	if err != nil {
-		return nil, fmt.Errorf("error parsing certificate: %v", err)
+// leafCertificate picks the leaf among certs as described for ParseLeafCertificate, falling
+// back to the first certificate.
+func leafCertificate(certs []*x509.Certificate, domain string) *x509.Certificate {
+	if domain != "" {
+		for _, cert := range certs {
+			if !cert.IsCA && cert.VerifyHostname(domain) == nil {
+				return cert
+			}
+		}
+	}
+	for _, cert := range certs {
+		if cert.IsCA {
+			continue
+		}
+		issuesAnother := slices.ContainsFunc(certs, func(other *x509.Certificate) bool {
+			return other != cert && bytes.Equal(other.RawIssuer, cert.RawSubject) && other.CheckSignatureFrom(cert) == nil
+		})
+		if !issuesAnother {
+			return cert
+		}
 	}
+	return certs[0]
+}
 
-	return cert, nil
+// CertRemainingDays returns the number of whole days until cert expires, negative once it has.
+// Everything reporting remaining days uses it, so reports agree with the renewal decision.
+func CertRemainingDays(cert *x509.Certificate) int {
+	return int(time.Until(cert.NotAfter).Hours() / 24)
 }
 
-// CErtExpiresSoon checks the certificate in the given folder and renews it if it is expired or about to expire.
-func CertExpiresSoon(certData []byte, maxRemainingDaysBeforeCertExpiry int) (bool, error) {
+// shouldRenew reports whether a certificate with remainingDays of validity left is due for
+// renewal, i.e. it is within threshold days of expiry.
+func shouldRenew(remainingDays, threshold int) bool {
+	return remainingDays <= threshold
+}
 
-	// Parse the certificate
-	cert, err := parseCertificate(certData)
+// Renewal modes select how CertExpiresSoon decides that a certificate is due.
+const (
+	// RenewalModeFixed renews within MaxRemainingDaysBeforeCertExpiry days of expiry.
+	RenewalModeFixed = "fixed"
+	// RenewalModeLifetimeFraction renews once two thirds of the certificate's validity period
+	// has passed, plus a jitter, as Let's Encrypt recommends.
+	RenewalModeLifetimeFraction = "lifetime-fraction"
+)
+
+// RenewalMode is RenewalModeFixed or RenewalModeLifetimeFraction.
+var RenewalMode = RenewalModeFixed
+
+// lifetimeFractionRenewalTime returns when cert is due under RenewalModeLifetimeFraction: two
+// thirds into its actual validity period plus a jitter of up to a twelfth of that period. The
+// jitter is derived from the serial number, so every sweep and every instance sharing the
+// certificate reach the same decision.
+func lifetimeFractionRenewalTime(cert *x509.Certificate) time.Time {
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	h := fnv.New64a()
+	h.Write(cert.SerialNumber.Bytes())
+	jitter := time.Duration(h.Sum64() % uint64(lifetime/12+1))
+	return cert.NotBefore.Add(lifetime*2/3 + jitter)
+}
+
+// CertExpiresSoon reports whether the leaf certificate for domain in certData is due for
+// renewal under RenewalMode: in the fixed mode, when it expires within
+// maxRemainingDaysBeforeCertExpiry days. A certificate that cannot be parsed is due.
+func CertExpiresSoon(certData []byte, domain string, maxRemainingDaysBeforeCertExpiry int) (bool, error) {
+	cert, err := ParseLeafCertificate(certData, domain)
 	if err != nil {
 		return true, fmt.Errorf("error parsing certificate: %v", err)
 	}
 
-	// Get the expiration date of the certificate
-	expirationDate := cert.NotAfter
-	// Calculate the remaining days until expiration
-	remainingDays := int(time.Until(expirationDate).Hours() / 24)
-	slog.Debug("Certificate expiry date",
-		"expirationDate", expirationDate,
-		"remainingDays", remainingDays,
-		"maxRemainingDaysBeforeCertExpiry", maxRemainingDaysBeforeCertExpiry,
+	remainingDays := CertRemainingDays(cert)
+	if RenewalMode == RenewalModeLifetimeFraction {
+		renewAt := lifetimeFractionRenewalTime(cert)
+		if !time.Now().Before(renewAt) {
+			slog.Info("Certificate is due for renewal",
+				"subject", cert.Subject.CommonName,
+				"expirationDate", cert.NotAfter,
+				"daysRemaining", remainingDays,
+				"renewAt", renewAt,
+			)
+			return true, nil
+		}
+		slog.Debug("Certificate is still valid",
+			"subject", cert.Subject.CommonName,
+			"expirationDate", cert.NotAfter,
+			"daysRemaining", remainingDays,
+			"renewAt", renewAt,
+		)
+		return false, nil
+	}
+
+	if shouldRenew(remainingDays, maxRemainingDaysBeforeCertExpiry) {
+		slog.Info("Certificate is due for renewal",
+			"subject", cert.Subject.CommonName,
+			"expirationDate", cert.NotAfter,
+			"daysRemaining", remainingDays,
+			"maxRemainingDaysBeforeCertExpiry", maxRemainingDaysBeforeCertExpiry,
+		)
+		return true, nil
+	}
+	slog.Debug("Certificate is still valid",
+		"subject", cert.Subject.CommonName,
+		"expirationDate", cert.NotAfter,
+		"daysRemaining", remainingDays,
+		"daysUntilRenewal", remainingDays-maxRemainingDaysBeforeCertExpiry,
 	)
+	return false, nil
+}
 
-	// if maxRemainingDaysBeforeCertExpiry days or less until expiration, renew
-	if remainingDays <= maxRemainingDaysBeforeCertExpiry {
-		fmt.Println("Only " + strconv.Itoa(remainingDays) + " days until TLS cert expiration.")
+// GetLocalCertFilenames returns the certificate and private key paths for domain within certDir.
+func GetLocalCertFilenames(certDir, domain string) (string, string) {
+	return filepath.Join(certDir, domain, "cert.pem"), filepath.Join(certDir, domain, "privkey.pem")
+}
 
-		return true, nil
+// removeCertDir deletes the directory holding domainRoot's installed certificate files. A
+// missing directory is not an error.
+func removeCertDir(certDir, domainRoot string) error {
+	if domainRoot == "" || domainRoot == "." || domainRoot == ".." || strings.ContainsAny(domainRoot, `/\`) {
+		return fmt.Errorf("invalid domain root %q", domainRoot)
 	}
-	slog.Debug(fmt.Sprintf("Certificate is still valid for %d days. Days remaining until renewal: %d", remainingDays, remainingDays-maxRemainingDaysBeforeCertExpiry))
+	if err := os.RemoveAll(filepath.Join(certDir, domainRoot)); err != nil {
+		return fmt.Errorf("error removing certificate directory for %s: %w", domainRoot, err)
+	}
+	return nil
+}
 
-	return false, nil
+// listCertDirs returns the names of the directories in certDir that hold an installed
+// certificate. A missing certDir holds none.
+func listCertDirs(certDir string) ([]string, error) {
+	entries, err := os.ReadDir(certDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var roots []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if len(readFirstFile(filepath.Join(certDir, entry.Name()), "fullchain.pem", "cert.pem")) > 0 {
+			roots = append(roots, entry.Name())
+		}
+	}
+	return roots, nil
+}
+
+// writeFileAtomic writes data to a temp file in the same directory as filename and
+// renames it into place, so readers never observe a partially written file. Unless uid and gid
+// are both -1, the temp file is chowned to them before the rename, so the file never appears
+// with the wrong owner.
+func writeFileAtomic(filename string, data []byte, perm os.FileMode, uid, gid int) error {
+	tmp, err := stageFile(filename, data, perm, uid, gid)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// stageFile writes data to a synced temp file in the same directory as filename, with perm and
+// the owner described at writeFileAtomic, and returns its name for renaming into place.
+func stageFile(filename string, data []byte, perm os.FileMode, uid, gid int) (name string, err error) {
+	tmp, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp-*")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+	if err = tmp.Chmod(perm); err != nil {
+		_ = tmp.Close()
+		return "", err
+	}
+	if uid != -1 || gid != -1 {
+		if err = tmp.Chown(uid, gid); err != nil {
+			_ = tmp.Close()
+			return "", fmt.Errorf("failed to set owner of %s: %w", filename, err)
+		}
+	}
+	if _, err = tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return "", err
+	}
+	if err = tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return "", err
+	}
+	if err = tmp.Close(); err != nil {
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// CertFileMode and KeyFileMode are the permissions installed certificate files and private keys
+// are written with.
+var (
+	CertFileMode os.FileMode = 0644
+	KeyFileMode  os.FileMode = 0600
+)
+
+// CertFileUID and CertFileGID, when not -1, are the owner and group installed certificate files
+// and private keys are chowned to. They only take effect when running as root.
+var (
+	CertFileUID = -1
+	CertFileGID = -1
+)
+
+// writeInstalledFile writes one of the files installed in the cert directory with perm and the
+// configured owner.
+func writeInstalledFile(filename string, data []byte, perm os.FileMode) error {
+	uid, gid := installedFileOwner()
+	return writeFileAtomic(filename, data, perm, uid, gid)
 }
 
-func GetLocalCertFilenames(domain string) (string, string) {
-	return path.Join(localCertDir, domain, "cert.pem"), path.Join(localCertDir, domain, "privkey.pem")
+// installedFileOwner returns the owner installed files are chowned to, -1 for none.
+func installedFileOwner() (uid, gid int) {
+	if os.Geteuid() != 0 {
+		return -1, -1
+	}
+	return CertFileUID, CertFileGID
 }
 
-func writeCertToFilesToDisk(domain string, certData, privateKeyData []byte) error {
-	certFolder := filepath.Join(localCertDir, domain)
-	certFilename, privateKeyFilename := GetLocalCertFilenames(domain)
+// verifyKeyMatchesCert checks that keyPEM is the private key of the leaf certificate in certPEM.
+func verifyKeyMatchesCert(certPEM, keyPEM []byte) error {
+	if _, err := tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		return fmt.Errorf("private key does not match certificate: %w", err)
+	}
+	return nil
+}
+
+func writeCertToFilesToDisk(certDir, domain string, certData, privateKeyData []byte) error {
+	if err := verifyKeyMatchesCert(certData, privateKeyData); err != nil {
+		return fmt.Errorf("not installing certificate for %s: %w", domain, err)
+	}
+	if err := validateChain(certData); err != nil {
+		return fmt.Errorf("not installing certificate for %s: %w", domain, err)
+	}
+	certFolder := filepath.Join(certDir, domain)
+	certFilename, privateKeyFilename := GetLocalCertFilenames(certDir, domain)
 
 	slog.Debug("Writing certificate to disk")
 	if err := os.MkdirAll(certFolder, 0755); err != nil {
 		return fmt.Errorf("failed to create directory: %w", err)
 	}
 
-	if err := os.WriteFile(certFilename, certData, 0644); err != nil {
-		return fmt.Errorf("failed to write certificate to disk: %w", err)
+	// Every file is staged before any is renamed into place, and the key is renamed first, so a
+	// consumer reloading on a cert change finds the new key with it. Each file is replaced
+	// atomically but the set is not: in the moment between the renames, a reader can still see
+	// the new key with the old certificate.
+	//
+	// fullchain.pem is what nginx and friends expect; with the default bundling it is
+	// identical to cert.pem. writeChainToDisk rebuilds it when the chain is separate.
+	files := []struct {
+		filename, what string
+		data           []byte
+		perm           os.FileMode
+	}{
+		{privateKeyFilename, "private key", privateKeyData, KeyFileMode},
+		{filepath.Join(certFolder, "fullchain.pem"), "full chain", certData, CertFileMode},
+		{certFilename, "certificate", certData, CertFileMode},
 	}
-
-	if err := os.WriteFile(privateKeyFilename, privateKeyData, 0644); err != nil {
-		return fmt.Errorf("failed to write private key to disk: %w", err)
+	uid, gid := installedFileOwner()
+	var staged []string
+	renamed := 0
+	defer func() {
+		for _, tmp := range staged[renamed:] {
+			_ = os.Remove(tmp)
+		}
+	}()
+	for _, f := range files {
+		tmp, err := stageFile(f.filename, f.data, f.perm, uid, gid)
+		if err != nil {
+			return fmt.Errorf("failed to write %s to disk: %w", f.what, err)
+		}
+		staged = append(staged, tmp)
+	}
+	for i, f := range files {
+		if err := os.Rename(staged[i], f.filename); err != nil {
+			return fmt.Errorf("failed to write %s to disk: %w", f.what, err)
+		}
+		renamed++
 	}
 	slog.Debug("Certificate written to disk", "certFilename", certFilename, "privateKeyFilename", privateKeyFilename)
+	notifyCertChanged(domain)
 	return nil
 }
 
-// GenerateSelfSignedTLSCert sets locally generated and signed certificates for the given domains.
-func GenerateSelfSignedTLSCert(domainGroup []string) error {
-	for _, domainGroupRoot := range domainGroup {
-		domainRoot := domainGroupRoot
-		certData, privateKeyData, err := generateSelfSignedCert(domainRoot)
-		if err != nil {
-			return fmt.Errorf("error generating self-signed certificate: %v", err)
+// DomainRoot returns the name a domain group's certificate is stored under: the alphabetically
+// first domain, so reordering the group in domains.json does not move the certificate.
+func DomainRoot(domainGroup []string) string {
+	root := domainGroup[0]
+	for _, domain := range domainGroup[1:] {
+		if domain < root {
+			root = domain
 		}
-		err = writeCertToFilesToDisk(domainRoot, certData, privateKeyData)
-		if err != nil {
-			return fmt.Errorf("error writing certificate to disk: %v", err)
+	}
+	return root
+}
+
+// MigrateCertDirs moves certificates stored under a name other than the group's DomainRoot (as
+// older versions keyed them by the first domain listed) to the DomainRoot directory. Directories
+// left behind once the DomainRoot directory exists are removed, unless another group still
+// uses them.
+func MigrateCertDirs(certDir string, domainGroups [][]string) error {
+	roots := make(map[string]bool)
+	for _, group := range domainGroups {
+		if len(group) > 0 {
+			roots[DomainRoot(group)] = true
+		}
+	}
+	var errs []error
+	for _, group := range domainGroups {
+		if len(group) == 0 {
+			continue
 		}
+		root := DomainRoot(group)
+		rootDir := filepath.Join(certDir, root)
+		for _, domain := range group {
+			if roots[domain] {
+				continue
+			}
+			orphanDir := filepath.Join(certDir, domain)
+			if _, err := os.Stat(orphanDir); err != nil {
+				continue
+			}
+			if _, err := os.Stat(rootDir); os.IsNotExist(err) {
+				slog.Info("Moving certificate directory to the group's storage key", "from", orphanDir, "to", rootDir)
+				if err := os.Rename(orphanDir, rootDir); err != nil {
+					errs = append(errs, fmt.Errorf("error moving %s to %s: %w", orphanDir, rootDir, err))
+				}
+				continue
+			}
+			slog.Info("Removing orphaned certificate directory", "dir", orphanDir, "domainRoot", root)
+			if err := os.RemoveAll(orphanDir); err != nil {
+				errs = append(errs, fmt.Errorf("error removing %s: %w", orphanDir, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validateChain checks that bundle is a PEM chain ordered leaf first, with every certificate
+// signed by the one after it.
+func validateChain(bundle []byte) error {
+	certs, err := parseCertificateBundle(bundle)
+	if err != nil {
+		return err
+	}
+	for i := 0; i+1 < len(certs); i++ {
+		if err := certs[i].CheckSignatureFrom(certs[i+1]); err != nil {
+			return fmt.Errorf("malformed chain: certificate %d (%s) is not signed by certificate %d (%s): %w", i, certs[i].Subject.CommonName, i+1, certs[i+1].Subject.CommonName, err)
+		}
+	}
+	return nil
+}
+
+// installCert writes the certificate and key to disk unless the files already hold exactly
+// these bytes, reporting whether anything was written. It also records the certificate's expiry
+// in the loadmaster_cert_expiry_timestamp_seconds metric.
+func installCert(certDir, domain string, certData, privateKeyData []byte) (bool, error) {
+	if cert, err := ParseCertificate(certData); err == nil {
+		metrics.CertExpiry.WithLabelValues(domain).Set(float64(cert.NotAfter.Unix()))
+	}
+	certFilename, privateKeyFilename := GetLocalCertFilenames(certDir, domain)
+	existingCert, certErr := os.ReadFile(certFilename)
+	existingKey, keyErr := os.ReadFile(privateKeyFilename)
+	if certErr == nil && keyErr == nil && bytes.Equal(existingCert, certData) && bytes.Equal(existingKey, privateKeyData) {
+		slog.Debug("Certificate on disk is unchanged; skipping write", "domain", domain)
+		return false, nil
+	}
+	return true, writeCertToFilesToDisk(certDir, domain, certData, privateKeyData)
+}
+
+// writeChainToDisk writes chain.pem and rebuilds fullchain.pem from the certificate already on
+// disk, so it must be called after writeCertToFilesToDisk.
+func writeChainToDisk(certDir, domain string, chain []byte) error {
+	certFilename, _ := GetLocalCertFilenames(certDir, domain)
+	certData, err := os.ReadFile(certFilename)
+	if err != nil {
+		return fmt.Errorf("failed to read certificate for full chain: %w", err)
+	}
+	fullchain := append(append([]byte{}, certData...), chain...)
+	if err := validateChain(fullchain); err != nil {
+		return fmt.Errorf("not installing chain for %s: %w", domain, err)
+	}
+	if err := writeInstalledFile(filepath.Join(certDir, domain, "chain.pem"), chain, CertFileMode); err != nil {
+		return fmt.Errorf("failed to write chain to disk: %w", err)
+	}
+	if err := writeInstalledFile(filepath.Join(certDir, domain, "fullchain.pem"), fullchain, CertFileMode); err != nil {
+		return fmt.Errorf("failed to write full chain to disk: %w", err)
+	}
+	return nil
+}
+
+// GenerateSelfSignedTLSCert installs a locally generated and signed certificate covering every
+// name in domainGroup under the group's DomainRoot, as one multi-SAN certificate like the ACME
+// certificates it stands in for.
+func GenerateSelfSignedTLSCert(certDir string, domainGroup []string) error {
+	if len(domainGroup) == 0 {
+		return errors.New("no domains to generate a self-signed certificate for")
+	}
+	certData, privateKeyData, err := generateSelfSignedCert(domainGroup)
+	if err != nil {
+		return fmt.Errorf("error generating self-signed certificate: %v", err)
+	}
+	err = writeCertToFilesToDisk(certDir, DomainRoot(domainGroup), certData, privateKeyData)
+	if err != nil {
+		return fmt.Errorf("error writing certificate to disk: %v", err)
 	}
 	return nil
 }
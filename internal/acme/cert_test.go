@@ -0,0 +1,168 @@
+package acme
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// testCert returns a self-signed certificate and key for names, valid from now for validity;
+// a negative validity gives a certificate that has already expired.
+func testCert(t *testing.T, validity time.Duration, names ...string) (certPEM, keyPEM []byte) {
+	t.Helper()
+	saved := SelfSignedCertValidity
+	SelfSignedCertValidity = validity
+	defer func() { SelfSignedCertValidity = saved }()
+	certPEM, keyPEM, err := generateSelfSignedCert(names)
+	if err != nil {
+		t.Fatalf("generateSelfSignedCert: %v", err)
+	}
+	return certPEM, keyPEM
+}
+
+func TestCertExpiresSoon(t *testing.T) {
+	const day = 24 * time.Hour
+	tests := []struct {
+		name     string
+		validity time.Duration
+		want     bool
+	}{
+		{"expired", -2 * day, true},
+		{"about to expire", 10 * day, true},
+		{"valid", 90 * day, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			certPEM, _ := testCert(t, tt.validity, "example.com")
+			got, err := CertExpiresSoon(certPEM, "example.com", 30)
+			if err != nil {
+				t.Fatalf("CertExpiresSoon: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("CertExpiresSoon = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("unparseable", func(t *testing.T) {
+		got, err := CertExpiresSoon([]byte("not a certificate"), "example.com", 30)
+		if err == nil || !got {
+			t.Errorf("CertExpiresSoon = %v, %v; want true and an error", got, err)
+		}
+	})
+}
+
+// testChain returns PEM blocks of a root CA, an intermediate CA it signed and a leaf for
+// example.com signed by the intermediate.
+func testChain(t *testing.T) (root, intermediate, leaf []byte) {
+	t.Helper()
+	issue := func(serial int64, cn string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, []byte) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template := &x509.Certificate{
+			SerialNumber:          big.NewInt(serial),
+			Subject:               pkix.Name{CommonName: cn},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(90 * 24 * time.Hour),
+			BasicConstraintsValid: true,
+			IsCA:                  isCA,
+		}
+		if isCA {
+			template.KeyUsage = x509.KeyUsageCertSign
+		} else {
+			template.DNSNames = []string{cn}
+		}
+		if parent == nil {
+			parent, parentKey = template, key
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	}
+	rootCert, rootKey, root := issue(1, "Test Root", true, nil, nil)
+	intermediateCert, intermediateKey, intermediate := issue(2, "Test Intermediate", true, rootCert, rootKey)
+	_, _, leaf = issue(3, "example.com", false, intermediateCert, intermediateKey)
+	return root, intermediate, leaf
+}
+
+func TestParseLeafCertificateBundleOrder(t *testing.T) {
+	root, intermediate, leaf := testChain(t)
+	tests := []struct {
+		name   string
+		bundle [][]byte
+	}{
+		{"leaf first", [][]byte{leaf, intermediate, root}},
+		{"leaf last", [][]byte{root, intermediate, leaf}},
+		{"shuffled", [][]byte{intermediate, leaf, root}},
+	}
+	for _, tt := range tests {
+		for _, domain := range []string{"", "example.com"} {
+			t.Run(tt.name+"/"+domain, func(t *testing.T) {
+				cert, err := ParseLeafCertificate(bytes.Join(tt.bundle, nil), domain)
+				if err != nil {
+					t.Fatalf("ParseLeafCertificate: %v", err)
+				}
+				if cert.Subject.CommonName != "example.com" {
+					t.Errorf("leaf = %q, want example.com", cert.Subject.CommonName)
+				}
+			})
+		}
+	}
+}
+
+func TestCertRemainingDays(t *testing.T) {
+	const day = 24 * time.Hour
+	tests := []struct {
+		name     string
+		notAfter time.Duration
+		want     int
+	}{
+		{"expired", -36 * time.Hour, -1},
+		{"expires today", time.Hour, 0},
+		{"30 days", 30*day + time.Hour, 30},
+		{"partial days round down", 30*day + 23*time.Hour, 30},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cert := &x509.Certificate{NotAfter: time.Now().Add(tt.notAfter)}
+			if got := CertRemainingDays(cert); got != tt.want {
+				t.Errorf("CertRemainingDays = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShouldRenew(t *testing.T) {
+	tests := []struct {
+		name          string
+		remainingDays int
+		want          bool
+	}{
+		{"expired", -1, true},
+		{"below the threshold", 29, true},
+		{"exactly at the threshold", 30, true},
+		{"above the threshold", 31, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := shouldRenew(tt.remainingDays, 30); got != tt.want {
+				t.Errorf("shouldRenew(%d, 30) = %v, want %v", tt.remainingDays, got, tt.want)
+			}
+		})
+	}
+}
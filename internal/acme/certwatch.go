@@ -0,0 +1,43 @@
+package acme
+
+import "sync"
+
+// certWatchers are notified of the domain root of every certificate installed on disk.
+var certWatchers struct {
+	mu   sync.Mutex
+	next int
+	chs  map[int]chan string
+}
+
+// WatchCertChanges returns a channel receiving the domain root of each certificate written to
+// the cert directory (issued, renewed, imported, rolled back, self-signed or synced from
+// storage), and a function that stops the notifications. Notifications a slow receiver has no
+// room for are dropped, so receivers should reload whatever they serve for that domain root.
+func WatchCertChanges() (<-chan string, func()) {
+	certWatchers.mu.Lock()
+	defer certWatchers.mu.Unlock()
+	if certWatchers.chs == nil {
+		certWatchers.chs = make(map[int]chan string)
+	}
+	id := certWatchers.next
+	certWatchers.next++
+	ch := make(chan string, 16)
+	certWatchers.chs[id] = ch
+	return ch, func() {
+		certWatchers.mu.Lock()
+		defer certWatchers.mu.Unlock()
+		delete(certWatchers.chs, id)
+	}
+}
+
+// notifyCertChanged tells the watchers that domainRoot's certificate was installed.
+func notifyCertChanged(domainRoot string) {
+	certWatchers.mu.Lock()
+	defer certWatchers.mu.Unlock()
+	for _, ch := range certWatchers.chs {
+		select {
+		case ch <- domainRoot:
+		default:
+		}
+	}
+}
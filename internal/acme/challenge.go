@@ -0,0 +1,166 @@
+package acme
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-acme/lego/v4/challenge/http01"
+)
+
+// challengeServer is the HTTP-01 provider shared by every renewal: one long-lived listener on
+// HTTPChallengePort answers the tokens of all in-flight orders, so concurrent renewals don't
+// compete for the port.
+type challengeServer struct {
+	mu       sync.Mutex
+	listener net.Listener
+	// tokens maps each pending challenge token to its key authorization.
+	tokens map[string]string
+}
+
+// HTTPChallengeBindAddress is the IP address the HTTP-01 challenge server listens on. Empty
+// binds every interface.
+var HTTPChallengeBindAddress = ""
+
+// HTTPChallengeAddr returns the address the reverse proxy and redirect listener forward HTTP-01
+// requests to: the bind address, or loopback when every interface is bound.
+func HTTPChallengeAddr() string {
+	host := HTTPChallengeBindAddress
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, fmt.Sprint(HTTPChallengePort))
+}
+
+var sharedChallengeServer = &challengeServer{tokens: make(map[string]string)}
+
+// Present publishes the key authorization for token, starting the listener on first use.
+func (c *challengeServer) Present(domain, token, keyAuth string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.listen(); err != nil {
+		return err
+	}
+	c.tokens[token] = keyAuth
+	slog.Debug("Presenting HTTP-01 challenge", "domain", domain, "token", token)
+	return nil
+}
+
+// listen starts the listener unless it is running. c.mu must be held.
+func (c *challengeServer) listen() error {
+	if c.listener != nil {
+		return nil
+	}
+	addr := net.JoinHostPort(HTTPChallengeBindAddress, fmt.Sprint(HTTPChallengePort))
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("could not start HTTP-01 challenge server on %s: %w", addr, err)
+	}
+	slog.Info("Started HTTP-01 challenge server", "addr", listener.Addr())
+	c.listener = listener
+	go func() {
+		if err := http.Serve(listener, c); err != nil {
+			slog.Error("HTTP-01 challenge server stopped", "error", err)
+		}
+	}()
+	return nil
+}
+
+// preflightClient fetches challenge tokens the way a CA does: directly, on port 80, following
+// redirects to HTTPS without verifying the certificate, on a new connection each time.
+var preflightClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		DisableKeepAlives: true,
+	},
+}
+
+// CheckHTTPChallengeReachable starts the HTTP-01 challenge server and fetches a test token from
+// it through domain's public name, as the CA will, so an unreachable challenge port (a
+// firewall, NAT without port forwarding, DNS pointing elsewhere) is found before an order is
+// placed. It only succeeds once domain resolves to this host.
+func CheckHTTPChallengeReachable(ctx context.Context, domain string) error {
+	random := make([]byte, 24)
+	if _, err := rand.Read(random); err != nil {
+		return err
+	}
+	token := base64.RawURLEncoding.EncodeToString(random)
+	keyAuth := token + ".loadmaster-preflight"
+	c := sharedChallengeServer
+	c.mu.Lock()
+	err := c.listen()
+	if err == nil {
+		c.tokens[token] = keyAuth
+	}
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = c.CleanUp(domain, token, keyAuth)
+	}()
+
+	host := domain
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	url := "http://" + host + http01.ChallengePath(token)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := preflightClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error fetching %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return fmt.Errorf("error reading %s: %w", url, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s; the request did not reach this challenge server", url, resp.Status)
+	}
+	if strings.TrimSpace(string(body)) != keyAuth {
+		return fmt.Errorf("%s answered with other content; the request did not reach this challenge server", url)
+	}
+	return nil
+}
+
+// CleanUp withdraws token once its challenge is done. The listener stays up for later orders.
+func (c *challengeServer) CleanUp(domain, token, keyAuth string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.tokens, token)
+	return nil
+}
+
+func (c *challengeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, ok := strings.CutPrefix(r.URL.Path, http01.ChallengePath(""))
+	if r.Method != http.MethodGet || !ok {
+		http.NotFound(w, r)
+		return
+	}
+	c.mu.Lock()
+	keyAuth, ok := c.tokens[token]
+	c.mu.Unlock()
+	if !ok {
+		slog.Warn("HTTP-01 challenge request for an unknown token", "host", r.Host, "token", token)
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	if _, err := w.Write([]byte(keyAuth)); err != nil {
+		slog.Warn("error writing HTTP-01 challenge response", "error", err)
+	}
+}
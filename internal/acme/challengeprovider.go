@@ -0,0 +1,150 @@
+package acme
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/go-acme/lego/v4/challenge/dns01"
+	"github.com/go-acme/lego/v4/lego"
+	"github.com/go-acme/lego/v4/providers/dns/exec"
+	"github.com/go-acme/lego/v4/providers/dns/httpreq"
+	"github.com/go-acme/lego/v4/providers/dns/rfc2136"
+	"github.com/go-acme/lego/v4/providers/dns/route53"
+)
+
+// ChallengeProvider solves one type of ACME challenge: challenge.HTTP01, challenge.DNS01 or
+// challenge.TLSALPN01. Any lego challenge.Provider can be used by adding ChallengeType.
+type ChallengeProvider interface {
+	challenge.Provider
+	ChallengeType() challenge.Type
+}
+
+// ChallengeProviders solve the challenges of every order. When empty, HTTP-01 is answered by
+// the built-in challenge server on HTTPChallengePort, plus TLS-ALPN-01 when TLSALPNChallenge is
+// set.
+var ChallengeProviders []ChallengeProvider
+
+// HTTP01ChallengeProvider returns the built-in HTTP-01 solver, which serves the tokens of all
+// in-flight orders from one listener on HTTPChallengePort.
+func HTTP01ChallengeProvider() ChallengeProvider {
+	return sharedChallengeServer
+}
+
+// TLSALPN01ChallengeProvider returns the built-in TLS-ALPN-01 solver, whose challenge
+// certificates are served by the proxy's TLS listener; see TLSALPNChallenge.
+func TLSALPN01ChallengeProvider() ChallengeProvider {
+	return sharedALPNProvider
+}
+
+func (c *challengeServer) ChallengeType() challenge.Type { return challenge.HTTP01 }
+
+func (p *alpnChallengeProvider) ChallengeType() challenge.Type { return challenge.TLSALPN01 }
+
+// dnsProviders lists the lego DNS providers DNS01ChallengeProvider can build.
+var dnsProviders = map[string]func() (challenge.Provider, error){
+	"exec":    func() (challenge.Provider, error) { return exec.NewDNSProvider() },
+	"httpreq": func() (challenge.Provider, error) { return httpreq.NewDNSProvider() },
+	"rfc2136": func() (challenge.Provider, error) { return rfc2136.NewDNSProvider() },
+	"route53": func() (challenge.Provider, error) { return route53.NewDNSProvider() },
+}
+
+// DNS01ChallengeProvider returns a DNS-01 solver using the lego DNS provider name, configured
+// through lego's environment variables for that provider (e.g. AWS_REGION for route53).
+func DNS01ChallengeProvider(name string) (ChallengeProvider, error) {
+	newProvider, ok := dnsProviders[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown DNS provider %q", name)
+	}
+	provider, err := newProvider()
+	if err != nil {
+		return nil, fmt.Errorf("error creating %s DNS provider: %w", name, err)
+	}
+	return &dnsChallengeProvider{Provider: provider}, nil
+}
+
+// DNS propagation settings for DNS-01 challenges. Zero values keep the provider's own
+// propagation timeout and polling interval, and lego's 10s DNS query timeout.
+var (
+	// DNSPropagationTimeout is how long lego waits for the TXT record to propagate.
+	DNSPropagationTimeout time.Duration
+	// DNSPollingInterval is how often lego checks whether the TXT record has propagated.
+	DNSPollingInterval time.Duration
+	// DNSQueryTimeout bounds each DNS query of the propagation check.
+	DNSQueryTimeout time.Duration
+	// DNSSkipAuthoritativeCheck skips checking that every authoritative nameserver serves the
+	// TXT record; the CA is notified as soon as the recursive resolvers see it.
+	DNSSkipAuthoritativeCheck bool
+)
+
+// dnsChallengeProvider adapts a lego DNS provider to ChallengeProvider.
+type dnsChallengeProvider struct {
+	challenge.Provider
+}
+
+func (p *dnsChallengeProvider) ChallengeType() challenge.Type { return challenge.DNS01 }
+
+// Timeout passes on the propagation timeout of the wrapped provider, which lego only finds
+// through the challenge.ProviderTimeout interface, unless DNSPropagationTimeout or
+// DNSPollingInterval override it.
+func (p *dnsChallengeProvider) Timeout() (timeout, interval time.Duration) {
+	timeout, interval = dns01.DefaultPropagationTimeout, dns01.DefaultPollingInterval
+	if withTimeout, ok := p.Provider.(challenge.ProviderTimeout); ok {
+		timeout, interval = withTimeout.Timeout()
+	}
+	if DNSPropagationTimeout > 0 {
+		timeout = DNSPropagationTimeout
+	}
+	if DNSPollingInterval > 0 {
+		interval = DNSPollingInterval
+	}
+	return timeout, interval
+}
+
+// dnsChallengeOptions returns the lego options applying the DNS propagation settings.
+func dnsChallengeOptions() []dns01.ChallengeOption {
+	var opts []dns01.ChallengeOption
+	if DNSQueryTimeout > 0 {
+		opts = append(opts, dns01.AddDNSTimeout(DNSQueryTimeout))
+	}
+	if DNSSkipAuthoritativeCheck {
+		opts = append(opts, dns01.DisableAuthoritativeNssPropagationRequirement())
+	}
+	return opts
+}
+
+// setChallengeProviders registers ChallengeProviders, or the default solvers, on client. The
+// acme-dns solver keeps the accounts it registers in storage.
+func setChallengeProviders(client *lego.Client, storage ACMEStorage) error {
+	providers := ChallengeProviders
+	if len(providers) == 0 {
+		providers = []ChallengeProvider{HTTP01ChallengeProvider()}
+		if TLSALPNChallenge {
+			providers = append(providers, TLSALPN01ChallengeProvider())
+		}
+	}
+	for _, provider := range providers {
+		var err error
+		switch provider.ChallengeType() {
+		case challenge.HTTP01:
+			err = client.Challenge.SetHTTP01Provider(provider)
+		case challenge.DNS01:
+			if acmeDNS, ok := provider.(*acmeDNSProvider); ok {
+				provider = acmeDNS.withStorage(storage)
+			}
+			// Wrapped so the propagation settings apply to custom DNS providers too.
+			if _, ok := provider.(*dnsChallengeProvider); !ok {
+				provider = &dnsChallengeProvider{Provider: provider}
+			}
+			err = client.Challenge.SetDNS01Provider(provider, dnsChallengeOptions()...)
+		case challenge.TLSALPN01:
+			err = client.Challenge.SetTLSALPN01Provider(provider)
+		default:
+			err = fmt.Errorf("unsupported challenge type %q", provider.ChallengeType())
+		}
+		if err != nil {
+			return fmt.Errorf("error setting %s provider: %w", provider.ChallengeType(), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package acme
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// checksumMetadataKey is the S3 user metadata key (x-amz-meta-sha256) holding the hex SHA-256
+// of a certificate or key object, written by SaveCert.
+const checksumMetadataKey = "sha256"
+
+// ErrChecksumMismatch is returned when an object read from storage doesn't match the checksum
+// stored with it, e.g. after a truncated read.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// checksumMetadata returns the S3 user metadata recording the checksum of data.
+func checksumMetadata(data []byte) map[string]string {
+	sum := sha256.Sum256(data)
+	return map[string]string{checksumMetadataKey: hex.EncodeToString(sum[:])}
+}
+
+// verifyChecksum checks data read from key against the checksum in its metadata. Objects
+// written before checksums were stored have none and are accepted.
+func verifyChecksum(key string, data []byte, metadata map[string]string) error {
+	want, ok := metadata[checksumMetadataKey]
+	if !ok {
+		return nil
+	}
+	sum := sha256.Sum256(data)
+	if got := hex.EncodeToString(sum[:]); got != want {
+		return fmt.Errorf("%w for %s: got sha256 %s, stored %s", ErrChecksumMismatch, key, got, want)
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package acme
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+)
+
+// Distribute makes UpdateTLS only install the certificates another loadmaster instance keeps in
+// storage: nothing is obtained via ACME, no self-signed fallback is generated and nothing is
+// written back to storage.
+var Distribute = false
+
+// syncTLS is the UpdateTLS flow in Distribute mode: the certificate for domainGroup is
+// downloaded from storage and installed in certDir if it changed.
+func syncTLS(storage ACMEStorage, certDir string, domainGroup []string) error {
+	domainRoot := DomainRoot(domainGroup)
+	certData, privateKeyData, err := storage.DownloadCert(domainRoot)
+	if errors.Is(err, ErrChecksumMismatch) {
+		slog.Error("certificate in storage failed checksum verification; keeping the installed certificate", "domain", domainRoot, "error", err)
+	}
+	if err != nil {
+		return fmt.Errorf("error downloading certificate for %s from storage: %w", domainRoot, err)
+	}
+	changed, err := installCert(certDir, domainRoot, certData, privateKeyData)
+	if err != nil {
+		return fmt.Errorf("error writing certificate to disk: %v", err)
+	}
+	// Staple a fresh OCSP response, but leave caching it in storage to the issuer.
+	if ocspResp, err := fetchOCSPResponse(certData); err == nil {
+		if err := writeOCSPToDisk(certDir, domainRoot, ocspResp); err != nil {
+			slog.Warn("error writing OCSP response to disk", "domain", domainRoot, "error", err)
+		}
+	}
+	if changed {
+		slog.Info("Installed certificate from storage", "domain", domainRoot)
+		runPostRenewHook(certDir, domainRoot)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package acme
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// gzipMagic starts every gzip stream; JSON never does, so compressed objects are recognized by
+// their content whatever their key.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// putAccountObject writes an ACME user or registration JSON object at key, or gzipped at
+// key+".gz" when the storage compresses account data.
+func (s *S3ACMEStorage) putAccountObject(ctx context.Context, key string, data []byte) error {
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucketName),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/json"),
+	}
+	if s.gzipAccountData {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(data); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		key += ".gz"
+		data = buf.Bytes()
+		input.Key = aws.String(key)
+		input.Body = bytes.NewReader(data)
+		input.ContentEncoding = aws.String("gzip")
+	}
+	if _, err := s.s3Client.PutObject(ctx, input); err != nil {
+		return err
+	}
+	s.cacheWritten(key, data)
+	return nil
+}
+
+// getAccountObject reads the JSON object written by putAccountObject at key. The plain and the
+// gzipped key are both tried, the configured one first, so turning compression on or off keeps
+// finding objects written before; gzipped content is decompressed.
+func (s *S3ACMEStorage) getAccountObject(ctx context.Context, key string) ([]byte, error) {
+	keys := []string{key, key + ".gz"}
+	if s.gzipAccountData {
+		keys[0], keys[1] = keys[1], keys[0]
+	}
+	data, err := s.getObject(ctx, keys[0])
+	if isNotFound(err) {
+		data, err = s.getObject(ctx, keys[1])
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(data, gzipMagic) {
+		return data, nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("error decompressing %s: %w", key, err)
+	}
+	defer zr.Close()
+	data, err = io.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("error decompressing %s: %w", key, err)
+	}
+	return data, nil
+}
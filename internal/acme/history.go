@@ -0,0 +1,138 @@
+package acme
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/joshuaschlichting/loadmaster/internal/metrics"
+)
+
+// RenewalRecord is the renewal history of one domain group, keyed by its DomainRoot in
+// RenewalHistory.
+type RenewalRecord struct {
+	LastAttempt  time.Time `json:"lastAttempt,omitzero"`
+	LastSuccess  time.Time `json:"lastSuccess,omitzero"`
+	LastError    string    `json:"lastError,omitempty"`
+	AttemptCount int       `json:"attemptCount"`
+	// ConsecutiveFailures counts the failed attempts since the last success, and NextAttempt is
+	// when the renewal backoff they earned ends.
+	ConsecutiveFailures int       `json:"consecutiveFailures,omitempty"`
+	NextAttempt         time.Time `json:"nextAttempt,omitzero"`
+}
+
+// RenewalHistory maps a domain root to its renewal record.
+type RenewalHistory map[string]RenewalRecord
+
+// MinTimeBetweenRenewals is how long after a successful renewal a domain group is not renewed
+// again unless forced, so that a crash-looping process does not re-issue certificates it has
+// just obtained. Zero disables the guard.
+var MinTimeBetweenRenewals = DefaultMinTimeBetweenRenewals
+
+// DefaultMinTimeBetweenRenewals is MinTimeBetweenRenewals when the config doesn't set it.
+const DefaultMinTimeBetweenRenewals = 24 * time.Hour
+
+// MaxRenewalBackoff caps the backoff after consecutive renewal failures of a domain group: the
+// first failure holds the group back for renewalBackoffBase, and each further one doubles that,
+// up to MaxRenewalBackoff. Zero disables the backoff.
+var MaxRenewalBackoff = DefaultMaxRenewalBackoff
+
+// DefaultMaxRenewalBackoff is MaxRenewalBackoff when the config doesn't set it.
+const DefaultMaxRenewalBackoff = 24 * time.Hour
+
+// renewalBackoffBase is the backoff after the first failure.
+const renewalBackoffBase = time.Hour
+
+// renewalBackoff returns how long a domain group is held back after failures consecutive
+// failures.
+func renewalBackoff(failures int) time.Duration {
+	if MaxRenewalBackoff <= 0 || failures <= 0 {
+		return 0
+	}
+	delay := renewalBackoffBase
+	for i := 1; i < failures && delay < MaxRenewalBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, MaxRenewalBackoff)
+}
+
+// historyMu serializes the load-modify-save of the history within this process.
+var historyMu sync.Mutex
+
+// recentlyRenewed returns the time of domainRoot's last successful renewal and whether it lies
+// within MinTimeBetweenRenewals. A history that can't be loaded counts as no recent renewal.
+func recentlyRenewed(storage ACMEStorage, domainRoot string) (time.Time, bool) {
+	if MinTimeBetweenRenewals <= 0 {
+		return time.Time{}, false
+	}
+	historyMu.Lock()
+	history, err := storage.LoadRenewalHistory()
+	historyMu.Unlock()
+	if err != nil {
+		slog.Warn("error loading renewal history", "error", err)
+		return time.Time{}, false
+	}
+	lastSuccess := history[domainRoot].LastSuccess
+	return lastSuccess, !lastSuccess.IsZero() && time.Since(lastSuccess) < MinTimeBetweenRenewals
+}
+
+// backingOff returns when domainRoot's renewal backoff ends and whether it is still running. An
+// attempt due within a tenth of the backoff is let through, so that a daily sweep starting a
+// little earlier than the previous attempt ended isn't skipped for a whole day. A history that
+// can't be loaded counts as no backoff.
+func backingOff(storage ACMEStorage, domainRoot string) (time.Time, bool) {
+	if MaxRenewalBackoff <= 0 {
+		return time.Time{}, false
+	}
+	historyMu.Lock()
+	history, err := storage.LoadRenewalHistory()
+	historyMu.Unlock()
+	if err != nil {
+		slog.Warn("error loading renewal history", "error", err)
+		return time.Time{}, false
+	}
+	record := history[domainRoot]
+	slack := renewalBackoff(record.ConsecutiveFailures) / 10
+	return record.NextAttempt, time.Now().Add(slack).Before(record.NextAttempt)
+}
+
+// recordRenewalAttempt adds the outcome of a renewal attempt for domainRoot to the history kept
+// in storage. Failures to persist the history are logged, not returned. If the history can't be
+// loaded, the attempt goes unrecorded rather than overwriting the other groups' records.
+func recordRenewalAttempt(storage ACMEStorage, domainRoot string, renewErr error) {
+	if renewErr != nil {
+		metrics.Renewals.WithLabelValues("failure").Inc()
+	} else {
+		metrics.Renewals.WithLabelValues("success").Inc()
+	}
+	historyMu.Lock()
+	defer historyMu.Unlock()
+
+	history, err := storage.LoadRenewalHistory()
+	if err != nil {
+		slog.Warn("error loading renewal history; not recording renewal attempt", "domain", domainRoot, "error", err)
+		return
+	}
+	now := time.Now()
+	record := history[domainRoot]
+	record.LastAttempt = now
+	record.AttemptCount++
+	if renewErr != nil {
+		record.LastError = renewErr.Error()
+		record.ConsecutiveFailures++
+		record.NextAttempt = time.Time{}
+		if backoff := renewalBackoff(record.ConsecutiveFailures); backoff > 0 {
+			record.NextAttempt = now.Add(backoff)
+			slog.Info("Backing off renewals of failing domain group", "domain", domainRoot, "failures", record.ConsecutiveFailures, "nextAttempt", record.NextAttempt)
+		}
+	} else {
+		record.LastSuccess = now
+		record.LastError = ""
+		record.ConsecutiveFailures = 0
+		record.NextAttempt = time.Time{}
+	}
+	history[domainRoot] = record
+	if err := storage.SaveRenewalHistory(history); err != nil {
+		slog.Warn("error saving renewal history", "domain", domainRoot, "error", err)
+	}
+}
@@ -0,0 +1,33 @@
+package acme
+
+import (
+	"errors"
+	"testing"
+)
+
+// unreadableHistoryStorage is a MemoryACMEStorage whose renewal history can't be loaded.
+type unreadableHistoryStorage struct {
+	*MemoryACMEStorage
+}
+
+func (s unreadableHistoryStorage) LoadRenewalHistory() (RenewalHistory, error) {
+	return nil, errors.New("transient storage error")
+}
+
+func TestRecordRenewalAttemptKeepsHistoryWhenLoadFails(t *testing.T) {
+	memory := NewMemoryACMEStorage("admin@example.com", unreachableCA, t.TempDir())
+	saved := RenewalHistory{"other.example.com": {AttemptCount: 3, ConsecutiveFailures: 2}}
+	if err := memory.SaveRenewalHistory(saved); err != nil {
+		t.Fatal(err)
+	}
+
+	recordRenewalAttempt(unreadableHistoryStorage{memory}, "example.com", errors.New("order failed"))
+
+	history, err := memory.LoadRenewalHistory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 || history["other.example.com"] != saved["other.example.com"] {
+		t.Errorf("renewal history = %+v, want %+v", history, saved)
+	}
+}
@@ -0,0 +1,42 @@
+package acme
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// PostRenewHook is the command (argv) run after a renewed certificate has been written to disk.
+// It is not run for self-signed fallbacks or when the existing certificate was still valid.
+var PostRenewHook []string
+
+func runPostRenewHook(certDir, domainRoot string) {
+	if len(PostRenewHook) == 0 {
+		return
+	}
+	certPath, keyPath := GetLocalCertFilenames(certDir, domainRoot)
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(PostRenewHook[0], PostRenewHook[1:]...)
+	cmd.Env = append(os.Environ(),
+		"LOADMASTER_DOMAIN="+domainRoot,
+		"LOADMASTER_CERT_PATH="+certPath,
+		"LOADMASTER_KEY_PATH="+keyPath,
+	)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	slog.Info("Running post-renew hook", "domain", domainRoot, "command", PostRenewHook)
+	err := cmd.Run()
+	if out := strings.TrimSpace(stdout.String()); out != "" {
+		slog.Info("post-renew hook stdout", "domain", domainRoot, "output", out)
+	}
+	if out := strings.TrimSpace(stderr.String()); out != "" {
+		slog.Info("post-renew hook stderr", "domain", domainRoot, "output", out)
+	}
+	if err != nil {
+		slog.Warn("post-renew hook failed", "domain", domainRoot, "error", err)
+	}
+}
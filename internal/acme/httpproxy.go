@@ -0,0 +1,32 @@
+package acme
+
+import (
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// HTTPProxy and NoProxy, when HTTPProxy is set, route ACME and S3 traffic through an HTTP proxy
+// instead of the one configured by the HTTPS_PROXY, HTTP_PROXY and NO_PROXY environment
+// variables. NoProxy uses the NO_PROXY syntax.
+var (
+	HTTPProxy = ""
+	NoProxy   = ""
+)
+
+// proxyFunc returns the proxy selection for outbound ACME and S3 requests: HTTPProxy and NoProxy
+// when HTTPProxy is set, and the environment otherwise.
+func proxyFunc() func(*http.Request) (*url.URL, error) {
+	if HTTPProxy == "" {
+		return http.ProxyFromEnvironment
+	}
+	proxy := (&httpproxy.Config{
+		HTTPProxy:  HTTPProxy,
+		HTTPSProxy: HTTPProxy,
+		NoProxy:    NoProxy,
+	}).ProxyFunc()
+	return func(r *http.Request) (*url.URL, error) {
+		return proxy(r.URL)
+	}
+}
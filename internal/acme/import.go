@@ -0,0 +1,41 @@
+package acme
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// ImportCert stores an existing certificate and key for domainGroup, e.g. one issued by certbot,
+// and installs it in certDir. The pair must match, cover every name in the group and still be
+// valid; whether it needs renewing is left to the next sweep.
+func ImportCert(storage ACMEStorage, certDir string, domainGroup []string, certPEM, keyPEM []byte) error {
+	domainRoot := DomainRoot(domainGroup)
+	if err := verifyKeyMatchesCert(certPEM, keyPEM); err != nil {
+		return err
+	}
+	cert, err := ParseCertificate(certPEM)
+	if err != nil {
+		return err
+	}
+	if time.Now().After(cert.NotAfter) {
+		return fmt.Errorf("certificate expired on %s", cert.NotAfter.Format(time.DateOnly))
+	}
+	for _, domain := range domainGroup {
+		if err := cert.VerifyHostname(domain); err != nil {
+			return fmt.Errorf("certificate does not cover %s: %w", domain, err)
+		}
+	}
+	if err := validateChain(certPEM); err != nil {
+		return err
+	}
+
+	if err := storage.SaveCert(domainRoot, certPEM, keyPEM); err != nil {
+		return fmt.Errorf("error saving cert to storage: %w", err)
+	}
+	if err := writeCertToFilesToDisk(certDir, domainRoot, certPEM, keyPEM); err != nil {
+		return fmt.Errorf("error writing certificate to disk: %w", err)
+	}
+	slog.Info("Imported certificate", "domain", domainRoot, "issuer", cert.Issuer.CommonName, "notAfter", cert.NotAfter)
+	return nil
+}
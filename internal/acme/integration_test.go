@@ -0,0 +1,174 @@
+//go:build integration
+
+package acme
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// TestRenewACMECertificatePebble obtains a certificate from Let's Encrypt's pebble test CA,
+// answering its HTTP-01 challenge with the built-in challenge server. pebble is run from
+// $PEBBLE_BIN, or from the PATH; the test is skipped when it can't be found.
+func TestRenewACMECertificatePebble(t *testing.T) {
+	pebbleBin := os.Getenv("PEBBLE_BIN")
+	if pebbleBin == "" {
+		var err error
+		if pebbleBin, err = exec.LookPath("pebble"); err != nil {
+			t.Skip("pebble not found; install it with go install github.com/letsencrypt/pebble/v2/cmd/pebble@latest or set PEBBLE_BIN")
+		}
+	}
+	const domain = "loadmaster.test"
+	dir := t.TempDir()
+
+	// pebble resolves the names it validates through this server, which points them all at
+	// the challenge server on this host.
+	dnsAddr := startTestDNSServer(t)
+
+	// pebble's API certificate is trusted by the ACME client through CARootCerts.
+	apiCert, apiKey, err := generateSelfSignedCert([]string{"localhost", "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "pebble.pem"), filepath.Join(dir, "pebble.key")
+	if err := os.WriteFile(certFile, apiCert, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, apiKey, 0600); err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(apiCert)
+	savedRoots, savedPort := CARootCerts, HTTPChallengePort
+	t.Cleanup(func() { CARootCerts, HTTPChallengePort = savedRoots, savedPort })
+	CARootCerts = pool
+	HTTPChallengePort = freePort(t)
+
+	listenAddr := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	pebbleConfig, err := json.Marshal(map[string]any{
+		"pebble": map[string]any{
+			"listenAddress":           listenAddr,
+			"managementListenAddress": fmt.Sprintf("127.0.0.1:%d", freePort(t)),
+			"certificate":             certFile,
+			"privateKey":              keyFile,
+			"httpPort":                HTTPChallengePort,
+			"tlsPort":                 freePort(t),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	configFile := filepath.Join(dir, "pebble-config.json")
+	if err := os.WriteFile(configFile, pebbleConfig, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(pebbleBin, "-config", configFile, "-dnsserver", dnsAddr)
+	cmd.Env = append(os.Environ(), "PEBBLE_VA_NOSLEEP=1", "PEBBLE_WFE_NONCEREJECT=0")
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("error starting pebble: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+	directory := "https://" + listenAddr + "/dir"
+	waitForPebble(t, directory, pool)
+
+	storage := NewMemoryACMEStorage("admin@"+domain, directory, filepath.Join(dir, "certs"))
+	certData, keyData, _, err := renewACMECertificate(renewACMECertificateParams{
+		email:          "admin@" + domain,
+		domains:        []string{domain},
+		caAuthorityURL: directory,
+		s:              storage,
+	})
+	if err != nil {
+		t.Fatalf("renewACMECertificate: %v", err)
+	}
+	cert, err := ParseCertificate(certData)
+	if err != nil {
+		t.Fatalf("ParseCertificate: %v", err)
+	}
+	if err := cert.VerifyHostname(domain); err != nil {
+		t.Errorf("certificate is not valid for %s: %v", domain, err)
+	}
+	if err := validateChain(certData); err != nil {
+		t.Errorf("invalid chain: %v", err)
+	}
+	if err := verifyKeyMatchesCert(certData, keyData); err != nil {
+		t.Error(err)
+	}
+}
+
+// startTestDNSServer serves A records pointing every name at 127.0.0.1, returning its address.
+func startTestDNSServer(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{
+		PacketConn: conn,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			for _, q := range r.Question {
+				if q.Qtype == dns.TypeA {
+					m.Answer = append(m.Answer, &dns.A{
+						Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+						A:   net.IPv4(127, 0, 0, 1),
+					})
+				}
+			}
+			_ = w.WriteMsg(m)
+		}),
+	}
+	go func() { _ = server.ActivateAndServe() }()
+	t.Cleanup(func() { _ = server.Shutdown() })
+	return conn.LocalAddr().String()
+}
+
+// freePort returns a TCP port that was free on 127.0.0.1 a moment ago.
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// waitForPebble polls pebble's directory until it answers.
+func waitForPebble(t *testing.T, directory string, roots *x509.CertPool) {
+	t.Helper()
+	client := &http.Client{
+		Timeout:   time.Second,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}},
+	}
+	deadline := time.Now().Add(15 * time.Second)
+	for {
+		resp, err := client.Get(directory)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("pebble did not start at %s: %v", directory, err)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
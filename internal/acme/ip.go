@@ -0,0 +1,48 @@
+package acme
+
+import (
+	"fmt"
+	"net"
+)
+
+// ipSANUnsupported lists public CAs that do not issue certificates for IP addresses through
+// their default profile.
+var ipSANUnsupported = map[string]bool{
+	CAAuthorityLetsEncryptProduction: true,
+	CAAuthorityLetsEncryptStaging:    true,
+	CAAuthorityBuypassProduction:     true,
+	CAAuthorityBuypassStaging:        true,
+	CAAuthorityGoogleProduction:      true,
+	CAAuthorityGoogleStaging:         true,
+	CAAuthorityZeroSSL:               true,
+}
+
+// isIPAddress reports whether a domain group entry is an IP address rather than a DNS name.
+func isIPAddress(name string) bool {
+	return net.ParseIP(name) != nil
+}
+
+// splitSANs separates the IP address entries of a domain group from the DNS names.
+func splitSANs(domainGroup []string) (dnsNames []string, ipAddresses []net.IP) {
+	for _, name := range domainGroup {
+		if ip := net.ParseIP(name); ip != nil {
+			ipAddresses = append(ipAddresses, ip)
+		} else {
+			dnsNames = append(dnsNames, name)
+		}
+	}
+	return dnsNames, ipAddresses
+}
+
+// validateIPSANs rejects IP address entries when caAuthority is known not to issue them.
+func validateIPSANs(domains []string, caAuthority string) error {
+	if !ipSANUnsupported[caAuthority] {
+		return nil
+	}
+	for _, name := range domains {
+		if isIPAddress(name) {
+			return fmt.Errorf("%s is an IP address, which CA %s does not issue certificates for; use a private CA such as step-ca for IP SANs", name, caAuthority)
+		}
+	}
+	return nil
+}
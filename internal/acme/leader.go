@@ -0,0 +1,216 @@
+package acme
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// LeaderLease is a lease that at most one loadmaster instance holds at a time. Holders renew it
+// well before it expires; once it has expired, any instance may take it over.
+type LeaderLease interface {
+	// AcquireLease takes the lease for holder, or extends it if holder has it, until ttl from
+	// now. It returns false when another holder's lease hasn't expired.
+	AcquireLease(ctx context.Context, holder string, ttl time.Duration) (bool, error)
+	// ReleaseLease gives up the lease if holder has it, so another instance can take over
+	// without waiting for it to expire.
+	ReleaseLease(ctx context.Context, holder string) error
+}
+
+// leaseRecord is the content of a lease object or file.
+type leaseRecord struct {
+	Holder  string    `json:"holder"`
+	Expires time.Time `json:"expires"`
+}
+
+// follower is set while leader election runs and another instance holds the lease.
+var follower atomic.Bool
+
+// SetLeader records whether this instance holds the leader lease. Followers only install the
+// certificates the leader keeps in storage, as in Distribute mode. Without leader election,
+// every instance is a leader.
+func SetLeader(leader bool) {
+	follower.Store(!leader)
+}
+
+// IsLeader reports whether this instance may renew certificates and write to storage.
+func IsLeader() bool {
+	return !follower.Load()
+}
+
+// leaderKey is the S3 object holding the leader lease.
+func (s *S3ACMEStorage) leaderKey() string {
+	return path.Join(s.serviceName, "leader.lock")
+}
+
+// AcquireLease takes or extends the leader lease object with conditional writes, so two
+// instances racing for an expired lease can't both win.
+func (s *S3ACMEStorage) AcquireLease(ctx context.Context, holder string, ttl time.Duration) (bool, error) {
+	key := s.leaderKey()
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucketName),
+		Key:         aws.String(key),
+		ContentType: aws.String("application/json"),
+	}
+	// The sweep cache is bypassed: the lease must be read fresh each time.
+	out, err := s.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucketName),
+		Key:    aws.String(key),
+	})
+	switch {
+	case isNotFound(err):
+		input.IfNoneMatch = aws.String("*")
+	case err != nil:
+		return false, fmt.Errorf("error reading leader lease %s: %w", key, err)
+	default:
+		data, err := io.ReadAll(out.Body)
+		out.Body.Close()
+		if err != nil {
+			return false, fmt.Errorf("error reading leader lease %s: %w", key, err)
+		}
+		var current leaseRecord
+		if err := json.Unmarshal(data, &current); err != nil {
+			slog.Warn("ignoring unreadable leader lease", "key", key, "error", err)
+		} else if current.Holder != holder && time.Now().Before(current.Expires) {
+			return false, nil
+		}
+		input.IfMatch = out.ETag
+	}
+	data, err := json.Marshal(leaseRecord{Holder: holder, Expires: time.Now().Add(ttl)})
+	if err != nil {
+		return false, err
+	}
+	input.Body = bytes.NewReader(data)
+	if _, err := s.s3Client.PutObject(ctx, input); err != nil {
+		if isPreconditionFailed(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("error writing leader lease %s: %w", key, err)
+	}
+	return true, nil
+}
+
+// ReleaseLease deletes the leader lease object if holder has it.
+func (s *S3ACMEStorage) ReleaseLease(ctx context.Context, holder string) error {
+	key := s.leaderKey()
+	out, err := s.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucketName),
+		Key:    aws.String(key),
+	})
+	if isNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading leader lease %s: %w", key, err)
+	}
+	data, err := io.ReadAll(out.Body)
+	out.Body.Close()
+	if err != nil {
+		return fmt.Errorf("error reading leader lease %s: %w", key, err)
+	}
+	var current leaseRecord
+	if err := json.Unmarshal(data, &current); err != nil || current.Holder != holder {
+		return nil
+	}
+	_, err = s.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket:  aws.String(s.bucketName),
+		Key:     aws.String(key),
+		IfMatch: out.ETag,
+	})
+	if err != nil && !isPreconditionFailed(err) {
+		return fmt.Errorf("error releasing leader lease %s: %w", key, err)
+	}
+	return nil
+}
+
+// FileLease is a LeaderLease kept in a file on a filesystem shared by the instances, such as
+// an NFS mount.
+type FileLease struct {
+	Path string
+}
+
+// AcquireLease takes or extends the lease file. The file is created exclusively when missing
+// and replaced atomically otherwise, then read back, so of two instances racing for an expired
+// lease only the last writer goes on as leader.
+func (l *FileLease) AcquireLease(_ context.Context, holder string, ttl time.Duration) (bool, error) {
+	current, err := l.read()
+	exists := err == nil
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Warn("ignoring unreadable leader lease", "path", l.Path, "error", err)
+		exists = true
+	}
+	if exists && current.Holder != holder && time.Now().Before(current.Expires) {
+		return false, nil
+	}
+	data, err := json.Marshal(leaseRecord{Holder: holder, Expires: time.Now().Add(ttl)})
+	if err != nil {
+		return false, err
+	}
+	if !exists {
+		f, err := os.OpenFile(l.Path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if errors.Is(err, os.ErrExist) {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("error creating leader lease %s: %w", l.Path, err)
+		}
+		_, err = f.Write(data)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return false, fmt.Errorf("error writing leader lease %s: %w", l.Path, err)
+		}
+		return true, nil
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(l.Path), filepath.Base(l.Path)+".tmp-*")
+	if err != nil {
+		return false, fmt.Errorf("error writing leader lease %s: %w", l.Path, err)
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), l.Path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return false, fmt.Errorf("error writing leader lease %s: %w", l.Path, err)
+	}
+	written, err := l.read()
+	return err == nil && written.Holder == holder, nil
+}
+
+// ReleaseLease removes the lease file if holder has it.
+func (l *FileLease) ReleaseLease(_ context.Context, holder string) error {
+	current, err := l.read()
+	if err != nil || current.Holder != holder {
+		return nil
+	}
+	if err := os.Remove(l.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("error releasing leader lease %s: %w", l.Path, err)
+	}
+	return nil
+}
+
+func (l *FileLease) read() (leaseRecord, error) {
+	var current leaseRecord
+	data, err := os.ReadFile(l.Path)
+	if err != nil {
+		return current, err
+	}
+	return current, json.Unmarshal(data, &current)
+}
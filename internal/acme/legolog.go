@@ -0,0 +1,53 @@
+package acme
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	legolog "github.com/go-acme/lego/v4/log"
+)
+
+// legoLogger forwards lego's log output to slog with component=lego, so ACME protocol details
+// share loadmaster's format and stream. lego's "[INFO]" lines are logged at debug level and its
+// "[WARN]" lines as warnings.
+type legoLogger struct{}
+
+func init() {
+	legolog.Logger = legoLogger{}
+}
+
+func (legoLogger) log(level slog.Level, msg string) {
+	msg = strings.TrimSuffix(msg, "\n")
+	if rest, ok := strings.CutPrefix(msg, "[WARN] "); ok {
+		level, msg = max(level, slog.LevelWarn), rest
+	} else {
+		msg = strings.TrimPrefix(msg, "[INFO] ")
+	}
+	slog.Default().Log(context.Background(), level, msg, "component", "lego")
+}
+
+func (l legoLogger) Print(args ...any) { l.log(slog.LevelDebug, fmt.Sprint(args...)) }
+
+func (l legoLogger) Println(args ...any) { l.log(slog.LevelDebug, fmt.Sprintln(args...)) }
+
+func (l legoLogger) Printf(format string, args ...any) {
+	l.log(slog.LevelDebug, fmt.Sprintf(format, args...))
+}
+
+func (l legoLogger) Fatal(args ...any) {
+	l.log(slog.LevelError, fmt.Sprint(args...))
+	os.Exit(1)
+}
+
+func (l legoLogger) Fatalln(args ...any) {
+	l.log(slog.LevelError, fmt.Sprintln(args...))
+	os.Exit(1)
+}
+
+func (l legoLogger) Fatalf(format string, args ...any) {
+	l.log(slog.LevelError, fmt.Sprintf(format, args...))
+	os.Exit(1)
+}
@@ -11,22 +11,83 @@ import (
 	"path/filepath"
 
 	"github.com/go-acme/lego/v4/registration"
+
+	"github.com/joshuaschlichting/loadmaster/internal/config"
 )
 
 type LocalACMEStorage struct {
 	contactEmail string
 	caAuthority  string
+	homeDir      string
+	certDir      string
+}
+
+type NewLocalACMEStorageParams struct {
+	ContactEmail string
+	CAAuthority  string
+	// HomeDir holds the ACME accounts. Defaults to config.Dir.
+	HomeDir string
+	// LocalCertDir holds the issued certificates. Defaults to <HomeDir>/certs.
+	LocalCertDir string
 }
 
-func NewLocalACMEStorage(email, caAuthority string) *LocalACMEStorage {
+func NewLocalACMEStorage(params NewLocalACMEStorageParams) *LocalACMEStorage {
+	logCAAuthority(params.CAAuthority)
+	homeDir := params.HomeDir
+	if homeDir == "" {
+		homeDir = config.Dir
+	}
+	certDir := params.LocalCertDir
+	if certDir == "" {
+		certDir = filepath.Join(homeDir, "certs")
+	}
 	return &LocalACMEStorage{
-		contactEmail: email,
-		caAuthority:  caAuthority,
+		contactEmail: params.ContactEmail,
+		caAuthority:  params.CAAuthority,
+		homeDir:      homeDir,
+		certDir:      certDir,
+	}
+}
+
+// CheckWrite checks that the cert directory and the directory holding the ACME account and
+// renewal history are writable.
+func (s *LocalACMEStorage) CheckWrite() error {
+	if err := checkDirWritable(s.certDir); err != nil {
+		return err
+	}
+	return checkDirWritable(s.homeDir)
+}
+
+// checkDirWritable creates dir if needed, then writes and removes a test file in it.
+func checkDirWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("cannot create directory %s: %w", dir, err)
+	}
+	f, err := os.CreateTemp(dir, ".healthcheck-*")
+	if err != nil {
+		return fmt.Errorf("directory %s is not writable: %w", dir, err)
+	}
+	name := f.Name()
+	_, err = f.WriteString("loadmaster storage check\n")
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
 	}
+	if removeErr := os.Remove(name); err == nil && removeErr != nil {
+		err = fmt.Errorf("cannot remove %s: %w", name, removeErr)
+	}
+	if err != nil {
+		return fmt.Errorf("directory %s is not writable: %w", dir, err)
+	}
+	return nil
+}
+
+// accountDir is where the ACME user and registration for the configured CA are kept.
+func (s *LocalACMEStorage) accountDir() string {
+	return filepath.Join(s.homeDir, "accounts", accountNamespace(s.caAuthority))
 }
 
 func (s *LocalACMEStorage) LoadUser(emailAddress string) (DomainUser, error) {
-	filename := filepath.Join(loadmasterHomeDir, fmt.Sprintf("%s.json", emailAddress))
+	filename := filepath.Join(s.accountDir(), fmt.Sprintf("%s.json", emailAddress))
 	userJson, err := os.ReadFile(filename)
 	if err != nil {
 		return DomainUser{}, fmt.Errorf("error reading user file: %s", err)
@@ -38,7 +99,7 @@ func (s *LocalACMEStorage) LoadUser(emailAddress string) (DomainUser, error) {
 	}
 
 	// load the private key
-	keyFilename := filepath.Join(loadmasterHomeDir, fmt.Sprintf("%s.pem", emailAddress))
+	keyFilename := filepath.Join(s.accountDir(), fmt.Sprintf("%s.pem", emailAddress))
 	pemBytes, err := os.ReadFile(keyFilename)
 	if err != nil {
 		return DomainUser{}, fmt.Errorf("error reading private key file: %s", err)
@@ -79,9 +140,12 @@ func (s *LocalACMEStorage) SaveUser(user DomainUser) error {
 	if err != nil {
 		return fmt.Errorf("error marshalling user: %s", err)
 	}
-	filename := filepath.Join(loadmasterHomeDir, fmt.Sprintf("%s.json", user.Email))
+	if err := os.MkdirAll(s.accountDir(), 0700); err != nil {
+		return fmt.Errorf("error creating account directory: %w", err)
+	}
+	filename := filepath.Join(s.accountDir(), fmt.Sprintf("%s.json", user.Email))
 	slog.Debug("saving user to file", "user", userJson)
-	err = os.WriteFile(filename, userJson, 0644)
+	err = os.WriteFile(filename, userJson, 0600)
 	if err != nil {
 		return fmt.Errorf("error writing user to file: %s", err)
 	}
@@ -99,7 +163,7 @@ func (s *LocalACMEStorage) SaveUser(user DomainUser) error {
 
 	// Encode the private key into PEM format
 	privateKeyPem := pem.EncodeToMemory(privateKeyBlock)
-	keyFilename := filepath.Join(loadmasterHomeDir, fmt.Sprintf("%s.pem", user.Email))
+	keyFilename := filepath.Join(s.accountDir(), fmt.Sprintf("%s.pem", user.Email))
 	err = os.WriteFile(keyFilename, privateKeyPem, 0600)
 	if err != nil {
 		return fmt.Errorf("error writing private key to file: %s", err)
@@ -113,17 +177,17 @@ func (s *LocalACMEStorage) SaveRegistration(reg *registration.Resource) error {
 	if err != nil {
 		return err
 	}
-	// Ensure the certs directory exists (e.g., ~/.loadmaster/certs)
-	if err := os.MkdirAll(localCertDir, 0755); err != nil {
-		return fmt.Errorf("error ensuring certs directory exists: %w", err)
+	// Ensure the account directory exists (e.g., ~/.loadmaster/accounts/<ca>)
+	if err := os.MkdirAll(s.accountDir(), 0700); err != nil {
+		return fmt.Errorf("error ensuring account directory exists: %w", err)
 	}
-	regPath := filepath.Join(localCertDir, "registration.json")
+	regPath := filepath.Join(s.accountDir(), "registration.json")
 	return os.WriteFile(regPath, data, 0600)
 }
 
 // Load the registration information from a file
 func (s *LocalACMEStorage) LoadRegistration() (*registration.Resource, error) {
-	regPath := filepath.Join(localCertDir, "registration.json")
+	regPath := filepath.Join(s.accountDir(), "registration.json")
 	data, err := os.ReadFile(regPath)
 	if err != nil {
 		return nil, err
@@ -135,74 +199,142 @@ func (s *LocalACMEStorage) LoadRegistration() (*registration.Resource, error) {
 	return &reg, nil
 }
 
-// DownloadCert find the domainRoot's folder within localCertDir and return cert/key from inside.
+// historyFile is the JSON file holding the renewal history.
+func (s *LocalACMEStorage) historyFile() string {
+	return filepath.Join(s.homeDir, "renewal-history.json")
+}
+
+func (s *LocalACMEStorage) LoadRenewalHistory() (RenewalHistory, error) {
+	data, err := os.ReadFile(s.historyFile())
+	if os.IsNotExist(err) {
+		return RenewalHistory{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	history := RenewalHistory{}
+	if err := json.Unmarshal(data, &history); err != nil {
+		return nil, fmt.Errorf("error unmarshalling renewal history: %w", err)
+	}
+	return history, nil
+}
+
+func (s *LocalACMEStorage) SaveRenewalHistory(history RenewalHistory) error {
+	data, err := json.Marshal(history)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.homeDir, 0700); err != nil {
+		return fmt.Errorf("error creating home directory: %w", err)
+	}
+	return writeFileAtomic(s.historyFile(), data, 0600, -1, -1)
+}
+
+// acmeDNSAccountsFile is the JSON file holding the acme-dns accounts.
+func (s *LocalACMEStorage) acmeDNSAccountsFile() string {
+	return filepath.Join(s.homeDir, "acme-dns-accounts.json")
+}
+
+func (s *LocalACMEStorage) LoadACMEDNSAccounts() (map[string]ACMEDNSAccount, error) {
+	data, err := os.ReadFile(s.acmeDNSAccountsFile())
+	if os.IsNotExist(err) {
+		return map[string]ACMEDNSAccount{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	accounts := map[string]ACMEDNSAccount{}
+	if err := json.Unmarshal(data, &accounts); err != nil {
+		return nil, fmt.Errorf("error unmarshalling acme-dns accounts: %w", err)
+	}
+	return accounts, nil
+}
+
+func (s *LocalACMEStorage) SaveACMEDNSAccounts(accounts map[string]ACMEDNSAccount) error {
+	data, err := json.Marshal(accounts)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.homeDir, 0700); err != nil {
+		return fmt.Errorf("error creating home directory: %w", err)
+	}
+	return writeFileAtomic(s.acmeDNSAccountsFile(), data, 0600, -1, -1)
+}
+
+// DownloadCert find the domainRoot's folder within the local cert directory and return cert/key from inside.
 // Expected filenames:
 // - fullchain.pem or cert.pem for certificate
 // - privkey.pem or key.pem for private key
 // If these do not exist, return an error.
 func (s *LocalACMEStorage) DownloadCert(domainRoot string) (certData []byte, keyData []byte, err error) {
 
-	certDir := filepath.Join(localCertDir, domainRoot)
+	certDir := filepath.Join(s.certDir, domainRoot)
 
-	certPath := filepath.Join(certDir, "cert.pem")
-	keyPath := filepath.Join(certDir, "privkey.pem")
-
-	certData, err = os.ReadFile(certPath)
-	if err != nil || len(certData) == 0 {
-		return nil, nil, fmt.Errorf("certificate not found in %s", certDir)
+	certData = readFirstFile(certDir, "fullchain.pem", "cert.pem")
+	if len(certData) == 0 {
+		return nil, nil, fmt.Errorf("%w in %s", ErrCertNotFound, certDir)
 	}
 
-	keyData, err = os.ReadFile(keyPath)
-	if err != nil || len(keyData) == 0 {
-		return nil, nil, fmt.Errorf("private key not found in %s", certDir)
-	}
+	keyData = readFirstFile(certDir, "privkey.pem", "key.pem")
 	if len(keyData) == 0 {
-		return nil, nil, fmt.Errorf("private key not found in %s", certDir)
+		return nil, nil, fmt.Errorf("%w: private key missing in %s", ErrCertNotFound, certDir)
 	}
 
 	return certData, keyData, nil
 }
 
-func (s *LocalACMEStorage) SaveCert(domainRoot string, certData, privateKeyData []byte) error {
-	return fmt.Errorf("'saveCerts' not implemented in LocalACMEStorage")
+// readFirstFile returns the contents of the first non-empty file among names in dir.
+func readFirstFile(dir string, names ...string) []byte {
+	for _, name := range names {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err == nil && len(data) > 0 {
+			return data
+		}
+	}
+	return nil
 }
 
-// UpdateTLS checks the TLS certificates for the given domains and renews them if they are expired or about to expire.
-func (s *LocalACMEStorage) UpdateTLS(domainGroup []string) error {
+// SaveCert writes the certificate and key to the local cert directory, which is this storage's
+// only copy.
+func (s *LocalACMEStorage) SaveCert(domainRoot string, certData, privateKeyData []byte) error {
+	return writeCertToFilesToDisk(s.certDir, domainRoot, certData, privateKeyData)
+}
 
-	slog.Debug("Starting certificate check for ", "domains", domainGroup)
+// CertLocation returns the on-disk paths of the certificate and key for domainRoot.
+func (s *LocalACMEStorage) CertLocation(domainRoot string) (certPath, keyPath string) {
+	return GetLocalCertFilenames(s.certDir, domainRoot)
+}
 
-	domainRoot := domainGroup[0]
+func (s *LocalACMEStorage) DeleteCert(domainRoot string) error {
+	return removeCertDir(s.certDir, domainRoot)
+}
 
-	var certData, privateKeyData []byte
-	_, _, err := s.DownloadCert(domainRoot)
-	if err != nil {
-		slog.Error("error while downloading certificates from local", "error", err)
-	}
-	certData, privateKeyData, err = renewACMECertificate(renewACMECertificateParams{
-		email:          s.contactEmail,
-		domains:        domainGroup,
-		caAuthorityURL: s.caAuthority,
-		s:              s,
-	})
-	if err != nil {
-		slog.Error("renewACMECertificate failed", "error", err)
-	}
-	slog.Debug("Checking certificate expiry", "domains", domainGroup)
+func (s *LocalACMEStorage) ListCerts() ([]string, error) {
+	return listCertDirs(s.certDir)
+}
 
-	if len(certData) == 0 || len(privateKeyData) == 0 {
-		slog.Warn("certData or privateKeyData is nil or empty after renewal process. Creating a self-signed cert...", "certData", certData, "privateKeyData", privateKeyData)
-		certData, privateKeyData, err = generateSelfSignedCert(domainRoot)
-		if err != nil {
-			return fmt.Errorf("error generating self-signed certificate (as a result of errors renewing certificate via ACME protocol): %v", err)
-		}
+// SaveChain writes the issuer chain next to the certificate in the local cert directory.
+func (s *LocalACMEStorage) SaveChain(domainRoot string, chain []byte) error {
+	return writeChainToDisk(s.certDir, domainRoot, chain)
+}
 
-	}
-	removeExisting(domainRoot)
-	err = writeCertToFilesToDisk(domainRoot, certData, privateKeyData)
-	if err != nil {
-		return fmt.Errorf("error writing certificate to disk: %v", err)
-	}
+// SaveOCSP writes the OCSP response next to the certificate in the local cert directory.
+func (s *LocalACMEStorage) SaveOCSP(domainRoot string, ocspResp []byte) error {
+	return writeOCSPToDisk(s.certDir, domainRoot, ocspResp)
+}
 
-	return nil
+// UpdateTLS runs updateTLS for domainGroup under the domain lock. The certificate directory is
+// both the storage and the install location, so the renewal decision is made on the installed
+// certificate, and a failed renewal leaves it in place.
+func (s *LocalACMEStorage) UpdateTLS(domainGroup []string) error {
+	unlock := lockDomain(DomainRoot(domainGroup))
+	defer unlock()
+
+	return updateTLS(updateTLSParams{
+		storage:     s,
+		certDir:     s.certDir,
+		email:       s.contactEmail,
+		caAuthority: s.caAuthority,
+		domainGroup: domainGroup,
+	})
 }
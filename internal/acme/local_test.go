@@ -0,0 +1,97 @@
+package acme
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-acme/lego/v4/registration"
+)
+
+func TestLocalACMEStorageUserRoundTrip(t *testing.T) {
+	home := t.TempDir()
+	storage := NewLocalACMEStorage(NewLocalACMEStorageParams{
+		ContactEmail: "admin@example.com",
+		CAAuthority:  "https://acme.example.com/directory",
+		HomeDir:      home,
+	})
+	user, err := createNewACMEUser("admin@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.Registration = &registration.Resource{URI: "https://acme.example.com/acct/1"}
+	if err := storage.SaveUser(user); err != nil {
+		t.Fatalf("SaveUser: %v", err)
+	}
+
+	loaded, err := storage.LoadUser("admin@example.com")
+	if err != nil {
+		t.Fatalf("LoadUser: %v", err)
+	}
+	if loaded.Email != user.Email {
+		t.Errorf("Email = %q, want %q", loaded.Email, user.Email)
+	}
+	if loaded.Registration == nil || loaded.Registration.URI != user.Registration.URI {
+		t.Errorf("Registration = %+v, want URI %q", loaded.Registration, user.Registration.URI)
+	}
+	if !user.key.(*ecdsa.PrivateKey).Equal(loaded.key) {
+		t.Errorf("loaded private key differs from the saved one")
+	}
+
+	modes := map[string]os.FileMode{
+		storage.accountDir(): 0700,
+		filepath.Join(storage.accountDir(), "admin@example.com.json"): 0600,
+		filepath.Join(storage.accountDir(), "admin@example.com.pem"):  0600,
+	}
+	for path, want := range modes {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.Mode().Perm(); got != want {
+			t.Errorf("%s has mode %o, want %o", path, got, want)
+		}
+	}
+}
+
+// TestLocalACMEStorageUpdateTLSImported checks that an imported certificate, which has no
+// renewal history, is kept while valid and stays installed when its renewal fails.
+func TestLocalACMEStorageUpdateTLSImported(t *testing.T) {
+	const day = 24 * time.Hour
+	tests := []struct {
+		name     string
+		validity time.Duration
+		wantErr  bool
+	}{
+		{"valid certificate is kept", 90 * day, false},
+		{"expiring certificate stays installed when renewal fails", 10 * day, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := NewLocalACMEStorage(NewLocalACMEStorageParams{
+				ContactEmail: "admin@example.com",
+				CAAuthority:  unreachableCA,
+				HomeDir:      t.TempDir(),
+			})
+			certPEM, keyPEM := testCert(t, tt.validity, "example.com")
+			if err := storage.SaveCert("example.com", certPEM, keyPEM); err != nil {
+				t.Fatal(err)
+			}
+
+			err := storage.UpdateTLS([]string{"example.com"})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("UpdateTLS error = %v, wantErr %v", err, tt.wantErr)
+			}
+			installed, _, err := storage.DownloadCert("example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(installed, certPEM) {
+				t.Errorf("installed certificate is not the imported one")
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package acme
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+)
+
+// DistributedLockTTL is how long an S3 lock object is honored before it is considered
+// abandoned (e.g. the holder crashed) and may be taken over by another instance.
+var DistributedLockTTL = 15 * time.Minute
+
+// domainLocks holds one *sync.Mutex per domainRoot.
+var domainLocks sync.Map
+
+// lockDomain serializes certificate work for domainRoot within this process and
+// returns the function that releases the lock.
+func lockDomain(domainRoot string) func() {
+	v, _ := domainLocks.LoadOrStore(domainRoot, &sync.Mutex{})
+	mu := v.(*sync.Mutex)
+	mu.Lock()
+	return mu.Unlock
+}
+
+// lockForUpdate takes the distributed lock of domainRoot when distributedLock is enabled and
+// the instance writes to the bucket, returning the function that releases it. An order that
+// timed out keeps the lock until it ends, so other instances don't place a duplicate one
+// meanwhile.
+func (s *S3ACMEStorage) lockForUpdate(domainRoot string) (func(), error) {
+	// Distribute mode and followers never write to the bucket, so they need no lock.
+	if !s.distributedLock || Distribute || !IsLeader() {
+		return func() {}, nil
+	}
+	release, err := s.acquireDistributedLock(domainRoot)
+	if err != nil {
+		return nil, fmt.Errorf("error locking %s: %w", domainRoot, err)
+	}
+	return func() { afterAbandonedOrders(domainRoot, release) }, nil
+}
+
+func (s *S3ACMEStorage) lockKey(domainRoot string) string {
+	return path.Join(s.serviceName, "certs", domainRoot, ".lock")
+}
+
+// acquireDistributedLock creates a lock object for domainRoot using a conditional
+// PutObject, so only one loadmaster instance sharing the bucket can hold it at a time.
+func (s *S3ACMEStorage) acquireDistributedLock(domainRoot string) (func(), error) {
+	ctx, cancel := s.opContext()
+	defer cancel()
+	key := s.lockKey(domainRoot)
+	hostname, _ := os.Hostname()
+	body := fmt.Sprintf("%s %d %s", hostname, os.Getpid(), time.Now().UTC().Format(time.RFC3339))
+
+	for attempt := 0; attempt < 2; attempt++ {
+		put, err := s.s3Client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:      aws.String(s.bucketName),
+			Key:         aws.String(key),
+			Body:        bytes.NewReader([]byte(body)),
+			IfNoneMatch: aws.String("*"),
+		})
+		if err == nil {
+			slog.Debug("acquired distributed lock", "key", key)
+			return func() {
+				ctx, cancel := s.opContext()
+				defer cancel()
+				// Only our own lock is deleted: another instance may have taken it over as stale.
+				_, err := s.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+					Bucket:  aws.String(s.bucketName),
+					Key:     aws.String(key),
+					IfMatch: put.ETag,
+				})
+				if isPreconditionFailed(err) {
+					slog.Warn("distributed lock was taken over before it was released", "key", key)
+				} else if err != nil {
+					slog.Warn("error releasing distributed lock", "key", key, "error", err)
+				}
+			}, nil
+		}
+		if !isPreconditionFailed(err) {
+			return nil, fmt.Errorf("error acquiring distributed lock %s: %w", key, err)
+		}
+
+		head, headErr := s.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(s.bucketName),
+			Key:    aws.String(key),
+		})
+		if headErr != nil || head.LastModified == nil || time.Since(*head.LastModified) < DistributedLockTTL {
+			return nil, fmt.Errorf("distributed lock %s is held by another instance", key)
+		}
+		slog.Warn("taking over stale distributed lock", "key", key, "lastModified", *head.LastModified)
+		// The delete is conditional on the lock being the stale one, so of two instances taking
+		// it over, the one that deleted and recreated it first keeps it.
+		_, err = s.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket:  aws.String(s.bucketName),
+			Key:     aws.String(key),
+			IfMatch: head.ETag,
+		})
+		if isPreconditionFailed(err) || isNotFound(err) {
+			return nil, fmt.Errorf("distributed lock %s is held by another instance", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error removing stale distributed lock %s: %w", key, err)
+		}
+	}
+	return nil, fmt.Errorf("distributed lock %s is held by another instance", key)
+}
+
+func isPreconditionFailed(err error) bool {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "PreconditionFailed", "ConditionalRequestConflict":
+			return true
+		}
+	}
+	return false
+}
+
+// isNotFound reports whether err is S3's answer for a missing object. GetObject reports
+// NoSuchKey, while HeadObject only has the status code to go on and reports NotFound.
+func isNotFound(err error) bool {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "NoSuchKey", "NotFound":
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,184 @@
+package acme
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+
+	"github.com/go-acme/lego/v4/registration"
+)
+
+// MemoryACMEStorage is a map-backed ACMEStorage. Nothing survives a restart, so it is intended
+// for tests and for embedding loadmaster where another layer owns persistence. Issued
+// certificates are still written to the local cert directory by UpdateTLS.
+type MemoryACMEStorage struct {
+	mu           sync.Mutex
+	certs        map[string][]byte
+	keys         map[string][]byte
+	ocsp         map[string][]byte
+	chains       map[string][]byte
+	users        map[string]DomainUser
+	registration *registration.Resource
+	history      RenewalHistory
+	// acmeDNSAccounts are the acme-dns accounts registered by the DNS-01 solver.
+	acmeDNSAccounts map[string]ACMEDNSAccount
+	contactEmail    string
+	caAuthority     string
+	certDir         string
+}
+
+// NewMemoryACMEStorage returns an empty MemoryACMEStorage. certDir defaults to <config.Dir>/certs.
+func NewMemoryACMEStorage(email, caAuthority, certDir string) *MemoryACMEStorage {
+	if certDir == "" {
+		certDir = defaultCertDir()
+	}
+	return &MemoryACMEStorage{
+		certs:           make(map[string][]byte),
+		keys:            make(map[string][]byte),
+		ocsp:            make(map[string][]byte),
+		chains:          make(map[string][]byte),
+		users:           make(map[string]DomainUser),
+		acmeDNSAccounts: make(map[string]ACMEDNSAccount),
+		contactEmail:    email,
+		caAuthority:     caAuthority,
+		certDir:         certDir,
+	}
+}
+
+func (s *MemoryACMEStorage) SaveCert(domainRoot string, cert, privateKey []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.certs[domainRoot] = cert
+	s.keys[domainRoot] = privateKey
+	return nil
+}
+
+func (s *MemoryACMEStorage) SaveChain(domainRoot string, chain []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.chains[domainRoot] = chain
+	return nil
+}
+
+func (s *MemoryACMEStorage) SaveOCSP(domainRoot string, ocspResp []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ocsp[domainRoot] = ocspResp
+	return nil
+}
+
+func (s *MemoryACMEStorage) DownloadCert(domainRoot string) ([]byte, []byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cert, ok := s.certs[domainRoot]
+	if !ok {
+		return nil, nil, fmt.Errorf("%w for %s", ErrCertNotFound, domainRoot)
+	}
+	return cert, s.keys[domainRoot], nil
+}
+
+func (s *MemoryACMEStorage) LoadUser(emailAddress string) (DomainUser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[emailAddress]
+	if !ok {
+		return DomainUser{}, fmt.Errorf("user %s not found", emailAddress)
+	}
+	user.Registration = s.registration
+	return user, nil
+}
+
+func (s *MemoryACMEStorage) SaveUser(user DomainUser) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users[user.Email] = user
+	return nil
+}
+
+func (s *MemoryACMEStorage) SaveRegistration(reg *registration.Resource) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.registration = reg
+	return nil
+}
+
+func (s *MemoryACMEStorage) LoadRegistration() (*registration.Resource, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.registration == nil {
+		return nil, fmt.Errorf("registration not found")
+	}
+	return s.registration, nil
+}
+
+func (s *MemoryACMEStorage) LoadRenewalHistory() (RenewalHistory, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	history := RenewalHistory{}
+	for domainRoot, record := range s.history {
+		history[domainRoot] = record
+	}
+	return history, nil
+}
+
+func (s *MemoryACMEStorage) SaveRenewalHistory(history RenewalHistory) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.history = history
+	return nil
+}
+
+func (s *MemoryACMEStorage) LoadACMEDNSAccounts() (map[string]ACMEDNSAccount, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return maps.Clone(s.acmeDNSAccounts), nil
+}
+
+func (s *MemoryACMEStorage) SaveACMEDNSAccounts(accounts map[string]ACMEDNSAccount) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.acmeDNSAccounts = maps.Clone(accounts)
+	return nil
+}
+
+func (s *MemoryACMEStorage) DeleteCert(domainRoot string) error {
+	s.mu.Lock()
+	delete(s.certs, domainRoot)
+	delete(s.keys, domainRoot)
+	delete(s.chains, domainRoot)
+	delete(s.ocsp, domainRoot)
+	s.mu.Unlock()
+	return removeCertDir(s.certDir, domainRoot)
+}
+
+func (s *MemoryACMEStorage) ListCerts() ([]string, error) {
+	roots, err := listCertDirs(s.certDir)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for domainRoot := range s.certs {
+		if !slices.Contains(roots, domainRoot) {
+			roots = append(roots, domainRoot)
+		}
+	}
+	return roots, err
+}
+
+func (s *MemoryACMEStorage) CertLocation(domainRoot string) (certPath, keyPath string) {
+	return GetLocalCertFilenames(s.certDir, domainRoot)
+}
+
+// UpdateTLS runs updateTLS for domainGroup under the domain lock, keeping the certificate in
+// memory and installing it in the local cert directory.
+func (s *MemoryACMEStorage) UpdateTLS(domainGroup []string) error {
+	unlock := lockDomain(DomainRoot(domainGroup))
+	defer unlock()
+
+	return updateTLS(updateTLSParams{
+		storage:     s,
+		certDir:     s.certDir,
+		email:       s.contactEmail,
+		caAuthority: s.caAuthority,
+		domainGroup: domainGroup,
+	})
+}
@@ -0,0 +1,289 @@
+package acme
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/go-acme/lego/v4/registration"
+)
+
+// MultiACMEStorage replicates writes to every wrapped storage and reads from the first one that
+// succeeds, e.g. to keep certificates in S3 as a durable backup and on local disk.
+type MultiACMEStorage struct {
+	storages     []ACMEStorage
+	contactEmail string
+	caAuthority  string
+	certDir      string
+}
+
+// NewMultiACMEStorage wraps storages, which must not be empty. UpdateTLS installs certificates
+// in certDir (default <config.Dir>/certs).
+func NewMultiACMEStorage(email, caAuthority, certDir string, storages ...ACMEStorage) (*MultiACMEStorage, error) {
+	if len(storages) == 0 {
+		return nil, fmt.Errorf("MultiACMEStorage requires at least one storage")
+	}
+	if certDir == "" {
+		certDir = defaultCertDir()
+	}
+	return &MultiACMEStorage{
+		storages:     storages,
+		contactEmail: email,
+		caAuthority:  caAuthority,
+		certDir:      certDir,
+	}, nil
+}
+
+// each calls fn for every storage and joins the errors.
+func (s *MultiACMEStorage) each(fn func(ACMEStorage) error) error {
+	var errs []error
+	for i, storage := range s.storages {
+		if err := fn(storage); err != nil {
+			errs = append(errs, fmt.Errorf("storage %d (%T): %w", i, storage, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *MultiACMEStorage) SaveCert(domainRoot string, cert, privateKey []byte) error {
+	return s.each(func(storage ACMEStorage) error { return storage.SaveCert(domainRoot, cert, privateKey) })
+}
+
+func (s *MultiACMEStorage) SaveChain(domainRoot string, chain []byte) error {
+	return s.each(func(storage ACMEStorage) error { return storage.SaveChain(domainRoot, chain) })
+}
+
+func (s *MultiACMEStorage) SaveOCSP(domainRoot string, ocspResp []byte) error {
+	return s.each(func(storage ACMEStorage) error { return storage.SaveOCSP(domainRoot, ocspResp) })
+}
+
+func (s *MultiACMEStorage) SaveUser(user DomainUser) error {
+	return s.each(func(storage ACMEStorage) error { return storage.SaveUser(user) })
+}
+
+func (s *MultiACMEStorage) SaveRegistration(reg *registration.Resource) error {
+	return s.each(func(storage ACMEStorage) error { return storage.SaveRegistration(reg) })
+}
+
+// DownloadCert returns the certificate from the first storage that has it. ErrCertNotFound is
+// only reported when every storage lacks the certificate, so a failing backend is not mistaken
+// for a missing certificate.
+func (s *MultiACMEStorage) DownloadCert(domainRoot string) ([]byte, []byte, error) {
+	var errs []error
+	for _, storage := range s.storages {
+		cert, key, err := storage.DownloadCert(domainRoot)
+		if err == nil {
+			return cert, key, nil
+		}
+		if !errors.Is(err, ErrCertNotFound) {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) == 0 {
+		return nil, nil, fmt.Errorf("%w for %s in any storage", ErrCertNotFound, domainRoot)
+	}
+	return nil, nil, errors.Join(errs...)
+}
+
+// CheckAccess checks every storage that supports it.
+func (s *MultiACMEStorage) CheckAccess() error {
+	return s.each(func(storage ACMEStorage) error {
+		if checker, ok := storage.(AccessChecker); ok {
+			return checker.CheckAccess()
+		}
+		return nil
+	})
+}
+
+// CheckWrite checks every storage that supports it.
+func (s *MultiACMEStorage) CheckWrite() error {
+	return s.each(func(storage ACMEStorage) error {
+		if checker, ok := storage.(WriteChecker); ok {
+			return checker.CheckWrite()
+		}
+		return nil
+	})
+}
+
+func (s *MultiACMEStorage) LoadRenewalHistory() (RenewalHistory, error) {
+	var errs []error
+	for _, storage := range s.storages {
+		history, err := storage.LoadRenewalHistory()
+		if err == nil {
+			return history, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+func (s *MultiACMEStorage) SaveRenewalHistory(history RenewalHistory) error {
+	return s.each(func(storage ACMEStorage) error { return storage.SaveRenewalHistory(history) })
+}
+
+func (s *MultiACMEStorage) LoadACMEDNSAccounts() (map[string]ACMEDNSAccount, error) {
+	var errs []error
+	for _, storage := range s.storages {
+		store, ok := storage.(ACMEDNSAccountStore)
+		if !ok {
+			continue
+		}
+		accounts, err := store.LoadACMEDNSAccounts()
+		if err == nil {
+			return accounts, nil
+		}
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		return map[string]ACMEDNSAccount{}, nil
+	}
+	return nil, errors.Join(errs...)
+}
+
+func (s *MultiACMEStorage) SaveACMEDNSAccounts(accounts map[string]ACMEDNSAccount) error {
+	return s.each(func(storage ACMEStorage) error {
+		if store, ok := storage.(ACMEDNSAccountStore); ok {
+			return store.SaveACMEDNSAccounts(accounts)
+		}
+		return nil
+	})
+}
+
+func (s *MultiACMEStorage) LoadUser(emailAddress string) (DomainUser, error) {
+	var errs []error
+	for _, storage := range s.storages {
+		user, err := storage.LoadUser(emailAddress)
+		if err == nil {
+			return user, nil
+		}
+		errs = append(errs, err)
+	}
+	return DomainUser{}, errors.Join(errs...)
+}
+
+func (s *MultiACMEStorage) LoadRegistration() (*registration.Resource, error) {
+	var errs []error
+	for _, storage := range s.storages {
+		reg, err := storage.LoadRegistration()
+		if err == nil {
+			return reg, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+// DeleteCert deletes domainRoot from every storage and from the cert directory.
+func (s *MultiACMEStorage) DeleteCert(domainRoot string) error {
+	err := s.each(func(storage ACMEStorage) error { return storage.DeleteCert(domainRoot) })
+	return errors.Join(err, removeCertDir(s.certDir, domainRoot))
+}
+
+// ListCerts returns the domain roots held by any storage or installed in the cert directory.
+func (s *MultiACMEStorage) ListCerts() ([]string, error) {
+	roots, err := listCertDirs(s.certDir)
+	if err != nil {
+		return nil, err
+	}
+	err = s.each(func(storage ACMEStorage) error {
+		lister, ok := storage.(CertLister)
+		if !ok {
+			return nil
+		}
+		held, err := lister.ListCerts()
+		for _, domainRoot := range held {
+			if !slices.Contains(roots, domainRoot) {
+				roots = append(roots, domainRoot)
+			}
+		}
+		return err
+	})
+	return roots, err
+}
+
+// ListArchivedCerts returns the archived versions kept by the first storage that archives
+// certificates.
+func (s *MultiACMEStorage) ListArchivedCerts(domainRoot string) ([]string, error) {
+	archiver, err := s.archiver()
+	if err != nil {
+		return nil, err
+	}
+	return archiver.ListArchivedCerts(domainRoot)
+}
+
+// LoadArchivedCert loads an archived version from the first storage that archives
+// certificates. Restoring it with SaveCert replicates it to every storage.
+func (s *MultiACMEStorage) LoadArchivedCert(domainRoot, version string) ([]byte, []byte, error) {
+	archiver, err := s.archiver()
+	if err != nil {
+		return nil, nil, err
+	}
+	return archiver.LoadArchivedCert(domainRoot, version)
+}
+
+func (s *MultiACMEStorage) archiver() (CertArchiver, error) {
+	for _, storage := range s.storages {
+		if archiver, ok := storage.(CertArchiver); ok {
+			return archiver, nil
+		}
+	}
+	return nil, fmt.Errorf("no storage keeps archived certificates")
+}
+
+// AcquireLease takes the leader lease kept by the first storage that keeps one.
+func (s *MultiACMEStorage) AcquireLease(ctx context.Context, holder string, ttl time.Duration) (bool, error) {
+	lease, err := s.lease()
+	if err != nil {
+		return false, err
+	}
+	return lease.AcquireLease(ctx, holder, ttl)
+}
+
+// ReleaseLease releases the leader lease kept by the first storage that keeps one.
+func (s *MultiACMEStorage) ReleaseLease(ctx context.Context, holder string) error {
+	lease, err := s.lease()
+	if err != nil {
+		return err
+	}
+	return lease.ReleaseLease(ctx, holder)
+}
+
+func (s *MultiACMEStorage) lease() (LeaderLease, error) {
+	for _, storage := range s.storages {
+		if lease, ok := storage.(LeaderLease); ok {
+			return lease, nil
+		}
+	}
+	return nil, fmt.Errorf("no storage keeps a leader lease")
+}
+
+func (s *MultiACMEStorage) CertLocation(domainRoot string) (certPath, keyPath string) {
+	return GetLocalCertFilenames(s.certDir, domainRoot)
+}
+
+// UpdateTLS runs updateTLS for domainGroup over the combined storages, holding the domain lock
+// and the distributed lock of every S3 storage that has distributedLock enabled.
+func (s *MultiACMEStorage) UpdateTLS(domainGroup []string) error {
+	domainRoot := DomainRoot(domainGroup)
+	unlock := lockDomain(domainRoot)
+	defer unlock()
+	for _, storage := range s.storages {
+		if s3Storage, ok := storage.(*S3ACMEStorage); ok {
+			release, err := s3Storage.lockForUpdate(domainRoot)
+			if err != nil {
+				return err
+			}
+			defer release()
+		}
+	}
+
+	return updateTLS(updateTLSParams{
+		storage:     s,
+		certDir:     s.certDir,
+		email:       s.contactEmail,
+		caAuthority: s.caAuthority,
+		domainGroup: domainGroup,
+	})
+}
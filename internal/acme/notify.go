@@ -0,0 +1,121 @@
+package acme
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Notification event types.
+const (
+	EventRenewed       = "renewed"
+	EventRenewalFailed = "renewal_failed"
+	// EventExpiring is sent when renewal failed and the current certificate expires within
+	// CriticalExpiryDays.
+	EventExpiring = "expiring"
+)
+
+// CriticalExpiryDays is the remaining validity below which a failed renewal is reported as an
+// EventExpiring alert in addition to the failure itself.
+var CriticalExpiryDays = 7
+
+// Event describes something that happened to a domain group's certificate during a sweep.
+type Event struct {
+	Type          string    `json:"event"`
+	Domain        string    `json:"domain"`
+	Domains       []string  `json:"domains"`
+	NotAfter      time.Time `json:"notAfter,omitzero"`
+	DaysRemaining int       `json:"daysRemaining"`
+	Error         string    `json:"error,omitempty"`
+	Time          time.Time `json:"time"`
+}
+
+// Notifier delivers events to an external system.
+type Notifier interface {
+	Notify(event Event) error
+}
+
+// Notifiers receive every event emitted by UpdateTLS.
+var Notifiers []Notifier
+
+// notify sends event to every configured notifier. Failures are logged, not returned, so a
+// broken notification channel never fails a renewal.
+func notify(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	for _, notifier := range Notifiers {
+		if err := notifier.Notify(event); err != nil {
+			slog.Warn("error sending notification", "event", event.Type, "domain", event.Domain, "notifier", fmt.Sprintf("%T", notifier), "error", err)
+		}
+	}
+}
+
+// newEvent builds an event for domainGroup, filling in the expiry of certData when it parses.
+func newEvent(eventType string, domainGroup []string, certData []byte, err error) Event {
+	event := Event{
+		Type:    eventType,
+		Domain:  DomainRoot(domainGroup),
+		Domains: domainGroup,
+	}
+	if cert, parseErr := ParseCertificate(certData); parseErr == nil {
+		event.NotAfter = cert.NotAfter
+		event.DaysRemaining = CertRemainingDays(cert)
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	return event
+}
+
+// notifyRenewalFailed reports a failed renewal and, when the certificate still in use
+// (currentCert) expires within CriticalExpiryDays, raises a critical expiry alert.
+func notifyRenewalFailed(domainGroup []string, currentCert []byte, err error) {
+	notify(newEvent(EventRenewalFailed, domainGroup, currentCert, err))
+
+	event := newEvent(EventExpiring, domainGroup, currentCert, err)
+	if event.NotAfter.IsZero() || event.DaysRemaining >= CriticalExpiryDays {
+		return
+	}
+	slog.Error("certificate is about to expire and could not be renewed",
+		"event", "critical_expiry",
+		"domain", event.Domain,
+		"notAfter", event.NotAfter,
+		"daysRemaining", event.DaysRemaining,
+		"error", err,
+	)
+	notify(event)
+}
+
+// WebhookNotifier POSTs each event as JSON to URL.
+type WebhookNotifier struct {
+	URL    string
+	Client *http.Client
+}
+
+// NewWebhookNotifier returns a WebhookNotifier for url with a 30 second timeout.
+func NewWebhookNotifier(url string) *WebhookNotifier {
+	return &WebhookNotifier{
+		URL:    url,
+		Client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (n *WebhookNotifier) Notify(event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("error encoding event: %w", err)
+	}
+	resp, err := n.Client.Post(n.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error posting to webhook: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
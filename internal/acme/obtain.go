@@ -0,0 +1,129 @@
+package acme
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/go-acme/lego/v4/certificate"
+)
+
+// ObtainTimeout bounds each certificate order, challenges and DNS propagation included, so a
+// domain group whose order is stuck fails instead of holding up its sweep. Zero disables it.
+var ObtainTimeout = DefaultObtainTimeout
+
+// DefaultObtainTimeout is ObtainTimeout when the config doesn't set it.
+const DefaultObtainTimeout = 2 * time.Minute
+
+// obtainParent is the context orders are derived from; see SetObtainContext.
+var obtainParent struct {
+	mu  sync.Mutex
+	ctx context.Context
+}
+
+// SetObtainContext sets the context every order is derived from, so canceling it abandons the
+// orders in flight, e.g. on shutdown. Orders are derived from context.Background until it is
+// set.
+func SetObtainContext(ctx context.Context) {
+	obtainParent.mu.Lock()
+	defer obtainParent.mu.Unlock()
+	obtainParent.ctx = ctx
+}
+
+// abandonedOrders counts, by domain root, the orders given up by obtainWithTimeout that are
+// still running in the background.
+var abandonedOrders struct {
+	mu    sync.Mutex
+	roots map[string]int
+	// waiters are run once the abandoned orders of their domain root have ended.
+	waiters map[string][]func()
+}
+
+// abandonedOrderRunning reports whether an order given up for domainRoot is still running.
+func abandonedOrderRunning(domainRoot string) bool {
+	abandonedOrders.mu.Lock()
+	defer abandonedOrders.mu.Unlock()
+	return abandonedOrders.roots[domainRoot] > 0
+}
+
+// afterAbandonedOrders runs fn once no order given up for domainRoot is running: right away
+// unless one is, and otherwise in the background when the last one ends.
+func afterAbandonedOrders(domainRoot string, fn func()) {
+	abandonedOrders.mu.Lock()
+	if abandonedOrders.roots[domainRoot] == 0 {
+		abandonedOrders.mu.Unlock()
+		fn()
+		return
+	}
+	if abandonedOrders.waiters == nil {
+		abandonedOrders.waiters = make(map[string][]func())
+	}
+	abandonedOrders.waiters[domainRoot] = append(abandonedOrders.waiters[domainRoot], fn)
+	abandonedOrders.mu.Unlock()
+}
+
+// obtainWithTimeout runs obtain, the order of a certificate for domains, giving up when
+// ObtainTimeout passes or the obtain context is canceled. lego orders can't be canceled, so a
+// given-up order is left to finish or fail in the background and its certificate is discarded.
+// Until it has, no new order is placed for the same domain root, so a stuck order can't be
+// duplicated by the next sweep or a forced renewal.
+func obtainWithTimeout(domains []string, obtain func() (*certificate.Resource, error)) (*certificate.Resource, error) {
+	domainRoot := DomainRoot(domains)
+	if abandonedOrderRunning(domainRoot) {
+		return nil, fmt.Errorf("not ordering a certificate for %s: an earlier order that timed out is still running", domainRoot)
+	}
+	obtainParent.mu.Lock()
+	ctx := obtainParent.ctx
+	obtainParent.mu.Unlock()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	cancel := func() {}
+	if ObtainTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, ObtainTimeout)
+	}
+	defer cancel()
+
+	type result struct {
+		certificates *certificate.Resource
+		err          error
+	}
+	done := make(chan result, 1)
+	go func() {
+		certificates, err := obtain()
+		done <- result{certificates, err}
+	}()
+	select {
+	case r := <-done:
+		return r.certificates, r.err
+	case <-ctx.Done():
+		abandonedOrders.mu.Lock()
+		if abandonedOrders.roots == nil {
+			abandonedOrders.roots = make(map[string]int)
+		}
+		abandonedOrders.roots[domainRoot]++
+		abandonedOrders.mu.Unlock()
+		go func() {
+			r := <-done
+			slog.Info("Abandoned certificate order ended", "domains", domains, "error", r.err)
+			abandonedOrders.mu.Lock()
+			var waiters []func()
+			if abandonedOrders.roots[domainRoot]--; abandonedOrders.roots[domainRoot] == 0 {
+				delete(abandonedOrders.roots, domainRoot)
+				waiters = abandonedOrders.waiters[domainRoot]
+				delete(abandonedOrders.waiters, domainRoot)
+			}
+			abandonedOrders.mu.Unlock()
+			for _, fn := range waiters {
+				fn()
+			}
+		}()
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, fmt.Errorf("order for %v did not complete within obtainTimeout (%s)", domains, ObtainTimeout)
+		}
+		return nil, fmt.Errorf("order for %v abandoned: %w", domains, ctx.Err())
+	}
+}
@@ -0,0 +1,217 @@
+package acme
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+const ocspFilename = "ocsp.resp"
+
+// errNoOCSPResponder is returned for certificates (e.g. self-signed) that name no OCSP responder.
+var errNoOCSPResponder = errors.New("certificate has no OCSP responder URL")
+
+var ocspHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// parseCertificateBundle parses every CERTIFICATE block in a PEM bundle, in order.
+func parseCertificateBundle(bundle []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, bundle = pem.Decode(bundle)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing certificate: %v", err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates found in PEM bundle")
+	}
+	return certs, nil
+}
+
+// fetchOCSPResponse queries the OCSP responder named in the leaf certificate of the bundle
+// and returns the raw DER response. The bundle must contain the issuer after the leaf.
+func fetchOCSPResponse(bundle []byte) ([]byte, error) {
+	certs, err := parseCertificateBundle(bundle)
+	if err != nil {
+		return nil, err
+	}
+	leaf := certs[0]
+	if len(leaf.OCSPServer) == 0 {
+		return nil, errNoOCSPResponder
+	}
+	if len(certs) < 2 {
+		return nil, fmt.Errorf("certificate bundle does not include the issuer certificate")
+	}
+	issuer := certs[1]
+
+	req, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating OCSP request: %v", err)
+	}
+	resp, err := ocspHTTPClient.Post(leaf.OCSPServer[0], "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return nil, fmt.Errorf("error querying OCSP responder %s: %v", leaf.OCSPServer[0], err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OCSP responder %s returned %s", leaf.OCSPServer[0], resp.Status)
+	}
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("error reading OCSP response: %v", err)
+	}
+
+	parsed, err := ocsp.ParseResponseForCert(raw, leaf, issuer)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing OCSP response: %v", err)
+	}
+	slog.Debug("OCSP response fetched", "status", parsed.Status, "nextUpdate", parsed.NextUpdate)
+	return raw, nil
+}
+
+// MustStaple requests certificates carrying the OCSP Must-Staple extension. Clients that honour
+// it reject the certificate unless a valid OCSP response is stapled to the handshake.
+var MustStaple = false
+
+// mustStapleUnsupported lists CAs known to refuse or ignore Must-Staple requests. Let's Encrypt
+// stopped issuing Must-Staple certificates when it retired OCSP.
+var mustStapleUnsupported = map[string]bool{
+	CAAuthorityLetsEncryptProduction: true,
+	CAAuthorityLetsEncryptStaging:    true,
+}
+
+// ValidateMustStaple reports an error if caAuthority is known not to issue Must-Staple
+// certificates.
+func ValidateMustStaple(caAuthority string) error {
+	if mustStapleUnsupported[caAuthority] {
+		return fmt.Errorf("CA %s does not issue Must-Staple certificates", caAuthority)
+	}
+	return nil
+}
+
+func writeOCSPToDisk(certDir, domain string, ocspResp []byte) error {
+	return writeInstalledFile(filepath.Join(certDir, domain, ocspFilename), ocspResp, CertFileMode)
+}
+
+// updateOCSP refreshes the cached OCSP response for domainRoot on disk and in storage.
+// Failures are logged rather than returned: a missing staple is not a reason to fail renewal.
+func updateOCSP(storage ACMEStorage, certDir, domainRoot string, certData []byte) {
+	ocspResp, err := fetchOCSPResponse(certData)
+	if errors.Is(err, errNoOCSPResponder) {
+		slog.Debug("certificate has no OCSP responder; not caching OCSP response", "domain", domainRoot)
+		return
+	}
+	if err != nil {
+		slog.Warn("skipping OCSP response caching", "domain", domainRoot, "error", err)
+		return
+	}
+	if err := writeOCSPToDisk(certDir, domainRoot, ocspResp); err != nil {
+		slog.Warn("error writing OCSP response to disk", "domain", domainRoot, "error", err)
+	}
+	if err := storage.SaveOCSP(domainRoot, ocspResp); err != nil {
+		slog.Warn("error saving OCSP response to storage", "domain", domainRoot, "error", err)
+	}
+}
+
+// tlsFeatureOID identifies the TLS Feature extension (RFC 7633) that carries Must-Staple.
+var tlsFeatureOID = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 24}
+
+// statusRequestFeature is the TLS feature number of status_request, i.e. OCSP stapling.
+const statusRequestFeature = 5
+
+// hasMustStaple reports whether cert carries the Must-Staple TLS feature.
+func hasMustStaple(cert *x509.Certificate) bool {
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(tlsFeatureOID) {
+			continue
+		}
+		var features []int
+		if _, err := asn1.Unmarshal(ext.Value, &features); err != nil {
+			return false
+		}
+		return slices.Contains(features, statusRequestFeature)
+	}
+	return false
+}
+
+// OCSPInfo describes a certificate's stapling setup: whether it demands stapling and the state
+// of the cached OCSP response.
+type OCSPInfo struct {
+	MustStaple     bool      `json:"mustStaple"`
+	CachedResponse bool      `json:"cachedResponse"`
+	Status         string    `json:"status,omitempty"`
+	NextUpdate     time.Time `json:"nextUpdate,omitzero"`
+	// Valid is true when the cached response reports the certificate good and is not past
+	// NextUpdate.
+	Valid bool   `json:"valid"`
+	Error string `json:"error,omitempty"`
+}
+
+// InspectOCSP reports the stapling state of the certificate installed for domainRoot, reading the
+// cached OCSP response next to it.
+func InspectOCSP(storage ACMEStorage, domainRoot string) OCSPInfo {
+	var info OCSPInfo
+	certPath, _ := storage.CertLocation(domainRoot)
+	certData, err := os.ReadFile(certPath)
+	if err != nil {
+		info.Error = err.Error()
+		return info
+	}
+	certs, err := parseCertificateBundle(certData)
+	if err != nil {
+		info.Error = err.Error()
+		return info
+	}
+	leaf := certs[0]
+	info.MustStaple = hasMustStaple(leaf)
+
+	raw, err := os.ReadFile(filepath.Join(filepath.Dir(certPath), ocspFilename))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			info.Error = err.Error()
+		}
+		return info
+	}
+	info.CachedResponse = true
+	var issuer *x509.Certificate
+	if len(certs) > 1 {
+		issuer = certs[1]
+	}
+	resp, err := ocsp.ParseResponseForCert(raw, leaf, issuer)
+	if err != nil {
+		info.Error = fmt.Sprintf("error parsing cached OCSP response: %v", err)
+		return info
+	}
+	switch resp.Status {
+	case ocsp.Good:
+		info.Status = "good"
+	case ocsp.Revoked:
+		info.Status = "revoked"
+	default:
+		info.Status = "unknown"
+	}
+	info.NextUpdate = resp.NextUpdate
+	info.Valid = resp.Status == ocsp.Good && (resp.NextUpdate.IsZero() || time.Now().Before(resp.NextUpdate))
+	return info
+}
@@ -0,0 +1,36 @@
+package acme
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// EncodePKCS12 combines a PEM certificate (leaf first, followed by any chain) and its PEM private
+// key into a PKCS#12 (.pfx) bundle protected by password. An empty password is allowed.
+func EncodePKCS12(certPEM, keyPEM []byte, password string) ([]byte, error) {
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("error loading certificate and key: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("error parsing certificate: %w", err)
+	}
+	var caCerts []*x509.Certificate
+	for _, der := range pair.Certificate[1:] {
+		caCert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing chain certificate: %w", err)
+		}
+		caCerts = append(caCerts, caCert)
+	}
+
+	pfxData, err := pkcs12.Modern.Encode(pair.PrivateKey, leaf, caCerts, password)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding PKCS#12: %w", err)
+	}
+	return pfxData, nil
+}
@@ -0,0 +1,63 @@
+package acme
+
+import (
+	"errors"
+	"log/slog"
+	"regexp"
+	"sync"
+	"time"
+
+	legoacme "github.com/go-acme/lego/v4/acme"
+)
+
+const rateLimitedProblemType = "urn:ietf:params:acme:error:rateLimited"
+
+// DefaultRateLimitBackoff is how long a domain is left alone after a rate-limit response that
+// does not say when to retry.
+var DefaultRateLimitBackoff = time.Hour
+
+// retryAfterPattern matches the retry time Let's Encrypt includes in rate-limit problem details,
+// e.g. "retry after 2024-01-02 15:04:05 UTC".
+var retryAfterPattern = regexp.MustCompile(`retry after (\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}) UTC`)
+
+// rateLimitedUntil maps a domainRoot to the time.Time before which it must not be retried.
+var rateLimitedUntil sync.Map
+
+// rateLimitRetryAfter reports whether err carries an ACME rateLimited problem document and, if so,
+// when the CA said the request may be retried.
+func rateLimitRetryAfter(err error) (time.Time, bool) {
+	var problem *legoacme.ProblemDetails
+	if !errors.As(err, &problem) || problem.Type != rateLimitedProblemType {
+		return time.Time{}, false
+	}
+	if m := retryAfterPattern.FindStringSubmatch(problem.Detail); m != nil {
+		if retryAfter, err := time.Parse(time.DateTime, m[1]); err == nil {
+			return retryAfter, true
+		}
+	}
+	return time.Now().Add(DefaultRateLimitBackoff), true
+}
+
+// recordRateLimit remembers that domainRoot was rate limited if err says so.
+func recordRateLimit(domainRoot string, err error) {
+	retryAfter, ok := rateLimitRetryAfter(err)
+	if !ok {
+		return
+	}
+	rateLimitedUntil.Store(domainRoot, retryAfter)
+	slog.Error("ACME rate limit hit; backing off", "domain", domainRoot, "retryAfter", retryAfter, "error", err)
+}
+
+// rateLimitBackoff returns the time before which domainRoot must not be retried, if any.
+func rateLimitBackoff(domainRoot string) (time.Time, bool) {
+	v, ok := rateLimitedUntil.Load(domainRoot)
+	if !ok {
+		return time.Time{}, false
+	}
+	retryAfter := v.(time.Time)
+	if time.Now().After(retryAfter) {
+		rateLimitedUntil.Delete(domainRoot)
+		return time.Time{}, false
+	}
+	return retryAfter, true
+}
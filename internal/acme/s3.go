@@ -8,120 +8,345 @@ import (
 	"encoding/json"
 	"encoding/pem"
 	"fmt"
-	"log"
 	"log/slog"
+	"net/http"
+	"net/url"
 	"os"
 	"path"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
 	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/aws/aws-sdk-go-v2/service/sts"
 	"github.com/go-acme/lego/v4/registration"
+	"github.com/joshuaschlichting/loadmaster/internal/metrics"
 )
 
-var awsConfig aws.Config
-
-func init() {
-	err := logAWSProfileDetails()
-	if err != nil {
-		log.Println("Failed to log AWS config:", err)
-	}
-}
-
-func logAWSProfileDetails() error {
-	var err error
-	awsConfig, err = config.LoadDefaultConfig(context.TODO())
-	if err != nil {
-		return fmt.Errorf("logAWSConfig() error initializing AWS config object: %v", err)
-	}
-
+// logAWSProfileDetails logs the identity awsConfig's credentials resolve to, which is the
+// assumed role when one is configured.
+func logAWSProfileDetails(ctx context.Context, awsConfig aws.Config) error {
 	client := sts.NewFromConfig(awsConfig)
 
 	input := &sts.GetCallerIdentityInput{}
 
-	resp, err := client.GetCallerIdentity(context.TODO(), input)
+	resp, err := client.GetCallerIdentity(ctx, input)
 	if err != nil {
 		return fmt.Errorf("logAWSConfig(): %v", err)
 	}
 
-	slog.Info("AWS Config", "account", *resp.Account, "user", *resp.UserId, "arn", *resp.Arn)
+	slog.Debug("AWS Config", "account", *resp.Account, "user", *resp.UserId, "arn", *resp.Arn)
 	return nil
 }
 
 type S3ACMEStorage struct {
 	s3Client     *s3.Client
 	uploader     *manager.Uploader
-	downloader   *manager.Downloader
 	serviceName  string
 	localCertDir string
 	bucketName   string
 	contactEmail string
 	caAuthority  string
+	// distributedLock guards UpdateTLS with a lock object in the bucket.
+	distributedLock bool
+	// timeout bounds each S3 operation, including its retries.
+	timeout time.Duration
+	// maxArchiveVersions is how many archived versions of each certificate are kept; zero
+	// keeps all.
+	maxArchiveVersions int
+	// gzipAccountData stores the ACME user and registration JSON gzipped.
+	gzipAccountData bool
 }
 
+// DefaultS3Timeout is how long an S3 operation may take, retries included, when
+// NewS3ACMEStorageParams.Timeout is unset.
+var DefaultS3Timeout = 30 * time.Second
+
 type NewS3ACMEStorageParams struct {
 	ServiceName  string
 	LocalCertDir string
 	BucketName   string
-	ContactEmail string
-	CAAuthority  string
+	// Region is the bucket's AWS region. Empty uses the region of the AWS config.
+	Region string
+	// Endpoint is the URL of an S3-compatible service used instead of AWS, addressed with
+	// path-style requests.
+	Endpoint        string
+	ContactEmail    string
+	CAAuthority     string
+	DistributedLock bool
+	// MaxAttempts is how many times a failed S3 request is attempted. Zero uses the SDK
+	// default of 3.
+	MaxAttempts int
+	// Timeout bounds each S3 operation. Zero uses DefaultS3Timeout.
+	Timeout time.Duration
+	// Profile selects a named profile from the shared AWS config files.
+	Profile string
+	// AccessKeyID and SecretAccessKey are static credentials. Without them or a Profile, the
+	// default credential chain is used.
+	AccessKeyID     string
+	SecretAccessKey string
+	// RoleARN is a role assumed on top of the credentials above, e.g. for a bucket in another
+	// account. ExternalID is passed along when the role's trust policy requires one.
+	RoleARN    string
+	ExternalID string
+	// MaxArchiveVersions is how many archived versions of each certificate are kept under
+	// certs/<domain root>/archive/. Zero keeps all.
+	MaxArchiveVersions int
+	// GzipAccountData stores the ACME user and registration JSON gzipped, under a .gz key.
+	GzipAccountData bool
 }
 
 func NewS3ACMEStorage(params NewS3ACMEStorageParams) (*S3ACMEStorage, error) {
-	switch params.CAAuthority {
-	case CAAuthorityLetsEncryptProduction:
-		slog.Warn("Using Let's Encrypt PRODUCTION CA Authority", "CAAuthority", params.CAAuthority)
-	case CAAuthorityLetsEncryptStaging:
-		slog.Info("Using Let's Encrypt Staging CA Authority", "CAAuthority", params.CAAuthority)
-	default:
-		slog.Warn("Unknown CA Authority", "CAAuthority", params.CAAuthority)
-	}
-	cfg, err := config.LoadDefaultConfig(context.TODO())
+	if params.LocalCertDir == "" {
+		params.LocalCertDir = defaultCertDir()
+	}
+	if params.Timeout <= 0 {
+		params.Timeout = DefaultS3Timeout
+	}
+	logCAAuthority(params.CAAuthority)
+	opts := []func(*config.LoadOptions) error{
+		config.WithHTTPClient(awshttp.NewBuildableClient().WithTransportOptions(func(tr *http.Transport) {
+			tr.Proxy = proxyFunc()
+		})),
+	}
+	if params.MaxAttempts > 0 {
+		opts = append(opts, config.WithRetryMaxAttempts(params.MaxAttempts))
+	}
+	if params.Profile != "" {
+		opts = append(opts, config.WithSharedConfigProfile(params.Profile))
+	}
+	if params.Region != "" {
+		opts = append(opts, config.WithRegion(params.Region))
+	}
+	if params.AccessKeyID != "" {
+		opts = append(opts, config.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(params.AccessKeyID, params.SecretAccessKey, "")))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), params.Timeout)
+	defer cancel()
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
 	if err != nil {
 		return nil, fmt.Errorf("error creating AWS config for S3ACMEStorage: %s", err)
 	}
+	if params.RoleARN != "" {
+		cfg.Credentials = aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), params.RoleARN,
+			func(o *stscreds.AssumeRoleOptions) {
+				if params.ExternalID != "" {
+					o.ExternalID = aws.String(params.ExternalID)
+				}
+			}))
+		if _, err := cfg.Credentials.Retrieve(ctx); err != nil {
+			return nil, fmt.Errorf("error assuming role %s for S3ACMEStorage: %w", params.RoleARN, err)
+		}
+	}
+	if err := logAWSProfileDetails(ctx, cfg); err != nil {
+		slog.Warn("Failed to log AWS config", "error", err)
+	}
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if params.Endpoint != "" {
+			o.BaseEndpoint = aws.String(params.Endpoint)
+			o.UsePathStyle = true
+		}
+	})
 	return &S3ACMEStorage{
-		s3Client:     s3.NewFromConfig(cfg),
-		uploader:     manager.NewUploader(s3.NewFromConfig(cfg)),
-		downloader:   manager.NewDownloader(s3.NewFromConfig(cfg)),
-		serviceName:  params.ServiceName,
-		localCertDir: params.LocalCertDir,
-		bucketName:   params.BucketName,
-		contactEmail: params.ContactEmail,
-		caAuthority:  params.CAAuthority,
+		s3Client:           client,
+		uploader:           manager.NewUploader(client),
+		serviceName:        params.ServiceName,
+		localCertDir:       params.LocalCertDir,
+		bucketName:         params.BucketName,
+		contactEmail:       params.ContactEmail,
+		caAuthority:        params.CAAuthority,
+		distributedLock:    params.DistributedLock,
+		timeout:            params.Timeout,
+		maxArchiveVersions: params.MaxArchiveVersions,
+		gzipAccountData:    params.GzipAccountData,
 	}, nil
 }
 
+// opContext returns the context for one S3 operation, which fails with
+// context.DeadlineExceeded once the configured timeout passes instead of blocking the sweep.
+func (s *S3ACMEStorage) opContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), s.timeout)
+}
+
+// certTagging builds the S3 object tags stored on certificate objects, for lifecycle rules and
+// inventory reports keyed on expiry.
+func (s *S3ACMEStorage) certTagging(domainRoot string, cert []byte) string {
+	tags := url.Values{}
+	tags.Set("loadmaster:domain", domainRoot)
+	tags.Set("loadmaster:caAuthority", s.caAuthority)
+	if parsed, err := ParseCertificate(cert); err == nil {
+		tags.Set("loadmaster:notAfter", parsed.NotAfter.UTC().Format(time.RFC3339))
+	} else {
+		slog.Warn("not tagging certificate with notAfter", "domain", domainRoot, "error", err)
+	}
+	return tags.Encode()
+}
+
 func (s *S3ACMEStorage) SaveCert(domainRoot string, cert, privateKey []byte) error {
+	ctx, cancel := s.opContext()
+	defer cancel()
+	start := time.Now()
+	tagging := s.certTagging(domainRoot, cert)
+	certKey := path.Join(s.serviceName, "certs", domainRoot, "cert.pem")
+	privateKeyKey := path.Join(s.serviceName, "certs", domainRoot, "privkey.pem")
 
 	// Upload the file to S3
-	_, err := s.uploader.Upload(context.TODO(), &s3.PutObjectInput{
-		Bucket: aws.String(s.bucketName),
-		Key:    aws.String(path.Join(s.serviceName, "certs", domainRoot, "cert.pem")),
-		Body:   bytes.NewReader(cert),
+	_, err := s.uploader.Upload(ctx, &s3.PutObjectInput{
+		Bucket:   aws.String(s.bucketName),
+		Key:      aws.String(certKey),
+		Body:     bytes.NewReader(cert),
+		Tagging:  aws.String(tagging),
+		Metadata: checksumMetadata(cert),
 	})
 	if err != nil {
 		return fmt.Errorf("error while uploading certificate files to S3: %v", err)
 	}
+	s.cacheWritten(certKey, cert)
 	// Upload the file to S3
-	_, err = s.uploader.Upload(context.TODO(), &s3.PutObjectInput{
-		Bucket: aws.String(s.bucketName),
-		Key:    aws.String(path.Join(s.serviceName, "certs", domainRoot, "privkey.pem")),
-		Body:   bytes.NewReader(privateKey),
+	_, err = s.uploader.Upload(ctx, &s3.PutObjectInput{
+		Bucket:   aws.String(s.bucketName),
+		Key:      aws.String(privateKeyKey),
+		Body:     bytes.NewReader(privateKey),
+		Tagging:  aws.String(tagging),
+		Metadata: checksumMetadata(privateKey),
 	})
 	if err != nil {
 		return fmt.Errorf("error while uploading certificate files to S3: %v", err)
 	}
-	slog.Debug(fmt.Sprintf("Successfully uploaded the renewed certificate to S3 for %s", domainRoot))
+	s.cacheWritten(privateKeyKey, privateKey)
+	// The current certificate is saved; a failed archive copy doesn't fail the renewal.
+	if err := s.archiveCert(ctx, domainRoot, cert, privateKey, tagging); err != nil {
+		slog.Error("Error archiving certificate", "domain", domainRoot, "error", err)
+	}
+	observeS3Op("SaveCert", domainRoot, start, int64(len(cert)+len(privateKey)))
 
 	return nil
 }
 
+// CertLocation returns the local cache paths for domainRoot, since that is what servers read;
+// the S3 objects are only the durable copy.
+func (s *S3ACMEStorage) CertLocation(domainRoot string) (certPath, keyPath string) {
+	return GetLocalCertFilenames(s.localCertDir, domainRoot)
+}
+
+// DeleteCert deletes every object under domainRoot's prefix in the bucket and the local copy.
+func (s *S3ACMEStorage) DeleteCert(domainRoot string) error {
+	if err := removeCertDir(s.localCertDir, domainRoot); err != nil {
+		return err
+	}
+	ctx, cancel := s.opContext()
+	defer cancel()
+	start := time.Now()
+	prefix := path.Join(s.serviceName, "certs", domainRoot) + "/"
+	deleted := 0
+	pages := s3.NewListObjectsV2Paginator(s.s3Client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucketName),
+		Prefix: aws.String(prefix),
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("error listing objects under %s: %w", prefix, err)
+		}
+		if len(page.Contents) == 0 {
+			continue
+		}
+		objects := make([]types.ObjectIdentifier, 0, len(page.Contents))
+		for _, object := range page.Contents {
+			objects = append(objects, types.ObjectIdentifier{Key: object.Key})
+		}
+		out, err := s.s3Client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(s.bucketName),
+			Delete: &types.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return fmt.Errorf("error deleting objects under %s: %w", prefix, err)
+		}
+		if len(out.Errors) > 0 {
+			first := out.Errors[0]
+			return fmt.Errorf("error deleting %d object(s) under %s, e.g. %s: %s", len(out.Errors), prefix, aws.ToString(first.Key), aws.ToString(first.Message))
+		}
+		deleted += len(objects)
+	}
+	cacheDeletePrefix(s.cacheKey(prefix))
+	observeS3Op("DeleteCert", domainRoot, start, 0)
+	slog.Info("Deleted certificate from S3", "domain", domainRoot, "objects", deleted)
+	return nil
+}
+
+// ListCerts returns the domain roots with objects under certs/ in the bucket or a certificate in
+// the local cert directory.
+func (s *S3ACMEStorage) ListCerts() ([]string, error) {
+	roots, err := listCertDirs(s.localCertDir)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := s.opContext()
+	defer cancel()
+	prefix := path.Join(s.serviceName, "certs") + "/"
+	pages := s3.NewListObjectsV2Paginator(s.s3Client, &s3.ListObjectsV2Input{
+		Bucket:    aws.String(s.bucketName),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error listing certificates in bucket %s: %w", s.bucketName, err)
+		}
+		for _, common := range page.CommonPrefixes {
+			domainRoot := strings.TrimSuffix(strings.TrimPrefix(aws.ToString(common.Prefix), prefix), "/")
+			if !slices.Contains(roots, domainRoot) {
+				roots = append(roots, domainRoot)
+			}
+		}
+	}
+	return roots, nil
+}
+
+// SaveChain uploads the issuer chain next to the domain's certificate in S3.
+func (s *S3ACMEStorage) SaveChain(domainRoot string, chain []byte) error {
+	ctx, cancel := s.opContext()
+	defer cancel()
+	_, err := s.uploader.Upload(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.bucketName),
+		Key:    aws.String(path.Join(s.serviceName, "certs", domainRoot, "chain.pem")),
+		Body:   bytes.NewReader(chain),
+	})
+	if err != nil {
+		return fmt.Errorf("error while uploading chain to S3: %v", err)
+	}
+	return nil
+}
+
+// SaveOCSP uploads the cached OCSP response next to the domain's certificate in S3.
+func (s *S3ACMEStorage) SaveOCSP(domainRoot string, ocspResp []byte) error {
+	ctx, cancel := s.opContext()
+	defer cancel()
+	_, err := s.uploader.Upload(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.bucketName),
+		Key:    aws.String(path.Join(s.serviceName, "certs", domainRoot, ocspFilename)),
+		Body:   bytes.NewReader(ocspResp),
+	})
+	if err != nil {
+		return fmt.Errorf("error while uploading OCSP response to S3: %v", err)
+	}
+	return nil
+}
+
 func (s *S3ACMEStorage) DownloadCert(domainRoot string) ([]byte, []byte, error) {
+	ctx, cancel := s.opContext()
+	defer cancel()
 	slog.Debug("Downloading certificate from S3 for " + domainRoot)
+	start := time.Now()
 
 	certFolder := path.Join(s.localCertDir, domainRoot)
 	// mkdir if not exists
@@ -132,77 +357,66 @@ func (s *S3ACMEStorage) DownloadCert(domainRoot string) ([]byte, []byte, error)
 		}
 	}
 	// Download the cert.pem file from S3
-	certData := make([]byte, 0)
-
-	certS3Writer := manager.NewWriteAtBuffer(certData)
 	s3Prefix := path.Join(s.serviceName, "certs", domainRoot)
 
 	s3KeyCertPem := path.Join(s3Prefix, "cert.pem")
 	slog.Debug(fmt.Sprintf("Downloading certificate from S3 for %s: %s", domainRoot, s3KeyCertPem))
-	certDataSize, err := s.downloader.Download(context.TODO(), certS3Writer, &s3.GetObjectInput{
-		Bucket: aws.String(s.bucketName),
-		Key:    aws.String(s3KeyCertPem),
-	})
+	certData, err := s.getObject(ctx, s3KeyCertPem)
 	if err != nil {
+		if isNotFound(err) {
+			return nil, nil, fmt.Errorf("%w in S3 at %s", ErrCertNotFound, s3KeyCertPem)
+		}
 		return nil, nil, fmt.Errorf("error while downloading certificate file from S3: %v", err)
 	}
-	slog.Debug("certificate downloaded", "s3key", s3KeyCertPem, "size", certDataSize)
 
 	// Download the privkey.pem file from S3
-	privateKeyData := make([]byte, 0)
-	privateKeyS3Writer := manager.NewWriteAtBuffer(privateKeyData)
-
 	s3KeyPrivKeyPem := path.Join(s3Prefix, "privkey.pem")
 	slog.Debug(fmt.Sprintf("Downloading private key from S3 for %s: %s", domainRoot, s3KeyPrivKeyPem))
-	privKeySize, err := s.downloader.Download(context.TODO(), privateKeyS3Writer, &s3.GetObjectInput{
-		Bucket: aws.String(s.bucketName),
-		Key:    aws.String(s3KeyPrivKeyPem),
-	})
+	privateKeyData, err := s.getObject(ctx, s3KeyPrivKeyPem)
 	if err != nil {
+		if isNotFound(err) {
+			return nil, nil, fmt.Errorf("%w: private key missing in S3 at %s", ErrCertNotFound, s3KeyPrivKeyPem)
+		}
 		return nil, nil, fmt.Errorf("error while downloading private key from S3: %v", err)
 	}
-	slog.Debug("private key downloaded", "s3key", s3KeyPrivKeyPem, "size", privKeySize)
-	slog.Debug(fmt.Sprintf("Successfully downloaded the certificates from S3 for %s", domainRoot))
+	observeS3Op("DownloadCert", domainRoot, start, int64(len(certData)+len(privateKeyData)))
 
-	return certS3Writer.Bytes(), privateKeyS3Writer.Bytes(), nil
+	return certData, privateKeyData, nil
+}
+
+// accountPrefix is the S3 prefix holding the ACME user and registration for the configured CA.
+func (s *S3ACMEStorage) accountPrefix() string {
+	return path.Join(s.serviceName, "accounts", accountNamespace(s.caAuthority))
 }
 
 func (s *S3ACMEStorage) LoadUser(emailAddress string) (DomainUser, error) {
+	ctx, cancel := s.opContext()
+	defer cancel()
+	start := time.Now()
 
 	filename := fmt.Sprintf("%s.json", emailAddress)
-	filename = path.Join(s.serviceName, filename)
-	userData := make([]byte, 0)
-	userS3Writer := manager.NewWriteAtBuffer(userData)
-
-	_, err := s.downloader.Download(context.TODO(), userS3Writer, &s3.GetObjectInput{
-		Bucket: aws.String(s.bucketName),
-		Key:    aws.String(filename),
-	})
+	filename = path.Join(s.accountPrefix(), filename)
+	userData, err := s.getAccountObject(ctx, filename)
 	if err != nil {
 		return DomainUser{}, fmt.Errorf("error reading user file from S3: %s", err)
 	}
 
 	var user DomainUser
-	err = json.Unmarshal(userS3Writer.Bytes(), &user)
+	err = json.Unmarshal(userData, &user)
 	if err != nil {
 		return DomainUser{}, fmt.Errorf("error unmarshalling user: %s", err)
 	}
 
 	// load the private key
 	keyFilename := fmt.Sprintf("%s.pem", emailAddress)
-	keyFilename = path.Join(s.serviceName, keyFilename)
-	keyData := make([]byte, 0)
-	keyS3Writer := manager.NewWriteAtBuffer(keyData)
-
-	_, err = s.downloader.Download(context.TODO(), keyS3Writer, &s3.GetObjectInput{
-		Bucket: aws.String(s.bucketName),
-		Key:    aws.String(keyFilename),
-	})
+	keyFilename = path.Join(s.accountPrefix(), keyFilename)
+	keyData, err := s.getObject(ctx, keyFilename)
 	if err != nil {
 		return DomainUser{}, fmt.Errorf("error reading private key file from S3: %s", err)
 	}
+	observeS3Op("LoadUser", emailAddress, start, int64(len(userData)+len(keyData)))
 
-	block, _ := pem.Decode(keyS3Writer.Bytes())
+	block, _ := pem.Decode(keyData)
 	if block == nil || block.Type != "PRIVATE KEY" {
 		return DomainUser{}, fmt.Errorf("failed to decode PEM block containing private key")
 	}
@@ -230,6 +444,9 @@ func (s *S3ACMEStorage) LoadUser(emailAddress string) (DomainUser, error) {
 }
 
 func (s *S3ACMEStorage) SaveUser(user DomainUser) error {
+	ctx, cancel := s.opContext()
+	defer cancel()
+	start := time.Now()
 
 	userJson, err := json.Marshal(user)
 	if err != nil {
@@ -237,13 +454,8 @@ func (s *S3ACMEStorage) SaveUser(user DomainUser) error {
 	}
 
 	filename := fmt.Sprintf("%s.json", user.Email)
-	filename = path.Join(s.serviceName, filename)
-	_, err = s.s3Client.PutObject(context.TODO(), &s3.PutObjectInput{
-		Bucket: aws.String(s.bucketName),
-		Key:    aws.String(filename),
-		Body:   bytes.NewReader(userJson),
-	})
-	if err != nil {
+	filename = path.Join(s.accountPrefix(), filename)
+	if err := s.putAccountObject(ctx, filename, userJson); err != nil {
 		return fmt.Errorf("error writing user to S3: %s", err)
 	}
 	// Marshal the private key into a PKCS8 format
@@ -262,8 +474,8 @@ func (s *S3ACMEStorage) SaveUser(user DomainUser) error {
 	privateKeyPem := pem.EncodeToMemory(privateKeyBlock)
 
 	keyFilename := fmt.Sprintf("%s.pem", user.Email)
-	keyFilename = path.Join(s.serviceName, keyFilename)
-	_, err = s.s3Client.PutObject(context.TODO(), &s3.PutObjectInput{
+	keyFilename = path.Join(s.accountPrefix(), keyFilename)
+	_, err = s.s3Client.PutObject(ctx, &s3.PutObjectInput{
 		Bucket: aws.String(s.bucketName),
 		Key:    aws.String(keyFilename),
 		Body:   strings.NewReader(string(privateKeyPem)),
@@ -271,21 +483,29 @@ func (s *S3ACMEStorage) SaveUser(user DomainUser) error {
 	if err != nil {
 		return fmt.Errorf("error writing private key to S3: %s", err)
 	}
+	s.cacheWritten(keyFilename, privateKeyPem)
+	observeS3Op("SaveUser", user.Email, start, int64(len(userJson)+len(privateKeyPem)))
 	return nil
 }
 
+// observeS3Op records the duration of a completed S3 operation in the
+// loadmaster_s3_op_duration_seconds histogram and logs it with the number of bytes transferred.
+func observeS3Op(op, subject string, start time.Time, size int64) {
+	elapsed := time.Since(start)
+	metrics.S3OpDuration.WithLabelValues(op).Observe(elapsed.Seconds())
+	slog.Debug("S3 operation complete", "op", op, "subject", subject, "elapsed", elapsed, "bytes", size)
+}
+
 func (s *S3ACMEStorage) SaveRegistration(reg *registration.Resource) error {
+	ctx, cancel := s.opContext()
+	defer cancel()
 	data, err := json.Marshal(reg)
 	if err != nil {
 		return err
 	}
 
-	_, err = s.s3Client.PutObject(context.TODO(), &s3.PutObjectInput{
-		Bucket: aws.String(s.bucketName),
-		Key:    aws.String(path.Join(s.serviceName, "certs", "registration.json")),
-		Body:   bytes.NewReader(data),
-	})
-	if err != nil {
+	key := path.Join(s.accountPrefix(), "registration.json")
+	if err := s.putAccountObject(ctx, key, data); err != nil {
 		return fmt.Errorf("error writing registration to S3: %s", err)
 	}
 
@@ -293,20 +513,15 @@ func (s *S3ACMEStorage) SaveRegistration(reg *registration.Resource) error {
 }
 
 func (s *S3ACMEStorage) LoadRegistration() (*registration.Resource, error) {
-
-	data := make([]byte, 0)
-	dataWriter := manager.NewWriteAtBuffer(data)
-
-	_, err := s.downloader.Download(context.TODO(), dataWriter, &s3.GetObjectInput{
-		Bucket: aws.String(s.bucketName),
-		Key:    aws.String(path.Join(s.serviceName, "certs", "registration.json")),
-	})
+	ctx, cancel := s.opContext()
+	defer cancel()
+	data, err := s.getAccountObject(ctx, path.Join(s.accountPrefix(), "registration.json"))
 	if err != nil {
 		return nil, fmt.Errorf("error reading registration file from S3: %s", err)
 	}
 
 	var reg registration.Resource
-	err = json.Unmarshal(dataWriter.Bytes(), &reg)
+	err = json.Unmarshal(data, &reg)
 	if err != nil {
 		return nil, fmt.Errorf("error unmarshalling registration: %s", err)
 	}
@@ -314,56 +529,161 @@ func (s *S3ACMEStorage) LoadRegistration() (*registration.Resource, error) {
 	return &reg, nil
 }
 
-// UpdateTLS checks the TLS certificates for the given domains and renews them if they are expired or about to expire.
-func (s *S3ACMEStorage) UpdateTLS(domainGroup []string) error {
+// CheckAccess verifies that the bucket exists and its objects can be listed with the current
+// credentials.
+func (s *S3ACMEStorage) CheckAccess() error {
+	ctx, cancel := s.opContext()
+	defer cancel()
+	if _, err := s.s3Client.HeadBucket(ctx, &s3.HeadBucketInput{
+		Bucket: aws.String(s.bucketName),
+	}); err != nil {
+		return fmt.Errorf("bucket %s is not reachable: %w", s.bucketName, err)
+	}
+	if _, err := s.s3Client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+		Bucket:  aws.String(s.bucketName),
+		Prefix:  aws.String(s.serviceName),
+		MaxKeys: aws.Int32(1),
+	}); err != nil {
+		return fmt.Errorf("cannot list objects in bucket %s: %w", s.bucketName, err)
+	}
+	return nil
+}
 
-	slog.Debug("Starting certificate check for ", "domains", domainGroup)
+// CheckWrite puts a test object at serviceName/.healthcheck, reads it back and deletes it, then
+// checks that the local cert directory certificates are installed in is writable. Errors name
+// the failing S3 operation and carry the service's error, e.g. AccessDenied.
+func (s *S3ACMEStorage) CheckWrite() error {
+	ctx, cancel := s.opContext()
+	defer cancel()
+	key := path.Join(s.serviceName, ".healthcheck")
+	data := []byte("loadmaster storage check " + time.Now().UTC().Format(time.RFC3339) + "\n")
+	if _, err := s.s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:   aws.String(s.bucketName),
+		Key:      aws.String(key),
+		Body:     bytes.NewReader(data),
+		Metadata: checksumMetadata(data),
+	}); err != nil {
+		return fmt.Errorf("PutObject s3://%s/%s: %w", s.bucketName, key, err)
+	}
+	got, err := s.getObject(ctx, key)
+	if err != nil {
+		return fmt.Errorf("GetObject s3://%s/%s: %w", s.bucketName, key, err)
+	}
+	if !bytes.Equal(got, data) {
+		return fmt.Errorf("GetObject s3://%s/%s returned different content than was written", s.bucketName, key)
+	}
+	if _, err := s.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucketName),
+		Key:    aws.String(key),
+	}); err != nil {
+		return fmt.Errorf("DeleteObject s3://%s/%s: %w", s.bucketName, key, err)
+	}
+	return checkDirWritable(s.localCertDir)
+}
 
-	domainRoot := domainGroup[0]
+// historyKey is the object holding the renewal history.
+func (s *S3ACMEStorage) historyKey() string {
+	return path.Join(s.serviceName, "state", "renewal-history.json")
+}
 
-	certData, privateKeyData, err := s.DownloadCert(domainRoot)
+func (s *S3ACMEStorage) LoadRenewalHistory() (RenewalHistory, error) {
+	ctx, cancel := s.opContext()
+	defer cancel()
+	data, err := s.getObject(ctx, s.historyKey())
+	if isNotFound(err) {
+		return RenewalHistory{}, nil
+	}
 	if err != nil {
-		slog.Error("error while downloading certificates from S3", "error", err)
+		return nil, fmt.Errorf("error reading renewal history from S3: %w", err)
+	}
+	history := RenewalHistory{}
+	if err := json.Unmarshal(data, &history); err != nil {
+		return nil, fmt.Errorf("error unmarshalling renewal history: %w", err)
 	}
+	return history, nil
+}
 
-	slog.Debug("Checking certificate expiry", "domains", domainGroup)
-	timeToRenewCert, err := CertExpiresSoon(certData, MaxRemainingDaysBeforeCertExpiry)
+func (s *S3ACMEStorage) SaveRenewalHistory(history RenewalHistory) error {
+	ctx, cancel := s.opContext()
+	defer cancel()
+	data, err := json.Marshal(history)
 	if err != nil {
-		slog.Error("error checking certificate expiry. Getting new ACME cert...", "error", err)
-		timeToRenewCert = true
-	}
-	if timeToRenewCert {
-		fmt.Println("Renewing certificate via ACME protocol...")
-		certData, privateKeyData, err = renewACMECertificate(renewACMECertificateParams{
-			email:          s.contactEmail,
-			domains:        domainGroup,
-			caAuthorityURL: s.caAuthority,
-			s:              s,
-		})
-		if err != nil {
-			// TODO: Do something about this
-			return fmt.Errorf("error renewing ACME certificate: %v", err)
-		}
-		fmt.Println("Certificate renewed successfully via ACME protocol.")
-		err = s.SaveCert(domainRoot, certData, privateKeyData)
-		if err != nil {
-			// TODO: Send SMS alerts if something like this is going on
-			return fmt.Errorf("error uploading cert to s3: %v", err)
-		}
+		return err
 	}
-	if certData == nil || privateKeyData == nil || len(certData) == 0 || len(privateKeyData) == 0 {
-		slog.Error("certData or privateKeyData is nil or empty after renewal process!!!")
-		slog.Warn("Creating a self-signed cert to use in lieu of expected ACME cert stored in S3...", "certData", certData, "privateKeyData", privateKeyData)
-		certData, privateKeyData, err = generateSelfSignedCert(domainRoot)
-		if err != nil {
-			return fmt.Errorf("error generating self-signed certificate (as a result of errors renewing certificate via ACME protocol): %v", err)
-		}
+	_, err = s.s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.bucketName),
+		Key:    aws.String(s.historyKey()),
+		Body:   bytes.NewReader(data),
+	})
+	if err != nil {
+		return fmt.Errorf("error writing renewal history to S3: %w", err)
+	}
+	s.cacheWritten(s.historyKey(), data)
+	return nil
+}
+
+// acmeDNSAccountsKey is the object holding the acme-dns accounts.
+func (s *S3ACMEStorage) acmeDNSAccountsKey() string {
+	return path.Join(s.serviceName, "state", "acme-dns-accounts.json")
+}
+
+func (s *S3ACMEStorage) LoadACMEDNSAccounts() (map[string]ACMEDNSAccount, error) {
+	ctx, cancel := s.opContext()
+	defer cancel()
+	data, err := s.getObject(ctx, s.acmeDNSAccountsKey())
+	if isNotFound(err) {
+		return map[string]ACMEDNSAccount{}, nil
 	}
-	removeExisting(domainRoot)
-	err = writeCertToFilesToDisk(domainRoot, certData, privateKeyData)
 	if err != nil {
-		return fmt.Errorf("error writing certificate to disk: %v", err)
+		return nil, fmt.Errorf("error reading acme-dns accounts from S3: %w", err)
+	}
+	accounts := map[string]ACMEDNSAccount{}
+	if err := json.Unmarshal(data, &accounts); err != nil {
+		return nil, fmt.Errorf("error unmarshalling acme-dns accounts: %w", err)
 	}
+	return accounts, nil
+}
 
+func (s *S3ACMEStorage) SaveACMEDNSAccounts(accounts map[string]ACMEDNSAccount) error {
+	ctx, cancel := s.opContext()
+	defer cancel()
+	data, err := json.Marshal(accounts)
+	if err != nil {
+		return err
+	}
+	_, err = s.s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucketName),
+		Key:         aws.String(s.acmeDNSAccountsKey()),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		return fmt.Errorf("error writing acme-dns accounts to S3: %w", err)
+	}
+	s.cacheWritten(s.acmeDNSAccountsKey(), data)
 	return nil
 }
+
+// UpdateTLS checks the TLS certificates for the given domains and renews them if they are expired or about to expire.
+func (s *S3ACMEStorage) UpdateTLS(domainGroup []string) error {
+
+	slog.Debug("Starting certificate check for ", "domains", domainGroup)
+
+	domainRoot := DomainRoot(domainGroup)
+
+	unlock := lockDomain(domainRoot)
+	defer unlock()
+	release, err := s.lockForUpdate(domainRoot)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return updateTLS(updateTLSParams{
+		storage:     s,
+		certDir:     s.localCertDir,
+		email:       s.contactEmail,
+		caAuthority: s.caAuthority,
+		domainGroup: domainGroup,
+	})
+}
@@ -0,0 +1,136 @@
+package acme
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// s3CacheEntry is a cached S3 object, or the not-found error S3 answered for it.
+type s3CacheEntry struct {
+	data []byte
+	err  error
+}
+
+// s3Cache holds the S3 objects read or written during the running sweeps, so that the
+// registration, account and renewal history each domain group reads are only fetched once per
+// sweep. It is only active between BeginSweep and the matching EndSweep.
+var s3Cache struct {
+	mu      sync.Mutex
+	sweeps  int
+	objects map[string]s3CacheEntry
+	hits    int
+	misses  int
+}
+
+// BeginSweep starts caching S3 reads until the matching EndSweep. Sweeps may overlap; the cache
+// is dropped when the last one ends.
+func BeginSweep() {
+	s3Cache.mu.Lock()
+	defer s3Cache.mu.Unlock()
+	if s3Cache.sweeps == 0 {
+		s3Cache.objects = make(map[string]s3CacheEntry)
+		s3Cache.hits, s3Cache.misses = 0, 0
+	}
+	s3Cache.sweeps++
+}
+
+// EndSweep ends a sweep started with BeginSweep. When no other sweep is running, it logs how
+// many S3 GETs the cache saved and drops the cached objects.
+func EndSweep() {
+	s3Cache.mu.Lock()
+	defer s3Cache.mu.Unlock()
+	if s3Cache.sweeps == 0 {
+		return
+	}
+	s3Cache.sweeps--
+	if s3Cache.sweeps > 0 {
+		return
+	}
+	if reads := s3Cache.hits + s3Cache.misses; reads > 0 {
+		slog.Info("S3 sweep cache", "reads", reads, "gets", s3Cache.misses, "saved", s3Cache.hits)
+	}
+	s3Cache.objects = nil
+}
+
+// cacheLookup returns the cached entry for key, counting the read as a hit or a miss.
+func cacheLookup(key string) (s3CacheEntry, bool) {
+	s3Cache.mu.Lock()
+	defer s3Cache.mu.Unlock()
+	if s3Cache.objects == nil {
+		return s3CacheEntry{}, false
+	}
+	entry, ok := s3Cache.objects[key]
+	if ok {
+		s3Cache.hits++
+	} else {
+		s3Cache.misses++
+	}
+	return entry, ok
+}
+
+// cacheStore records the current contents of key while a sweep is running.
+func cacheStore(key string, entry s3CacheEntry) {
+	s3Cache.mu.Lock()
+	defer s3Cache.mu.Unlock()
+	if s3Cache.objects != nil {
+		s3Cache.objects[key] = entry
+	}
+}
+
+// cacheDeletePrefix drops the cached objects whose key starts with prefix, after they were
+// deleted.
+func cacheDeletePrefix(prefix string) {
+	s3Cache.mu.Lock()
+	defer s3Cache.mu.Unlock()
+	for key := range s3Cache.objects {
+		if strings.HasPrefix(key, prefix) {
+			delete(s3Cache.objects, key)
+		}
+	}
+}
+
+// cacheKey is the sweep cache key of an object in this storage's bucket.
+func (s *S3ACMEStorage) cacheKey(key string) string {
+	return s.bucketName + "/" + key
+}
+
+// getObject downloads key from the bucket, answering from the sweep cache when it holds the
+// object. Missing objects are cached too; other errors are not. An object stored with a
+// checksum is verified against it, so a truncated or corrupt read is an error rather than data.
+func (s *S3ACMEStorage) getObject(ctx context.Context, key string) ([]byte, error) {
+	if entry, ok := cacheLookup(s.cacheKey(key)); ok {
+		return slices.Clone(entry.data), entry.err
+	}
+	out, err := s.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if isNotFound(err) {
+			cacheStore(s.cacheKey(key), s3CacheEntry{err: err})
+		}
+		return nil, err
+	}
+	defer out.Body.Close()
+	data, err := io.ReadAll(out.Body)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyChecksum(key, data, out.Metadata); err != nil {
+		return nil, err
+	}
+	cacheStore(s.cacheKey(key), s3CacheEntry{data: slices.Clone(data)})
+	return data, nil
+}
+
+// cacheWritten updates the sweep cache after data was written to key.
+func (s *S3ACMEStorage) cacheWritten(key string, data []byte) {
+	cacheStore(s.cacheKey(key), s3CacheEntry{data: slices.Clone(data)})
+}
@@ -0,0 +1,38 @@
+package acme
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"log/slog"
+)
+
+// SCTCheck enables a post-issuance check that the leaf carries embedded signed certificate
+// timestamps, which browsers require of publicly trusted certificates.
+var SCTCheck = false
+
+var (
+	// sctListOID is the embedded SCT list extension (RFC 6962, section 3.3).
+	sctListOID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}
+	// ctPoisonOID marks a precertificate, which must never be served.
+	ctPoisonOID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 3}
+)
+
+// checkSCTs logs a warning when cert has no embedded SCTs or is a precertificate. Either can
+// mean a misconfigured private CA, or a certificate modern browsers will reject.
+func checkSCTs(cert *x509.Certificate) {
+	hasSCTs := false
+	for _, ext := range cert.Extensions {
+		switch {
+		case ext.Id.Equal(ctPoisonOID):
+			slog.Warn("Issued certificate carries the CT poison extension; it is a precertificate and will be rejected by clients", "subject", cert.Subject.CommonName, "serial", cert.SerialNumber)
+			return
+		case ext.Id.Equal(sctListOID) && len(ext.Value) > 0:
+			hasSCTs = true
+		}
+	}
+	if !hasSCTs {
+		slog.Warn("Issued certificate has no embedded SCTs; browsers enforcing certificate transparency will reject it", "subject", cert.Subject.CommonName, "serial", cert.SerialNumber, "issuer", cert.Issuer.CommonName)
+		return
+	}
+	slog.Debug("Issued certificate has embedded SCTs", "subject", cert.Subject.CommonName)
+}
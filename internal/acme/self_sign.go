@@ -1,33 +1,68 @@
 package acme
 
 import (
+	"bytes"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/x509"
-	"crypto/x509/pkix"
 	"encoding/pem"
 	"log/slog"
 	"math/big"
 	"time"
 )
 
-func generateSelfSignedCert(domain string) (certPEM, keyPEM []byte, err error) {
-	slog.Debug("Generating self-signed certificate", "domain", domain)
+// DisableSelfSignedFallback stops UpdateTLS from installing a self-signed certificate when no
+// ACME certificate could be obtained. The renewal error is returned instead and whatever
+// certificate is already on disk is left in place.
+var DisableSelfSignedFallback = false
+
+// IsSelfSigned reports whether the leaf of certData is self-signed, as the fallback
+// certificates are.
+func IsSelfSigned(certData []byte) bool {
+	cert, err := ParseCertificate(certData)
+	if err != nil {
+		return false
+	}
+	// CheckSignatureFrom would reject the fallback certificates, which aren't CAs, so the
+	// signature is checked against the certificate's own key directly.
+	return bytes.Equal(cert.RawIssuer, cert.RawSubject) &&
+		cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature) == nil
+}
+
+// SelfSignedCertValidity is how long a fallback self-signed certificate is valid. It is kept
+// short so the certificate is obviously temporary and gets replaced by the next sweep.
+var SelfSignedCertValidity = 7 * 24 * time.Hour
+
+// generateSelfSignedCert creates a stand-in certificate covering every name in domainGroup, with
+// the group's DomainRoot as its common name.
+func generateSelfSignedCert(domainGroup []string) (certPEM, keyPEM []byte, err error) {
+	slog.Debug("Generating self-signed certificate", "domains", domainGroup)
 	// Generate a new private key
 	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
 		return nil, nil, err
 	}
 
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
 	// Create a self-signed certificate
+	dnsNames, ipAddresses := splitSANs(domainGroup)
+	subject, _ := subjectFor(domainGroup)
+	// The CN names the directory the certificate is installed under, so the fallback is easy to
+	// match to its group; the SANs cover every name in it.
+	subject.CommonName = DomainRoot(domainGroup)
+	now := time.Now()
 	template := x509.Certificate{
-		SerialNumber: big.NewInt(1),
-		Subject: pkix.Name{
-			CommonName: domain,
-		},
-		NotBefore:             time.Now(),
-		NotAfter:              time.Now().Add(24 * time.Hour),
+		SerialNumber:          serialNumber,
+		Subject:               subject,
+		DNSNames:              dnsNames,
+		IPAddresses:           ipAddresses,
+		NotBefore:             now,
+		NotAfter:              now.Add(SelfSignedCertValidity),
 		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 		BasicConstraintsValid: true,
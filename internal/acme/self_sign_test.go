@@ -0,0 +1,32 @@
+package acme
+
+import (
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestGenerateSelfSignedCertCoversGroup(t *testing.T) {
+	group := []string{"www.example.com", "example.com", "*.example.org", "192.0.2.1", "2001:db8::1"}
+	certPEM, _ := testCert(t, time.Hour, group...)
+	cert, err := ParseCertificate(certPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range group {
+		if ip := net.ParseIP(name); ip != nil {
+			if !slices.ContainsFunc(cert.IPAddresses, ip.Equal) {
+				t.Errorf("IPAddresses %v do not include %s", cert.IPAddresses, name)
+			}
+		} else if !slices.Contains(cert.DNSNames, name) {
+			t.Errorf("DNSNames %v do not include %s", cert.DNSNames, name)
+		}
+	}
+	if got, want := len(cert.DNSNames)+len(cert.IPAddresses), len(group); got != want {
+		t.Errorf("certificate has %d SANs, want %d", got, want)
+	}
+	if got, want := cert.Subject.CommonName, DomainRoot(group); got != want {
+		t.Errorf("CommonName = %q, want the DomainRoot %q", got, want)
+	}
+}
@@ -0,0 +1,91 @@
+package acme
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// SlackNotifier posts each event to a Slack incoming webhook as a color-coded attachment.
+type SlackNotifier struct {
+	WebhookURL string
+	Client     *http.Client
+}
+
+// NewSlackNotifier returns a SlackNotifier for the incoming webhook url with a 30 second
+// timeout.
+func NewSlackNotifier(url string) *SlackNotifier {
+	return &SlackNotifier{
+		WebhookURL: url,
+		Client:     &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+type slackField struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+	Short bool   `json:"short"`
+}
+
+type slackAttachment struct {
+	Fallback string       `json:"fallback"`
+	Color    string       `json:"color"`
+	Title    string       `json:"title"`
+	Fields   []slackField `json:"fields"`
+	TS       int64        `json:"ts"`
+}
+
+type slackMessage struct {
+	Attachments []slackAttachment `json:"attachments"`
+}
+
+// slackAttachmentFor formats event: green for renewals, red for failures and critical expiry.
+func slackAttachmentFor(event Event) slackAttachment {
+	title, color := "", "danger"
+	switch event.Type {
+	case EventRenewed:
+		title, color = "Certificate renewed: "+event.Domain, "good"
+	case EventRenewalFailed:
+		title = "Certificate renewal failed: " + event.Domain
+	case EventExpiring:
+		title = "Certificate about to expire: " + event.Domain
+	default:
+		title = event.Type + ": " + event.Domain
+	}
+	fields := []slackField{{Title: "Domains", Value: strings.Join(event.Domains, ", ")}}
+	if !event.NotAfter.IsZero() {
+		fields = append(fields,
+			slackField{Title: "Days remaining", Value: fmt.Sprint(event.DaysRemaining), Short: true},
+			slackField{Title: "Expires", Value: event.NotAfter.UTC().Format(time.RFC3339), Short: true},
+		)
+	}
+	if event.Error != "" {
+		fields = append(fields, slackField{Title: "Error", Value: event.Error})
+	}
+	return slackAttachment{
+		Fallback: title,
+		Color:    color,
+		Title:    title,
+		Fields:   fields,
+		TS:       event.Time.Unix(),
+	}
+}
+
+func (n *SlackNotifier) Notify(event Event) error {
+	body, err := json.Marshal(slackMessage{Attachments: []slackAttachment{slackAttachmentFor(event)}})
+	if err != nil {
+		return fmt.Errorf("error encoding Slack message: %w", err)
+	}
+	resp, err := n.Client.Post(n.WebhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error posting to Slack: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Slack webhook returned %s", resp.Status)
+	}
+	return nil
+}
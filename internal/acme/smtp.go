@@ -0,0 +1,110 @@
+package acme
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SweepNotifier is implemented by notifiers that batch events and deliver them once a sweep
+// has finished.
+type SweepNotifier interface {
+	Notifier
+	Flush() error
+}
+
+// FlushNotifiers delivers the events batched by every SweepNotifier in Notifiers. It is called
+// at the end of each sweep and after each on-demand renewal.
+func FlushNotifiers() error {
+	var errs []error
+	for _, notifier := range Notifiers {
+		if sweepNotifier, ok := notifier.(SweepNotifier); ok {
+			errs = append(errs, sweepNotifier.Flush())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// SMTPNotifier emails renewal failures and critical expiry alerts. Events are collected during
+// a sweep and sent as a single digest by Flush.
+type SMTPNotifier struct {
+	Host     string
+	Port     int
+	From     string
+	To       []string
+	Username string
+	Password string
+
+	mu      sync.Mutex
+	pending []Event
+}
+
+// Notify queues failure and critical expiry events for the next digest. Renewals are not
+// emailed.
+func (n *SMTPNotifier) Notify(event Event) error {
+	if event.Type != EventRenewalFailed && event.Type != EventExpiring {
+		return nil
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.pending = append(n.pending, event)
+	return nil
+}
+
+// Flush sends the queued events as one digest email, if there are any.
+func (n *SMTPNotifier) Flush() error {
+	n.mu.Lock()
+	events := n.pending
+	n.pending = nil
+	n.mu.Unlock()
+	if len(events) == 0 {
+		return nil
+	}
+
+	var auth smtp.Auth
+	if n.Username != "" {
+		auth = smtp.PlainAuth("", n.Username, n.Password, n.Host)
+	}
+	addr := net.JoinHostPort(n.Host, fmt.Sprint(n.Port))
+	if err := smtp.SendMail(addr, auth, n.From, n.To, n.digest(events)); err != nil {
+		return fmt.Errorf("error sending notification email via %s: %w", addr, err)
+	}
+	return nil
+}
+
+// digest formats events as a plain-text email, one entry per domain group.
+func (n *SMTPNotifier) digest(events []Event) []byte {
+	slices.SortStableFunc(events, func(a, b Event) int { return strings.Compare(a.Domain, b.Domain) })
+	domains := make(map[string]bool)
+	for _, event := range events {
+		domains[event.Domain] = true
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", n.From)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(n.To, ", "))
+	fmt.Fprintf(&b, "Subject: loadmaster: %d certificate problem(s)\r\n", len(domains))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString("The last certificate sweep reported the following problems:\r\n")
+	for _, event := range events {
+		kind := "Renewal failed"
+		if event.Type == EventExpiring {
+			kind = "CRITICAL: about to expire"
+		}
+		fmt.Fprintf(&b, "\r\n%s: %s\r\n", kind, event.Domain)
+		fmt.Fprintf(&b, "  Domains:   %s\r\n", strings.Join(event.Domains, ", "))
+		if !event.NotAfter.IsZero() {
+			fmt.Fprintf(&b, "  Not after: %s (%d days)\r\n", event.NotAfter.UTC().Format(time.RFC1123), event.DaysRemaining)
+		}
+		if event.Error != "" {
+			fmt.Fprintf(&b, "  Error:     %s\r\n", event.Error)
+		}
+	}
+	return []byte(b.String())
+}
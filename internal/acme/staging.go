@@ -0,0 +1,73 @@
+package acme
+
+import (
+	"fmt"
+	"log/slog"
+)
+
+// VerifyWithStaging makes every renewal first obtain a certificate from the CA's staging
+// directory and check it before asking production, so a broken setup fails against staging's
+// generous rate limits instead of spending production's.
+var VerifyWithStaging = false
+
+// stagingDirectories maps production directories to their staging counterparts.
+var stagingDirectories = map[string]string{
+	CAAuthorityLetsEncryptProduction: CAAuthorityLetsEncryptStaging,
+	CAAuthorityBuypassProduction:     CAAuthorityBuypassStaging,
+	CAAuthorityGoogleProduction:      CAAuthorityGoogleStaging,
+}
+
+// isStagingDirectory reports whether caAuthority is one of the known staging directories.
+func isStagingDirectory(caAuthority string) bool {
+	for _, staging := range stagingDirectories {
+		if staging == caAuthority {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateVerifyWithStaging reports an error if caAuthority has no known staging directory to
+// verify against.
+func ValidateVerifyWithStaging(caAuthority string) error {
+	if _, ok := stagingDirectories[caAuthority]; ok || isStagingDirectory(caAuthority) {
+		return nil
+	}
+	return fmt.Errorf("no staging directory is known for CA %s", caAuthority)
+}
+
+// verifyWithStaging obtains a certificate for domains from the staging directory matching
+// caAuthority and checks that its chain is well formed and covers every name. It does nothing
+// when caAuthority is itself a staging directory.
+func verifyWithStaging(email string, domains []string, storage ACMEStorage, caAuthority string) error {
+	staging, ok := stagingDirectories[caAuthority]
+	if !ok {
+		if isStagingDirectory(caAuthority) {
+			return nil
+		}
+		return fmt.Errorf("no staging directory is known for CA %s", caAuthority)
+	}
+	slog.Info("Verifying certificate request against staging before production", "domains", domains, "staging", staging)
+	certificateData, err := generateTLS(email, domains, storage, staging)
+	if err != nil {
+		return err
+	}
+	certs, err := parseCertificateBundle(certificateData.Certificate)
+	if err != nil {
+		return err
+	}
+	bundle := certificateData.Certificate
+	if len(certs) == 1 {
+		bundle = append(append([]byte{}, bundle...), certificateData.IssuerCertificate...)
+	}
+	if err := validateChain(bundle); err != nil {
+		return err
+	}
+	for _, domain := range domains {
+		if err := certs[0].VerifyHostname(domain); err != nil {
+			return fmt.Errorf("staging certificate does not cover %s: %w", domain, err)
+		}
+	}
+	slog.Info("Staging certificate verified", "domains", domains)
+	return nil
+}
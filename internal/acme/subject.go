@@ -0,0 +1,93 @@
+package acme
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/go-acme/lego/v4/certificate"
+	"github.com/go-acme/lego/v4/lego"
+)
+
+var (
+	subjectsMu sync.RWMutex
+	// subjects maps a domain name to the subject fields requested for the certificate of the
+	// group containing it.
+	subjects map[string]pkix.Name
+)
+
+// SetSubjects replaces the custom certificate subjects, keyed by a name of the domain group
+// each applies to. The common name is always the group's first domain and is ignored here.
+func SetSubjects(m map[string]pkix.Name) {
+	subjectsMu.Lock()
+	defer subjectsMu.Unlock()
+	subjects = m
+}
+
+// subjectFor returns the subject to request for domainGroup and whether custom fields are set
+// for it.
+func subjectFor(domainGroup []string) (pkix.Name, bool) {
+	subjectsMu.RLock()
+	defer subjectsMu.RUnlock()
+	for _, domain := range domainGroup {
+		if subject, ok := subjects[domain]; ok {
+			subject.CommonName = domainGroup[0]
+			return subject, true
+		}
+	}
+	return pkix.Name{CommonName: domainGroup[0]}, false
+}
+
+// subjectStripped lists public CAs that issue domain-validated certificates only and drop every
+// subject field of the CSR except the common name.
+var subjectStripped = map[string]bool{
+	CAAuthorityLetsEncryptProduction: true,
+	CAAuthorityLetsEncryptStaging:    true,
+	CAAuthorityBuypassProduction:     true,
+	CAAuthorityBuypassStaging:        true,
+	CAAuthorityGoogleProduction:      true,
+	CAAuthorityGoogleStaging:         true,
+	CAAuthorityZeroSSL:               true,
+}
+
+// mustStapleFeature is the TLS Feature extension value requesting status_request (RFC 7633).
+var mustStapleFeature = []byte{0x30, 0x03, 0x02, 0x01, 0x05}
+
+// obtainWithSubject orders a certificate for domains through a CSR carrying subject, instead of
+// the CSR lego builds from the names alone.
+func obtainWithSubject(client *lego.Client, domains []string, subject pkix.Name, caAuthority string) (*certificate.Resource, error) {
+	if subjectStripped[caAuthority] {
+		slog.Warn("CA issues domain-validated certificates only and will drop the custom subject fields", "domains", domains, "caAuthority", caAuthority)
+	}
+	privateKey, err := certcrypto.GeneratePrivateKey(certcrypto.RSA2048)
+	if err != nil {
+		return nil, fmt.Errorf("error generating private key: %w", err)
+	}
+	dnsNames, ipAddresses := splitSANs(domains)
+	template := x509.CertificateRequest{
+		Subject:     subject,
+		DNSNames:    dnsNames,
+		IPAddresses: ipAddresses,
+	}
+	if MustStaple {
+		template.ExtraExtensions = append(template.ExtraExtensions, pkix.Extension{Id: tlsFeatureOID, Value: mustStapleFeature})
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &template, privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("error creating CSR: %w", err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing CSR: %w", err)
+	}
+	return client.Certificate.ObtainForCSR(certificate.ObtainForCSRRequest{
+		CSR:            csr,
+		PrivateKey:     privateKey,
+		Bundle:         CertBundle == CertBundleFull,
+		PreferredChain: PreferredChain,
+	})
+}
@@ -0,0 +1,162 @@
+package acme
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TLSCertificateCacheTTL is how long GetCertificateFunc reuses a loaded certificate before
+// reloading it, so renewals are picked up without a handshake hitting storage every time.
+var TLSCertificateCacheTTL = 5 * time.Minute
+
+// GetTLSCertificate loads the certificate and key for domainRoot from storage and builds a
+// tls.Certificate. If the download fails, the files at storage.CertLocation are read instead;
+// if storage is nil, the default local cert directory is used.
+func GetTLSCertificate(storage ACMEStorage, domainRoot string) (*tls.Certificate, error) {
+	var certData, keyData []byte
+	var err error
+	if storage != nil {
+		certData, keyData, err = storage.DownloadCert(domainRoot)
+		if err != nil {
+			slog.Debug("error loading certificate from storage; falling back to disk", "domain", domainRoot, "error", err)
+		}
+	}
+	if len(certData) == 0 || len(keyData) == 0 {
+		certFilename, keyFilename := GetLocalCertFilenames(defaultCertDir(), domainRoot)
+		if storage != nil {
+			certFilename, keyFilename = storage.CertLocation(domainRoot)
+		}
+		if certData, err = os.ReadFile(certFilename); err != nil {
+			return nil, fmt.Errorf("error reading certificate for %s: %w", domainRoot, err)
+		}
+		if keyData, err = os.ReadFile(keyFilename); err != nil {
+			return nil, fmt.Errorf("error reading private key for %s: %w", domainRoot, err)
+		}
+	}
+
+	cert, err := tls.X509KeyPair(certData, keyData)
+	if err != nil {
+		return nil, fmt.Errorf("error building TLS certificate for %s: %w", domainRoot, err)
+	}
+	// Staple the cached OCSP response, which Must-Staple certificates depend on.
+	certFilename, _ := GetLocalCertFilenames(defaultCertDir(), domainRoot)
+	if storage != nil {
+		certFilename, _ = storage.CertLocation(domainRoot)
+	}
+	if ocspResp, err := os.ReadFile(filepath.Join(filepath.Dir(certFilename), ocspFilename)); err == nil {
+		cert.OCSPStaple = ocspResp
+	}
+	return &cert, nil
+}
+
+// DomainRoots maps the names of a set of domain groups to the domain root their certificate is
+// stored under.
+type DomainRoots map[string]string
+
+// NewDomainRoots indexes the names of domainGroups.
+func NewDomainRoots(domainGroups [][]string) DomainRoots {
+	roots := make(DomainRoots)
+	for _, group := range domainGroups {
+		if len(group) == 0 {
+			continue
+		}
+		for _, domain := range group {
+			roots[strings.ToLower(domain)] = DomainRoot(group)
+		}
+	}
+	return roots
+}
+
+// Lookup returns the domain root of the group whose certificate covers name, such as a TLS
+// client's SNI name. Wildcard entries such as "*.example.com" match a single label.
+func (r DomainRoots) Lookup(name string) (string, bool) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if domainRoot, ok := r[name]; ok {
+		return domainRoot, true
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		domainRoot, ok := r["*"+name[i:]]
+		return domainRoot, ok
+	}
+	return "", false
+}
+
+type cachedTLSCertificate struct {
+	cert     *tls.Certificate
+	loadedAt time.Time
+	// loading is the load of the certificate in flight, if any.
+	loading *tlsCertificateLoad
+}
+
+// tlsCertificateLoad is a load of a domain root's certificate, shared by the handshakes that
+// need it while it runs.
+type tlsCertificateLoad struct {
+	done chan struct{}
+	cert *tls.Certificate
+	err  error
+}
+
+// GetCertificateFunc returns a callback suitable for tls.Config.GetCertificate that selects the
+// certificate of the domain group containing the client's SNI name. Wildcard entries such as
+// "*.example.com" match a single label. TLS-ALPN-01 validation handshakes are answered with the
+// pending challenge certificate.
+//
+// Certificates are loaded outside the cache lock, once per domain root at a time, so a slow
+// storage only holds up the handshakes waiting for that root's first load; while a cached copy
+// is being reloaded, the cached copy is served.
+func GetCertificateFunc(storage ACMEStorage, domainGroups [][]string) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	roots := NewDomainRoots(domainGroups)
+
+	var mu sync.Mutex
+	cache := make(map[string]cachedTLSCertificate)
+
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if cert, ok, err := sharedALPNProvider.challengeCertificate(hello); ok {
+			return cert, err
+		}
+		domainRoot, ok := roots.Lookup(hello.ServerName)
+		if !ok {
+			return nil, fmt.Errorf("no certificate configured for %q", hello.ServerName)
+		}
+
+		mu.Lock()
+		entry := cache[domainRoot]
+		if entry.cert != nil && (entry.loading != nil || time.Since(entry.loadedAt) < TLSCertificateCacheTTL) {
+			mu.Unlock()
+			return entry.cert, nil
+		}
+		if load := entry.loading; load != nil {
+			mu.Unlock()
+			<-load.done
+			return load.cert, load.err
+		}
+		load := &tlsCertificateLoad{done: make(chan struct{})}
+		entry.loading = load
+		cache[domainRoot] = entry
+		mu.Unlock()
+
+		cert, err := GetTLSCertificate(storage, domainRoot)
+
+		mu.Lock()
+		entry = cache[domainRoot]
+		entry.loading = nil
+		if err == nil {
+			entry.cert, entry.loadedAt = cert, time.Now()
+		}
+		cache[domainRoot] = entry
+		mu.Unlock()
+		if err != nil && entry.cert != nil {
+			slog.Warn("error reloading certificate; serving cached copy", "domain", domainRoot, "error", err)
+			cert, err = entry.cert, nil
+		}
+		load.cert, load.err = cert, err
+		close(load.done)
+		return cert, err
+	}
+}
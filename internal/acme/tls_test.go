@@ -0,0 +1,82 @@
+package acme
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+)
+
+// blockingStorage is a MemoryACMEStorage whose downloads of one domain root wait until
+// released, like a slow S3 request.
+type blockingStorage struct {
+	*MemoryACMEStorage
+	blockedRoot string
+	started     chan struct{}
+	release     chan struct{}
+}
+
+func (s *blockingStorage) DownloadCert(domainRoot string) ([]byte, []byte, error) {
+	if domainRoot == s.blockedRoot {
+		s.started <- struct{}{}
+		<-s.release
+	}
+	return s.MemoryACMEStorage.DownloadCert(domainRoot)
+}
+
+func TestGetCertificateFuncSlowStorage(t *testing.T) {
+	savedTTL := TLSCertificateCacheTTL
+	defer func() { TLSCertificateCacheTTL = savedTTL }()
+	TLSCertificateCacheTTL = time.Hour
+
+	storage := &blockingStorage{
+		MemoryACMEStorage: NewMemoryACMEStorage("admin@example.com", unreachableCA, t.TempDir()),
+		started:           make(chan struct{}),
+		release:           make(chan struct{}),
+	}
+	for _, domain := range []string{"slow.example.com", "fast.example.com"} {
+		certPEM, keyPEM := testCert(t, 90*24*time.Hour, domain)
+		if err := storage.SaveCert(domain, certPEM, keyPEM); err != nil {
+			t.Fatal(err)
+		}
+	}
+	getCertificate := GetCertificateFunc(storage, [][]string{{"slow.example.com"}, {"fast.example.com"}})
+	handshake := func(name string) <-chan error {
+		result := make(chan error, 1)
+		go func() {
+			cert, err := getCertificate(&tls.ClientHelloInfo{ServerName: name})
+			if err == nil && cert == nil {
+				t.Errorf("no certificate for %s", name)
+			}
+			result <- err
+		}()
+		return result
+	}
+	wait := func(name string, result <-chan error) {
+		t.Helper()
+		select {
+		case err := <-result:
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: handshake blocked", name)
+		}
+	}
+
+	// First load of slow.example.com: it doesn't hold up the other domain root.
+	storage.blockedRoot = "slow.example.com"
+	slow := handshake("slow.example.com")
+	<-storage.started
+	wait("fast.example.com", handshake("fast.example.com"))
+	close(storage.release)
+	wait("slow.example.com", slow)
+
+	// Reload of slow.example.com: the cached copy is served meanwhile.
+	TLSCertificateCacheTTL = 0
+	storage.release = make(chan struct{})
+	slow = handshake("slow.example.com")
+	<-storage.started
+	wait("slow.example.com while reloading", handshake("slow.example.com"))
+	close(storage.release)
+	wait("slow.example.com", slow)
+}
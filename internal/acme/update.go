@@ -0,0 +1,180 @@
+package acme
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+)
+
+// ForceRenewal makes UpdateTLS renew every certificate regardless of its expiry, for the
+// renew-all -force command.
+var ForceRenewal = false
+
+var (
+	forcedMu sync.Mutex
+	// forced counts the RenewNow calls forcing the renewal of each domain root.
+	forced = make(map[string]int)
+)
+
+// RenewNow runs storage.UpdateTLS for domainGroup. With force, the certificate is renewed even
+// if it isn't due or was renewed recently, as with ForceRenewal, without affecting other groups.
+func RenewNow(storage ACMEStorage, domainGroup []string, force bool) error {
+	if force {
+		domainRoot := DomainRoot(domainGroup)
+		forcedMu.Lock()
+		forced[domainRoot]++
+		forcedMu.Unlock()
+		defer func() {
+			forcedMu.Lock()
+			defer forcedMu.Unlock()
+			if forced[domainRoot]--; forced[domainRoot] == 0 {
+				delete(forced, domainRoot)
+			}
+		}()
+	}
+	return storage.UpdateTLS(domainGroup)
+}
+
+// forceRenewal reports whether the certificate of domainRoot is to be renewed regardless of its
+// expiry.
+func forceRenewal(domainRoot string) bool {
+	forcedMu.Lock()
+	defer forcedMu.Unlock()
+	return ForceRenewal || forced[domainRoot] > 0
+}
+
+type updateTLSParams struct {
+	storage     ACMEStorage
+	certDir     string
+	email       string
+	caAuthority string
+	domainGroup []string
+}
+
+// updateTLS is the UpdateTLS flow shared by the storages: the certificate is taken from
+// storage, renewed via ACME if it expires soon, saved back to storage and installed in certDir. Callers hold the domain lock. In Distribute mode and on
+// leader election followers, the certificate is only installed from storage; see syncTLS.
+func updateTLS(p updateTLSParams) error {
+	if Distribute || !IsLeader() {
+		return syncTLS(p.storage, p.certDir, p.domainGroup)
+	}
+	domainRoot := DomainRoot(p.domainGroup)
+
+	var chain []byte
+	renewed := false
+	timeToRenewCert := false
+	certData, privateKeyData, err := p.storage.DownloadCert(domainRoot)
+	if errors.Is(err, ErrCertNotFound) {
+		certData, privateKeyData, err = adoptLegacyCert(p.storage, p.domainGroup)
+	}
+	if errors.Is(err, ErrCertNotFound) {
+		slog.Info("no certificate in storage yet; requesting initial issuance", "domain", domainRoot)
+		timeToRenewCert = true
+	} else {
+		if err != nil {
+			slog.Error("error while downloading certificates from storage", "domain", domainRoot, "error", err)
+		}
+		slog.Debug("Checking certificate expiry", "domains", p.domainGroup)
+		timeToRenewCert, err = CertExpiresSoon(certData, domainRoot, MaxRemainingDaysBeforeCertExpiry)
+		if err != nil {
+			slog.Error("error checking certificate expiry. Getting new ACME cert...", "error", err)
+			timeToRenewCert = true
+		} else if err := verifyKeyMatchesCert(certData, privateKeyData); err != nil {
+			slog.Error("stored certificate and key do not match. Getting new ACME cert...", "domain", domainRoot, "error", err)
+			timeToRenewCert = true
+		}
+	}
+	force := forceRenewal(domainRoot)
+	if force && !timeToRenewCert {
+		slog.Info("Forcing renewal", "domain", domainRoot)
+		timeToRenewCert = true
+	} else if timeToRenewCert && len(certData) > 0 && !force {
+		if lastSuccess, ok := recentlyRenewed(p.storage, domainRoot); ok {
+			slog.Info("Skipping renewal; domain group was renewed recently", "domain", domainRoot, "lastSuccess", lastSuccess, "minTimeBetweenRenewals", MinTimeBetweenRenewals)
+			timeToRenewCert = false
+		}
+	}
+	if timeToRenewCert && !force {
+		if nextAttempt, ok := backingOff(p.storage, domainRoot); ok {
+			slog.Info("Skipping renewal; backing off after repeated failures", "domain", domainRoot, "nextAttempt", nextAttempt)
+			timeToRenewCert = false
+		}
+	}
+	if timeToRenewCert {
+		slog.Info("Renewing certificate via ACME protocol", "domain", domainRoot, "domains", p.domainGroup)
+		currentCert := certData
+		certData, privateKeyData, chain, err = renewACMECertificate(renewACMECertificateParams{
+			email:          p.email,
+			domains:        p.domainGroup,
+			caAuthorityURL: p.caAuthority,
+			s:              p.storage,
+		})
+		recordRenewalAttempt(p.storage, domainRoot, err)
+		if err != nil {
+			notifyRenewalFailed(p.domainGroup, currentCert, err)
+			return fmt.Errorf("error renewing ACME certificate: %v", err)
+		}
+		slog.Info("Certificate renewed successfully via ACME protocol", "domain", domainRoot)
+		err = p.storage.SaveCert(domainRoot, certData, privateKeyData)
+		if err != nil {
+			// TODO: Send SMS alerts if something like this is going on
+			return fmt.Errorf("error saving cert to storage: %v", err)
+		}
+		renewed = true
+		if len(chain) > 0 {
+			if err := p.storage.SaveChain(domainRoot, chain); err != nil {
+				return fmt.Errorf("error saving chain to storage: %v", err)
+			}
+		}
+	}
+	if len(certData) == 0 || len(privateKeyData) == 0 {
+		if DisableSelfSignedFallback {
+			return fmt.Errorf("no certificate available for %s and the self-signed fallback is disabled", domainRoot)
+		}
+		slog.Error("certData or privateKeyData is nil or empty after renewal process!!!")
+		slog.Warn("Creating a self-signed cert to use in lieu of expected ACME cert in storage...", "domain", domainRoot)
+		certData, privateKeyData, err = generateSelfSignedCert(p.domainGroup)
+		if err != nil {
+			return fmt.Errorf("error generating self-signed certificate (as a result of errors renewing certificate via ACME protocol): %v", err)
+		}
+	}
+	if _, err := installCert(p.certDir, domainRoot, certData, privateKeyData); err != nil {
+		return fmt.Errorf("error writing certificate to disk: %v", err)
+	}
+	if len(chain) > 0 {
+		if err := writeChainToDisk(p.certDir, domainRoot, chain); err != nil {
+			return err
+		}
+	}
+	updateOCSP(p.storage, p.certDir, domainRoot, certData)
+	// Local storage has already written a renewed certificate to certDir when saving it, so
+	// the hook runs on renewal rather than on installCert reporting a change.
+	if renewed {
+		runPostRenewHook(p.certDir, domainRoot)
+		notify(newEvent(EventRenewed, p.domainGroup, certData, nil))
+	}
+
+	return nil
+}
+
+// adoptLegacyCert looks for the group's certificate under the other names in the group, where
+// it was stored before certificates were keyed by DomainRoot, and saves it under DomainRoot.
+func adoptLegacyCert(storage ACMEStorage, domainGroup []string) ([]byte, []byte, error) {
+	domainRoot := DomainRoot(domainGroup)
+	for _, domain := range domainGroup {
+		if domain == domainRoot {
+			continue
+		}
+		certData, privateKeyData, err := storage.DownloadCert(domain)
+		if err != nil {
+			continue
+		}
+		slog.Info("Adopting certificate stored under a previous domain root", "from", domain, "domainRoot", domainRoot)
+		if err := storage.SaveCert(domainRoot, certData, privateKeyData); err != nil {
+			return nil, nil, fmt.Errorf("error saving adopted certificate for %s: %w", domainRoot, err)
+		}
+		return certData, privateKeyData, nil
+	}
+	return nil, nil, fmt.Errorf("%w for %s", ErrCertNotFound, domainRoot)
+}
@@ -0,0 +1,121 @@
+package acme
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+)
+
+// unreachableCA is an ACME directory nothing listens on, so renewals fail without a network.
+const unreachableCA = "https://127.0.0.1:1/directory"
+
+func TestUpdateTLS(t *testing.T) {
+	const day = 24 * time.Hour
+	group := []string{"example.com", "www.example.com"}
+	tests := []struct {
+		name string
+		// stored is the validity of the certificate in storage; zero stores none.
+		stored          time.Duration
+		history         *RenewalRecord
+		force           bool
+		disableFallback bool
+		wantErr         bool
+		// wantAttempt is whether a renewal was attempted, which fails against unreachableCA.
+		wantAttempt bool
+		// wantInstalled is "stored", "self-signed" or "" for nothing.
+		wantInstalled string
+	}{
+		{name: "valid certificate is kept", stored: 90 * day, wantInstalled: "stored"},
+		{name: "expiring certificate is renewed", stored: 10 * day, wantErr: true, wantAttempt: true},
+		{name: "expired certificate is renewed", stored: -day, wantErr: true, wantAttempt: true},
+		{name: "missing certificate is issued", wantErr: true, wantAttempt: true},
+		{name: "forced renewal of a valid certificate", stored: 90 * day, force: true, wantErr: true, wantAttempt: true},
+		{
+			name:          "expiring certificate renewed recently is kept",
+			stored:        10 * day,
+			history:       &RenewalRecord{LastSuccess: time.Now().Add(-time.Hour)},
+			wantInstalled: "stored",
+		},
+		{
+			name:          "backing off without a certificate falls back to self-signed",
+			history:       &RenewalRecord{ConsecutiveFailures: 1, NextAttempt: time.Now().Add(time.Hour)},
+			wantInstalled: "self-signed",
+		},
+		{
+			name:            "self-signed fallback disabled",
+			history:         &RenewalRecord{ConsecutiveFailures: 1, NextAttempt: time.Now().Add(time.Hour)},
+			disableFallback: true,
+			wantErr:         true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			savedDisable, savedForce := DisableSelfSignedFallback, ForceRenewal
+			defer func() { DisableSelfSignedFallback, ForceRenewal = savedDisable, savedForce }()
+			DisableSelfSignedFallback = tt.disableFallback
+			ForceRenewal = tt.force
+
+			certDir := t.TempDir()
+			storage := NewMemoryACMEStorage("admin@example.com", unreachableCA, certDir)
+			domainRoot := DomainRoot(group)
+			var storedCert []byte
+			if tt.stored != 0 {
+				var storedKey []byte
+				storedCert, storedKey = testCert(t, tt.stored, group...)
+				if err := storage.SaveCert(domainRoot, storedCert, storedKey); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.history != nil {
+				if err := storage.SaveRenewalHistory(RenewalHistory{domainRoot: *tt.history}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := storage.UpdateTLS(group)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("UpdateTLS error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			history, err := storage.LoadRenewalHistory()
+			if err != nil {
+				t.Fatal(err)
+			}
+			record := history[domainRoot]
+			attempted := record.AttemptCount > 0
+			if attempted != tt.wantAttempt {
+				t.Errorf("renewal attempted = %v, want %v", attempted, tt.wantAttempt)
+			}
+			if tt.wantAttempt && record.ConsecutiveFailures != 1 {
+				t.Errorf("ConsecutiveFailures = %d, want 1", record.ConsecutiveFailures)
+			}
+
+			certFile, _ := GetLocalCertFilenames(certDir, domainRoot)
+			installed, err := os.ReadFile(certFile)
+			switch tt.wantInstalled {
+			case "":
+				if err == nil {
+					t.Errorf("a certificate was installed")
+				}
+			case "stored":
+				if !bytes.Equal(installed, storedCert) {
+					t.Errorf("installed certificate is not the stored one")
+				}
+			case "self-signed":
+				if !IsSelfSigned(installed) {
+					t.Fatalf("installed certificate is not self-signed")
+				}
+				cert, err := ParseCertificate(installed)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, name := range group {
+					if err := cert.VerifyHostname(name); err != nil {
+						t.Errorf("self-signed certificate does not cover %s: %v", name, err)
+					}
+				}
+			}
+		})
+	}
+}
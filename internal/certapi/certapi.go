@@ -0,0 +1,202 @@
+// Package certapi serves the managed certificates and their private keys to authenticated
+// clients, such as service mesh sidecars, which fetch a certificate by name and can keep the
+// connection open to receive each renewal.
+package certapi
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/joshuaschlichting/loadmaster/internal/acme"
+	"github.com/joshuaschlichting/loadmaster/internal/config"
+)
+
+// CertResponse is one certificate served by GET /v1/certs/{name}: the certificate chain and
+// private key of the domain group covering name, PEM-encoded.
+type CertResponse struct {
+	Name        string    `json:"name"`
+	DomainRoot  string    `json:"domainRoot"`
+	NotAfter    time.Time `json:"notAfter"`
+	Certificate string    `json:"certificate"`
+	PrivateKey  string    `json:"privateKey"`
+	OCSPStaple  []byte    `json:"ocspStaple,omitempty"`
+}
+
+// Server serves the certificate API over TLS, presenting the managed certificate matching the
+// client's SNI name.
+type Server struct {
+	listenAddr     string
+	storage        acme.ACMEStorage
+	token          string
+	clientCAs      *x509.CertPool
+	roots          atomic.Pointer[acme.DomainRoots]
+	getCertificate atomic.Pointer[func(*tls.ClientHelloInfo) (*tls.Certificate, error)]
+	mux            *http.ServeMux
+}
+
+// New builds a Server from cfg serving the certificates of domainGroups.
+func New(cfg config.CertAPIConfig, storage acme.ACMEStorage, domainGroups [][]string) (*Server, error) {
+	s := &Server{
+		listenAddr: cfg.ListenAddr,
+		storage:    storage,
+		token:      cfg.Token,
+		mux:        http.NewServeMux(),
+	}
+	if cfg.ClientCAFile != "" {
+		pemData, err := os.ReadFile(cfg.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading certAPI.clientCAFile: %w", err)
+		}
+		s.clientCAs = x509.NewCertPool()
+		if !s.clientCAs.AppendCertsFromPEM(pemData) {
+			return nil, fmt.Errorf("no certificates found in certAPI.clientCAFile %s", cfg.ClientCAFile)
+		}
+	}
+	s.SetDomains(domainGroups)
+	s.mux.HandleFunc("GET /v1/certs/{name}", s.handleCert)
+	return s, nil
+}
+
+// SetDomains replaces the set of domain groups certificates are served for.
+func (s *Server) SetDomains(domainGroups [][]string) {
+	roots := acme.NewDomainRoots(domainGroups)
+	s.roots.Store(&roots)
+	fn := acme.GetCertificateFunc(s.storage, domainGroups)
+	s.getCertificate.Store(&fn)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// ListenAndServeTLS starts the API listener and blocks until it fails.
+func (s *Server) ListenAndServeTLS() error {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return (*s.getCertificate.Load())(hello)
+		},
+	}
+	if s.clientCAs != nil {
+		tlsConfig.ClientCAs = s.clientCAs
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	server := &http.Server{
+		Addr:      s.listenAddr,
+		Handler:   s,
+		TLSConfig: tlsConfig,
+	}
+	slog.Info("Starting certificate API", "addr", s.listenAddr, "clientCerts", s.clientCAs != nil)
+	return server.ListenAndServeTLS("", "")
+}
+
+// handleCert answers GET /v1/certs/{name}. With ?watch=true, the response is a stream of
+// newline-delimited CertResponse objects: the current certificate, then one per renewal.
+func (s *Server) handleCert(w http.ResponseWriter, r *http.Request) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	name, err := config.NormalizeDomain(r.PathValue("name"))
+	if err != nil || name == "" {
+		http.Error(w, "invalid name", http.StatusBadRequest)
+		return
+	}
+	domainRoot, ok := s.roots.Load().Lookup(name)
+	if !ok {
+		http.Error(w, "no certificate configured for "+name, http.StatusNotFound)
+		return
+	}
+	// Subscribe before loading, so a renewal landing in between is not missed.
+	changes, stop := acme.WatchCertChanges()
+	defer stop()
+	resp, err := s.load(name, domainRoot)
+	if err != nil {
+		slog.Error("error loading certificate for API", "domain", domainRoot, "error", err)
+		http.Error(w, "error loading certificate", http.StatusInternalServerError)
+		return
+	}
+	if r.URL.Query().Get("watch") != "true" {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			slog.Warn("error writing certificate response", "error", err)
+		}
+		return
+	}
+
+	slog.Info("Certificate API client watching", "name", name, "remoteAddr", r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	for {
+		if err := enc.Encode(resp); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	wait:
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case changed := <-changes:
+				if changed != domainRoot {
+					continue
+				}
+				next, err := s.load(name, domainRoot)
+				if err != nil {
+					slog.Warn("error reloading certificate for API watcher", "domain", domainRoot, "error", err)
+					continue
+				}
+				if next.Certificate == resp.Certificate && next.PrivateKey == resp.PrivateKey {
+					continue
+				}
+				resp = next
+				break wait
+			}
+		}
+	}
+}
+
+// load reads domainRoot's certificate with acme.GetTLSCertificate and encodes it for name.
+func (s *Server) load(name, domainRoot string) (*CertResponse, error) {
+	cert, err := acme.GetTLSCertificate(s.storage, domainRoot)
+	if err != nil {
+		return nil, err
+	}
+	var chain strings.Builder
+	for _, der := range cert.Certificate {
+		if err := pem.Encode(&chain, &pem.Block{Type: "CERTIFICATE", Bytes: der}); err != nil {
+			return nil, err
+		}
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding private key for %s: %w", domainRoot, err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("error parsing certificate for %s: %w", domainRoot, err)
+	}
+	return &CertResponse{
+		Name:        name,
+		DomainRoot:  domainRoot,
+		NotAfter:    leaf.NotAfter,
+		Certificate: chain.String(),
+		PrivateKey:  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})),
+		OCSPStaple:  cert.OCSPStaple,
+	}, nil
+}
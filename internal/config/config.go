@@ -1,136 +1,744 @@
 package config
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 )
 
-var DefaultConfigDir string = filepath.Join(os.Getenv("HOME"), ".loadmaster")
+// ConfigDirEnv is the environment variable that sets Dir.
+const ConfigDirEnv = "LOADMASTER_CONFIG_DIR"
+
+// Dir is the base directory for the default config and domains files, the default cert
+// directory and the local ACME accounts. It defaults to $LOADMASTER_CONFIG_DIR, then
+// ~/.loadmaster; the -config-dir flag overrides it.
+var Dir = defaultDir()
+
+// defaultDir returns $LOADMASTER_CONFIG_DIR when set, otherwise ~/.loadmaster, or .loadmaster in
+// the working directory when no home directory can be determined (e.g. $HOME is unset in a
+// container).
+func defaultDir() string {
+	if dir := os.Getenv(ConfigDirEnv); dir != "" {
+		return dir
+	}
+	home, err := os.UserHomeDir()
+	if err != nil || home == "" {
+		log.Println("Could not determine home directory; using .loadmaster in the working directory")
+		return ".loadmaster"
+	}
+	return filepath.Join(home, ".loadmaster")
+}
 
 type S3Config struct {
 	BucketName string `json:"bucketName"`
 	Endpoint   string `json:"endpoint"`
 	Region     string `json:"region"`
+	// DistributedLock enables a lock object in the bucket so that only one
+	// loadmaster instance renews a given domain at a time.
+	DistributedLock bool `json:"distributedLock"`
+	// MaxAttempts is how many times a failed S3 request is attempted (default 3).
+	MaxAttempts int `json:"maxAttempts,omitempty"`
+	// Timeout bounds each S3 operation including retries, as a Go duration (default "30s").
+	Timeout string `json:"timeout,omitempty"`
+	// AWSProfile selects a named profile from the shared AWS config and credentials files.
+	AWSProfile string `json:"awsProfile,omitempty"`
+	// AWSAccessKeyID and AWSSecretAccessKey are static credentials used instead of the default
+	// credential chain.
+	AWSAccessKeyID     string `json:"awsAccessKeyId,omitempty"`
+	AWSSecretAccessKey string `json:"awsSecretAccessKey,omitempty"`
+	// AWSRoleARN is a role to assume for this bucket, e.g. one in another account.
+	// AWSExternalID is passed when assuming it if the role's trust policy requires one.
+	AWSRoleARN    string `json:"awsRoleArn,omitempty"`
+	AWSExternalID string `json:"awsExternalId,omitempty"`
+	// MaxArchiveVersions is how many archived copies of each certificate are kept; zero keeps
+	// all.
+	MaxArchiveVersions int `json:"maxArchiveVersions,omitempty"`
+	// GzipAccountData stores the ACME user and registration JSON gzipped.
+	GzipAccountData bool `json:"gzipAccountData,omitempty"`
+}
+
+// StorageConfig describes one storage backend. Type is "s3" or "local".
+type StorageConfig struct {
+	Type string   `json:"type"`
+	S3   S3Config `json:"s3,omitempty"`
+}
+
+// ProxyConfig enables the TLS-terminating reverse proxy when Routes is non-empty.
+type ProxyConfig struct {
+	ListenAddr string `json:"listenAddr,omitempty"`
+	// Routes maps a hostname to the upstream URL requests for it are forwarded to.
+	Routes map[string]string `json:"routes,omitempty"`
+	// RedirectListenAddr, when set, starts a plain HTTP listener that redirects to https
+	// and forwards ACME HTTP-01 challenges to the challenge server.
+	RedirectListenAddr string `json:"redirectListenAddr,omitempty"`
+}
+
+// CertAPIConfig enables the certificate API, which serves certificates and keys to sidecars
+// over TLS, when ListenAddr is set.
+type CertAPIConfig struct {
+	ListenAddr string `json:"listenAddr,omitempty"`
+	// Token is the bearer token clients must present.
+	Token string `json:"token,omitempty"`
+	// ClientCAFile, when set, requires clients to present a certificate issued by one of the
+	// CAs in this PEM file.
+	ClientCAFile string `json:"clientCAFile,omitempty"`
+}
+
+// LeaderElectionConfig lets several replicas share one set of certificates with only the
+// elected leader renewing them.
+type LeaderElectionConfig struct {
+	Enabled bool `json:"enabled,omitempty"`
+	// LockFile, when set, keeps the lease in this file on a shared filesystem instead of in the
+	// S3 bucket.
+	LockFile string `json:"lockFile,omitempty"`
+	// Lease is a Go duration: how long the leader's lease lasts without being renewed.
+	// Default: 1m.
+	Lease string `json:"lease,omitempty"`
+}
+
+// ChallengeConfig selects the built-in ACME challenge solver.
+type ChallengeConfig struct {
+	// Type is "http-01", "dns-01" or "tls-alpn-01". When empty, HTTP-01 is used, plus
+	// TLS-ALPN-01 when the reverse proxy is enabled.
+	Type string `json:"type,omitempty"`
+	// DNSProvider names the lego DNS provider used for dns-01, configured through lego's
+	// environment variables for it, or "acmedns" for the acme-dns server in ACMEDNS.
+	DNSProvider string `json:"dnsProvider,omitempty"`
+	// ACMEDNS configures the "acmedns" DNS provider.
+	ACMEDNS ACMEDNSConfig `json:"acmeDNS,omitzero"`
+	// PreflightCheck fetches a test token from the HTTP-01 challenge server through each
+	// domain's public name before the first sweep, warning about names it can't be reached on.
+	PreflightCheck bool `json:"preflightCheck,omitempty"`
+	// BindAddress is the IP address the HTTP-01 challenge server listens on. Empty binds every
+	// interface.
+	BindAddress string `json:"bindAddress,omitempty"`
+	// PropagationTimeout and PollingInterval are Go durations overriding how long and how often
+	// lego checks that the dns-01 TXT record has propagated. Empty keeps the DNS provider's own.
+	PropagationTimeout string `json:"propagationTimeout,omitempty"`
+	PollingInterval    string `json:"pollingInterval,omitempty"`
+	// DNSTimeout is a Go duration bounding each DNS query of the propagation check. Default: 10s.
+	DNSTimeout string `json:"dnsTimeout,omitempty"`
+	// SkipAuthoritativeCheck skips checking that every authoritative nameserver serves the
+	// TXT record before the CA is asked to validate it.
+	SkipAuthoritativeCheck bool `json:"skipAuthoritativeCheck,omitempty"`
+}
+
+// ACMEDNSConfig points dns-01 challenges at an acme-dns server, for domains whose
+// _acme-challenge name is delegated to it by CNAME.
+type ACMEDNSConfig struct {
+	// APIBase is the URL of the acme-dns API, e.g. "https://auth.example.org".
+	APIBase string `json:"apiBase,omitempty"`
+	// AllowFrom restricts the accounts loadmaster registers to updates from these CIDRs.
+	AllowFrom []string `json:"allowFrom,omitempty"`
+	// Accounts are existing acme-dns accounts by domain. Domains without one get an account
+	// registered and kept in storage.
+	Accounts map[string]ACMEDNSAccountConfig `json:"accounts,omitempty"`
+}
+
+// ACMEDNSAccountConfig holds the credentials of an acme-dns account, as returned by its
+// /register endpoint.
+type ACMEDNSAccountConfig struct {
+	Username   string `json:"username"`
+	Password   string `json:"password"`
+	Subdomain  string `json:"subdomain"`
+	FullDomain string `json:"fullDomain"`
+}
+
+// SMTPConfig enables emailed digests of renewal failures and critical expiry alerts when Host
+// is set.
+type SMTPConfig struct {
+	Host string `json:"host,omitempty"`
+	// Port defaults to 587.
+	Port     int      `json:"port,omitempty"`
+	From     string   `json:"from,omitempty"`
+	To       []string `json:"to,omitempty"`
+	Username string   `json:"username,omitempty"`
+	Password string   `json:"password,omitempty"`
+}
+
+// Command is an argv list. In JSON it may be given as an array, or as a single string which is
+// run through "sh -c".
+type Command []string
+
+func (c *Command) UnmarshalJSON(data []byte) error {
+	var shell string
+	if err := json.Unmarshal(data, &shell); err == nil {
+		if shell == "" {
+			*c = nil
+		} else {
+			*c = Command{"sh", "-c", shell}
+		}
+		return nil
+	}
+	var argv []string
+	if err := json.Unmarshal(data, &argv); err != nil {
+		return fmt.Errorf("command must be a string or an array of strings")
+	}
+	*c = argv
+	return nil
 }
 
 type AppConfig struct {
-	Email        string   `json:"email"`
-	S3           S3Config `json:"s3"`
-	LocalCertDir string   `json:"-"`
-	CAAuthority  string   `json:"caAuthority"`
+	Email        string      `json:"email"`
+	S3           S3Config    `json:"s3"`
+	LocalCertDir string      `json:"-"`
+	CAAuthority  string      `json:"caAuthority"`
+	Proxy        ProxyConfig `json:"proxy"`
+	// CertAPI serves certificates and keys to service mesh sidecars.
+	CertAPI CertAPIConfig `json:"certAPI,omitzero"`
+	// LeaderElection makes replicas elect one instance that renews certificates.
+	LeaderElection LeaderElectionConfig `json:"leaderElection,omitzero"`
+	// ConfigVersion is the schema version of the file; see CurrentConfigVersion. Older configs
+	// are migrated when loaded.
+	ConfigVersion int `json:"configVersion,omitempty"`
+	// StatusListenAddr enables the /status endpoint on this address (e.g. "127.0.0.1:9090").
+	StatusListenAddr string `json:"statusListenAddr,omitempty"`
+	// RenewAPIToken enables POST /renew on the status server for callers presenting it as a
+	// bearer token.
+	RenewAPIToken string `json:"renewAPIToken,omitempty"`
+	// PushgatewayURL is a Prometheus Pushgateway the metrics are pushed to at the end of a
+	// -once run.
+	PushgatewayURL string `json:"pushgatewayURL,omitempty"`
+	// Storage lists backends certificates are replicated to. When empty, S3 is used if
+	// S3.BucketName is set and local storage otherwise.
+	Storage []StorageConfig `json:"storage,omitempty"`
+	// HTTPProxy routes outbound ACME and S3 traffic through this proxy URL, overriding the
+	// HTTPS_PROXY/HTTP_PROXY environment variables. NoProxy lists exceptions in NO_PROXY syntax.
+	HTTPProxy string `json:"httpProxy,omitempty"`
+	NoProxy   string `json:"noProxy,omitempty"`
+	// CARootCertFile is a PEM file of extra roots trusted when connecting to the ACME server,
+	// for private CAs such as step-ca or pebble.
+	CARootCertFile string `json:"caRootCertFile,omitempty"`
+	// UserAgent identifies this instance to the ACME server. Defaults to "loadmaster/<version>".
+	UserAgent string `json:"userAgent,omitempty"`
+	// ACMEClientCertFile and ACMEClientKeyFile are a PEM certificate and key presented to the
+	// ACME server, for internal CAs that require mutual TLS.
+	ACMEClientCertFile string `json:"acmeClientCertFile,omitempty"`
+	ACMEClientKeyFile  string `json:"acmeClientKeyFile,omitempty"`
+	// PreferredChain is the issuer common name of the root to prefer among alternate chains
+	// (e.g. "ISRG Root X1").
+	PreferredChain string `json:"preferredChain,omitempty"`
+	// MustStaple requests certificates with the OCSP Must-Staple extension.
+	MustStaple bool `json:"mustStaple,omitempty"`
+	// Concurrency is how many domain groups are checked and renewed in parallel. Defaults to 4.
+	Concurrency int `json:"concurrency,omitempty"`
+	// Mode is "issue" (default), obtaining and renewing certificates, or "distribute", only
+	// installing the certificates an issuing instance keeps in S3.
+	Mode string `json:"mode,omitempty"`
+	// RenewalMode is "fixed" (default), renewing within a fixed number of days of expiry, or
+	// "lifetime-fraction", renewing two thirds into the certificate's validity plus a jitter.
+	RenewalMode string `json:"renewalMode,omitempty"`
+	// RenewalJitter is the half-width of the window scheduled sweeps are spread over, as a Go
+	// duration ("30m" by default, "0s" to disable).
+	RenewalJitter string `json:"renewalJitter,omitempty"`
+	// MinTimeBetweenRenewals is how long after a successful renewal a domain group is not
+	// renewed again, as a Go duration ("24h" by default, "0s" to disable).
+	MinTimeBetweenRenewals string `json:"minTimeBetweenRenewals,omitempty"`
+	// MaxRenewalBackoff is a Go duration capping the exponential backoff of a domain group
+	// whose renewals keep failing. "0s" disables the backoff. Default: 24h.
+	MaxRenewalBackoff string `json:"maxRenewalBackoff,omitempty"`
+	// ObtainTimeout is a Go duration bounding each certificate order, challenges included.
+	// "0s" disables it. Default: 2m, or a minute more than challenge.propagationTimeout.
+	ObtainTimeout string `json:"obtainTimeout,omitempty"`
+	// PruneRemovedDomains deletes, after domains.json is reloaded, the stored certificates of
+	// names that are no longer in any domain group.
+	PruneRemovedDomains bool `json:"pruneRemovedDomains,omitempty"`
+	// CertPerDomain issues one certificate per name instead of one multi-SAN certificate per
+	// domain group; see config.CertPerDomain.
+	CertPerDomain bool `json:"certPerDomain,omitempty"`
+	// SCTCheck warns when an issued certificate has no embedded certificate transparency SCTs.
+	SCTCheck bool `json:"sctCheck,omitempty"`
+	// CAACheck enables a DNS CAA pre-flight before requesting a certificate.
+	CAACheck bool `json:"caaCheck,omitempty"`
+	// CAAIdentity overrides the CAA issuer domain expected for the CA (e.g. "letsencrypt.org").
+	CAAIdentity string `json:"caaIdentity,omitempty"`
+	// PostRenewHook is run after a renewed certificate is written to disk.
+	PostRenewHook Command `json:"postRenewHook,omitempty"`
+	// DisableSelfSignedFallback keeps the existing certificate and reports the error when
+	// renewal fails, instead of installing a self-signed certificate.
+	DisableSelfSignedFallback bool `json:"disableSelfSignedFallback,omitempty"`
+	// WebhookURL receives a JSON POST for every renewal, renewal failure and critical expiry.
+	WebhookURL string `json:"webhookURL,omitempty"`
+	// SlackWebhookURL is a Slack incoming webhook that receives the same events as readable,
+	// color-coded messages.
+	SlackWebhookURL string `json:"slackWebhookURL,omitempty"`
+	// Challenge selects how domain ownership is proven to the CA.
+	Challenge ChallengeConfig `json:"challenge,omitzero"`
+	// SMTP emails a digest of each sweep's renewal failures and critical expiry alerts.
+	SMTP SMTPConfig `json:"smtp,omitzero"`
+	// CriticalExpiryDays is the remaining validity below which a failed renewal raises a
+	// critical expiry alert. Defaults to 7.
+	CriticalExpiryDays int `json:"criticalExpiryDays,omitempty"`
+	// CertFileMode and KeyFileMode are the octal permissions of the installed certificate files
+	// and private key. They default to "0644" and "0600".
+	CertFileMode string `json:"certFileMode,omitempty"`
+	KeyFileMode  string `json:"keyFileMode,omitempty"`
+	// CertOwner and CertGroup, a name or numeric id, are applied to the installed certificate
+	// files and private key when loadmaster runs as root.
+	CertOwner string `json:"certOwner,omitempty"`
+	CertGroup string `json:"certGroup,omitempty"`
+	// CertBundle is "bundle" (default), "leaf+chain" or "leaf".
+	CertBundle string `json:"certBundle,omitempty"`
+	// LogFormat is "text" (default) or "json".
+	LogFormat string `json:"logFormat,omitempty"`
+	// LogLevel is one of "debug", "info" (default), "warn" or "error".
+	LogLevel string `json:"logLevel,omitempty"`
 }
 
 type DomainsConfig struct {
 	Domains [][]string `json:"domains"`
+	// Subjects sets subject fields for the certificate of the group containing each key.
+	Subjects map[string]CertSubject `json:"subjects,omitempty"`
 }
 
-func LoadAppConfig(configFilename, domainsFilename string) (*AppConfig, error) {
+// CertSubject holds the subject fields requested for a domain group's certificate in addition
+// to its common name.
+type CertSubject struct {
+	Organization       string `json:"O,omitempty"`
+	OrganizationalUnit string `json:"OU,omitempty"`
+	Country            string `json:"C,omitempty"`
+	Province           string `json:"ST,omitempty"`
+	Locality           string `json:"L,omitempty"`
+}
 
-	if _, err := os.Stat(domainsFilename); os.IsNotExist(err) {
+// ErrConfigCreated is returned by EnsureDefaultConfig when it had to write default files, which
+// need editing before loadmaster can do anything useful.
+var ErrConfigCreated = errors.New("default configuration created")
 
-		log.Println(domainsFilename, "does not exist. Creating...")
-		// Create parent directory if it doesn't exist
-		dir := filepath.Dir(domainsFilename)
-		if err := os.MkdirAll(dir, 0755); err != nil {
-			log.Fatalf("Error creating parent directory: %v", err)
-		}
-
-		file, err := os.Create(domainsFilename)
-		if err != nil {
-			log.Fatalf("Error creating domains file: %v", err)
-		}
-		// Write default domains config
+// EnsureDefaultConfig writes a default domains file and application config for whichever of the
+// two does not exist yet. Neither is written when it is supplied through environment variables.
+// If it created anything, it returns an error wrapping ErrConfigCreated that names the files to
+// edit.
+func EnsureDefaultConfig(configFilename, domainsFilename string) error {
+	var created []string
+	if _, err := os.Stat(domainsFilename); os.IsNotExist(err) && !DomainsFromEnv() {
 		defaultDomains := DomainsConfig{
 			Domains: [][]string{
 				{"example.com", "www.example.com"},
 			},
 		}
-		defaultDomainsWithEmail := map[string]interface{}{
-			"domains": defaultDomains.Domains,
+		if err := writeDefaultFile(domainsFilename, defaultDomains); err != nil {
+			return fmt.Errorf("error creating default domains config: %w", err)
 		}
-		defaultDomainsJSON, err := json.MarshalIndent(defaultDomainsWithEmail, "", "  ")
-		if err != nil {
-			log.Fatalf("Error marshaling default domains config: %v", err)
+		created = append(created, domainsFilename)
+	}
+
+	if _, err := os.Stat(configFilename); os.IsNotExist(err) && !HasEnvOverrides() {
+		// Write default application config with local and S3 storage settings
+		defaultConfig := AppConfig{
+			ConfigVersion: CurrentConfigVersion,
+			Email:         "admin@example.com",
+
+			CAAuthority: "https://acme-staging-v02.api.letsencrypt.org/directory",
+			Storage: []StorageConfig{{
+				Type: "s3",
+				S3: S3Config{
+					BucketName: "my-certificates",
+					Endpoint:   "",
+					Region:     "us-east-1",
+				},
+			}},
 		}
-		_, err = file.Write(defaultDomainsJSON)
-		if err != nil {
-			log.Fatalf("Error writing default domains config: %v", err)
+		if err := writeDefaultFile(configFilename, defaultConfig); err != nil {
+			return fmt.Errorf("error creating default application config: %w", err)
 		}
-		log.Println("Default domains config created.")
-		defer func() { _ = file.Close() }()
-		log.Println("Please edit", domainsFilename, "and restart the application.")
-		os.Exit(1)
+		created = append(created, configFilename)
+	}
+
+	if len(created) > 0 {
+		return fmt.Errorf("%w: please edit %s and restart the application", ErrConfigCreated, strings.Join(created, " and "))
+	}
+	return nil
+}
+
+// writeDefaultFile writes v as indented JSON to filename, creating its parent directory.
+func writeDefaultFile(filename string, v any) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return fmt.Errorf("error creating parent directory: %w", err)
 	}
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, data, 0644)
+}
 
-	if _, err := os.Stat(configFilename); os.IsNotExist(err) {
+// LogLevelEnv is the environment variable overriding logLevel. Subcommands, which don't
+// configure logging from the config file, honor it too.
+const LogLevelEnv = "LOADMASTER_LOG_LEVEL"
 
-		log.Println(configFilename, "does not exist. Creating...")
-		dir := filepath.Dir(configFilename)
-		if err := os.MkdirAll(dir, 0755); err != nil {
-			log.Fatalf("Error creating parent directory: %v", err)
+// envOverrides maps the environment variables that override config fields to a function
+// applying the value.
+var envOverrides = map[string]func(c *AppConfig, value string){
+	"LOADMASTER_EMAIL":           func(c *AppConfig, v string) { c.Email = v },
+	"LOADMASTER_CA_AUTHORITY":    func(c *AppConfig, v string) { c.CAAuthority = v },
+	"LOADMASTER_S3_BUCKET":       func(c *AppConfig, v string) { c.envS3().BucketName = v },
+	"LOADMASTER_S3_REGION":       func(c *AppConfig, v string) { c.envS3().Region = v },
+	"LOADMASTER_S3_ENDPOINT":     func(c *AppConfig, v string) { c.envS3().Endpoint = v },
+	"LOADMASTER_LOCAL_CERT_DIR":  func(c *AppConfig, v string) { c.LocalCertDir = v },
+	"LOADMASTER_SMTP_PASSWORD":   func(c *AppConfig, v string) { c.SMTP.Password = v },
+	"LOADMASTER_RENEW_API_TOKEN": func(c *AppConfig, v string) { c.RenewAPIToken = v },
+	"LOADMASTER_CERT_API_TOKEN":  func(c *AppConfig, v string) { c.CertAPI.Token = v },
+	LogLevelEnv:                  func(c *AppConfig, v string) { c.LogLevel = v },
+}
+
+// envS3 returns the S3 settings the LOADMASTER_S3_* variables override: those of the only s3
+// entry in storage, or the top-level s3 otherwise. With several s3 entries, the top-level s3
+// is set and Validate rejects the config as ambiguous.
+func (c *AppConfig) envS3() *S3Config {
+	var entry *S3Config
+	for i := range c.Storage {
+		if c.Storage[i].Type != "s3" {
+			continue
+		}
+		if entry != nil {
+			return &c.S3
 		}
+		entry = &c.Storage[i].S3
+	}
+	if entry == nil {
+		return &c.S3
+	}
+	return entry
+}
 
-		file, err := os.Create(configFilename)
-		if err != nil {
-			log.Fatalf("Error creating config file: %v", err)
+// HasEnvOverrides reports whether any config override environment variable is set, in which
+// case the config file is optional. LogLevelEnv doesn't count: it is often set on its own, and
+// supplies none of the settings a config needs.
+func HasEnvOverrides() bool {
+	for name := range envOverrides {
+		if name == LogLevelEnv {
+			continue
 		}
+		if _, ok := os.LookupEnv(name); ok {
+			return true
+		}
+	}
+	return false
+}
 
-		// Write default application config with local and S3 storage settings
-		defaultConfig := AppConfig{
-			Email: "admin@example.com",
+// applyEnvOverrides sets the fields whose override environment variable is set, so the
+// environment takes precedence over the config file.
+func applyEnvOverrides(config *AppConfig) {
+	for name, apply := range envOverrides {
+		if value, ok := os.LookupEnv(name); ok {
+			apply(config, value)
+		}
+	}
+}
 
-			CAAuthority: "https://acme-staging-v02.api.letsencrypt.org/directory",
-			S3: S3Config{
-				BucketName: "my-certificates",
-				Endpoint:   "",
-				Region:     "us-east-1",
-			},
+// AllowUnknownFields makes the config and domains loaders ignore JSON fields they don't know, as
+// json.Unmarshal does, instead of rejecting them as likely typos. The -lax flag sets it.
+var AllowUnknownFields = false
+
+// decodeJSON unmarshals the JSON document in data into v, rejecting fields v has no place for
+// unless AllowUnknownFields is set.
+func decodeJSON(data []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if !AllowUnknownFields {
+		dec.DisallowUnknownFields()
+	}
+	if err := dec.Decode(v); err != nil {
+		if strings.HasPrefix(err.Error(), "json: unknown field") {
+			return fmt.Errorf("%w (check for a typo, or run with -lax to ignore unknown fields)", err)
 		}
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("invalid data after top-level JSON value")
+	}
+	return nil
+}
 
-		defaultConfigJSON, err := json.MarshalIndent(defaultConfig, "", "  ")
-		if err != nil {
-			log.Fatalf("Error marshaling default application config: %v", err)
+// LoadAppConfig parses the application config in filename and applies the LOADMASTER_*
+// environment overrides. A missing file is only an error when no override is set. It never
+// creates files; see EnsureDefaultConfig.
+func LoadAppConfig(filename string) (*AppConfig, error) {
+	var config AppConfig
+	data, err := os.ReadFile(filename)
+	switch {
+	case err == nil:
+		if err := checkConfigVersion(data); err != nil {
+			return nil, err
 		}
-		_, err = file.Write(defaultConfigJSON)
-		if err != nil {
-			log.Fatalf("Error writing default application config: %v", err)
+		if err := decodeJSON(data, &config); err != nil {
+			return nil, err
 		}
-		log.Println("Default application config created.")
-		defer func() { _ = file.Close() }()
-		log.Println("Please edit", configFilename, "and restart the application.")
-		os.Exit(1)
+	case os.IsNotExist(err) && HasEnvOverrides():
+	default:
+		return nil, err
 	}
-
-	data, err := os.ReadFile(configFilename)
-	if err != nil {
+	applyEnvOverrides(&config)
+	if err := migrate(&config); err != nil {
 		return nil, err
 	}
 
-	var config AppConfig
-	err = json.Unmarshal(data, &config)
+	if config.LocalCertDir == "" {
+		config.LocalCertDir = filepath.Join(Dir, "certs")
+	}
+	return &config, nil
+}
+
+// DomainsEnv is the environment variable that, when set, supplies the domain groups instead of
+// the domains file.
+const DomainsEnv = "LOADMASTER_DOMAINS"
+
+// DomainsFromEnv reports whether the domain groups come from DomainsEnv.
+func DomainsFromEnv() bool {
+	_, ok := os.LookupEnv(DomainsEnv)
+	return ok
+}
+
+// LoadDomains loads the domain groups from DomainsEnv when it is set and from filename
+// otherwise. The variable holds either a domains.json document or just its array of groups.
+// Internationalized names are converted to punycode (see NormalizeDomain).
+func LoadDomains(filename string) (*DomainsConfig, error) {
+	config, err := loadDomains(filename)
 	if err != nil {
 		return nil, err
 	}
+	if CertPerDomain {
+		config = config.PerDomain()
+	}
+	return config, nil
+}
 
-	if config.LocalCertDir == "" {
-		config.LocalCertDir = filepath.Join(DefaultConfigDir, "certs")
+// loadDomains is LoadDomains without the CertPerDomain split.
+func loadDomains(filename string) (*DomainsConfig, error) {
+	value, ok := os.LookupEnv(DomainsEnv)
+	if !ok {
+		return LoadDomainsConfig(filename)
+	}
+	var config DomainsConfig
+	if err := json.Unmarshal([]byte(value), &config.Domains); err != nil {
+		config = DomainsConfig{}
+		if objErr := decodeJSON([]byte(value), &config); objErr != nil {
+			return nil, fmt.Errorf("%s must be a JSON array of domain groups or a domains.json document: %w", DomainsEnv, err)
+		}
+	}
+	if err := config.normalize(); err != nil {
+		return nil, err
 	}
 	return &config, nil
 }
 
+// CertPerDomain makes LoadDomains split every domain group into one group per name, so that
+// each name gets a certificate of its own instead of the group sharing one multi-SAN
+// certificate. It is set from the certPerDomain config field.
+var CertPerDomain = false
+
+// PerDomain returns a copy of c with every domain group replaced by one group per name. Groups
+// that already hold a single name are unchanged, so splitting twice is harmless.
+func (c *DomainsConfig) PerDomain() *DomainsConfig {
+	split := *c
+	split.Domains = nil
+	for _, group := range c.Domains {
+		for _, domain := range group {
+			split.Domains = append(split.Domains, []string{domain})
+		}
+	}
+	return &split
+}
+
+// LoadDomainsConfig loads a domains file. If filename is a directory, every *.json file in it is
+// loaded and their domain groups merged: identical groups are kept once, and a domain that
+// appears in two different groups is an error.
 func LoadDomainsConfig(filename string) (*DomainsConfig, error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return loadDomainsFile(filename)
+	}
+
+	files, err := filepath.Glob(filepath.Join(filename, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	merged := &DomainsConfig{}
+	// groupFiles records the file each group came from, keyed by the group's sorted names.
+	groupFiles := make(map[string]string)
+	// domainGroups maps each domain to the key of the group it belongs to.
+	domainGroups := make(map[string]string)
+	for _, file := range files {
+		config, err := loadDomainsFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		for _, group := range config.Domains {
+			sorted := slices.Sorted(slices.Values(group))
+			key := strings.Join(sorted, ",")
+			if _, ok := groupFiles[key]; ok {
+				continue
+			}
+			for _, domain := range group {
+				if other, ok := domainGroups[domain]; ok {
+					return nil, fmt.Errorf("domain %s is in group [%s] in %s and group [%s] in %s", domain, key, file, other, groupFiles[other])
+				}
+				domainGroups[domain] = key
+			}
+			groupFiles[key] = file
+			merged.Domains = append(merged.Domains, group)
+		}
+		for domain, subject := range config.Subjects {
+			if other, ok := merged.Subjects[domain]; ok && other != subject {
+				return nil, fmt.Errorf("%s: conflicting subjects for %s", file, domain)
+			}
+			if merged.Subjects == nil {
+				merged.Subjects = make(map[string]CertSubject)
+			}
+			merged.Subjects[domain] = subject
+		}
+	}
+	return merged, nil
+}
+
+func loadDomainsFile(filename string) (*DomainsConfig, error) {
 	data, err := os.ReadFile(filename)
 	if err != nil {
 		return nil, err
 	}
 
 	var config DomainsConfig
-	err = json.Unmarshal(data, &config)
+	if len(bytes.TrimSpace(data)) == 0 {
+		return &config, nil
+	}
+	err = decodeJSON(data, &config)
 	if err != nil {
 		return nil, err
 	}
+	if err := config.normalize(); err != nil {
+		return nil, err
+	}
 
 	return &config, nil
 }
+
+// RemoveDomainGroup removes the group containing domain, and the subjects of its names, from
+// the domains file filename, or from the *.json file in it that lists domain when filename is a
+// directory. It returns the removed group with its names in NormalizeDomain form. The file is
+// rewritten as indented JSON, so its original formatting is not kept.
+func RemoveDomainGroup(filename, domain string) ([]string, error) {
+	if DomainsFromEnv() {
+		return nil, fmt.Errorf("domains come from $%s; remove %s there", DomainsEnv, domain)
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{filename}
+	if info.IsDir() {
+		if files, err = filepath.Glob(filepath.Join(filename, "*.json")); err != nil {
+			return nil, err
+		}
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var config DomainsConfig
+		if len(bytes.TrimSpace(data)) > 0 {
+			if err := decodeJSON(data, &config); err != nil {
+				return nil, fmt.Errorf("%s: %w", file, err)
+			}
+		}
+		// The file may spell names in Unicode, so compare the normalized forms.
+		normalized := func(name string) string {
+			ascii, err := NormalizeDomain(name)
+			if err != nil {
+				return name
+			}
+			return ascii
+		}
+		i := slices.IndexFunc(config.Domains, func(group []string) bool {
+			return slices.ContainsFunc(group, func(name string) bool { return normalized(name) == domain })
+		})
+		if i < 0 {
+			continue
+		}
+		var group []string
+		for _, name := range config.Domains[i] {
+			group = append(group, normalized(name))
+		}
+		config.Domains = slices.Delete(config.Domains, i, i+1)
+		for name := range config.Subjects {
+			if slices.Contains(group, normalized(name)) {
+				delete(config.Subjects, name)
+			}
+		}
+		out, err := json.MarshalIndent(config, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(file, append(out, '\n'), 0644); err != nil {
+			return nil, fmt.Errorf("error writing %s: %w", file, err)
+		}
+		return group, nil
+	}
+	return nil, fmt.Errorf("%s is not in any domain group in %s", domain, filename)
+}
+
+// redactedValue replaces secrets in Redacted.
+const redactedValue = "REDACTED"
+
+// Redacted returns a copy of c with credentials, passwords and secret-bearing URLs replaced,
+// for printing the effective configuration.
+func (c AppConfig) Redacted() AppConfig {
+	redact := func(v string) string {
+		if v == "" {
+			return ""
+		}
+		return redactedValue
+	}
+	// redactURL hides only the password in a URL's user info.
+	redactURL := func(v string) string {
+		if u, err := url.Parse(v); err == nil && u.User != nil {
+			return u.Redacted()
+		}
+		return v
+	}
+	redactS3 := func(s S3Config) S3Config {
+		s.AWSAccessKeyID = redact(s.AWSAccessKeyID)
+		s.AWSSecretAccessKey = redact(s.AWSSecretAccessKey)
+		return s
+	}
+	c.S3 = redactS3(c.S3)
+	c.Storage = slices.Clone(c.Storage)
+	for i := range c.Storage {
+		c.Storage[i].S3 = redactS3(c.Storage[i].S3)
+	}
+	c.SMTP.Password = redact(c.SMTP.Password)
+	if len(c.Challenge.ACMEDNS.Accounts) > 0 {
+		accounts := make(map[string]ACMEDNSAccountConfig, len(c.Challenge.ACMEDNS.Accounts))
+		for domain, account := range c.Challenge.ACMEDNS.Accounts {
+			account.Password = redact(account.Password)
+			accounts[domain] = account
+		}
+		c.Challenge.ACMEDNS.Accounts = accounts
+	}
+	c.RenewAPIToken = redact(c.RenewAPIToken)
+	c.CertAPI.Token = redact(c.CertAPI.Token)
+	// The path of a webhook URL is usually its secret.
+	c.WebhookURL = redact(c.WebhookURL)
+	c.SlackWebhookURL = redact(c.SlackWebhookURL)
+	c.PushgatewayURL = redactURL(c.PushgatewayURL)
+	c.HTTPProxy = redactURL(c.HTTPProxy)
+	if c.Proxy.Routes != nil {
+		routes := make(map[string]string, len(c.Proxy.Routes))
+		for host, upstream := range c.Proxy.Routes {
+			routes[host] = redactURL(upstream)
+		}
+		c.Proxy.Routes = routes
+	}
+	return c
+}
@@ -0,0 +1,22 @@
+package config
+
+import (
+	"os"
+	"testing"
+)
+
+func TestHasEnvOverrides(t *testing.T) {
+	for name := range envOverrides {
+		if _, ok := os.LookupEnv(name); ok {
+			t.Skipf("%s is set in the test environment", name)
+		}
+	}
+	t.Setenv(LogLevelEnv, "debug")
+	if HasEnvOverrides() {
+		t.Errorf("HasEnvOverrides() = true with only %s set", LogLevelEnv)
+	}
+	t.Setenv("LOADMASTER_EMAIL", "admin@example.com")
+	if !HasEnvOverrides() {
+		t.Errorf("HasEnvOverrides() = false with LOADMASTER_EMAIL set")
+	}
+}
@@ -0,0 +1,50 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+)
+
+// ParseFileMode parses an octal permission string such as "0640", returning def when s is empty.
+func ParseFileMode(s string, def os.FileMode) (os.FileMode, error) {
+	if s == "" {
+		return def, nil
+	}
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("%q is not an octal file mode such as \"0640\"", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+// LookupUID resolves a user name or numeric uid, returning -1 when name is empty.
+func LookupUID(name string) (int, error) {
+	if name == "" {
+		return -1, nil
+	}
+	if uid, err := strconv.Atoi(name); err == nil {
+		return uid, nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+// LookupGID resolves a group name or numeric gid, returning -1 when name is empty.
+func LookupGID(name string) (int, error) {
+	if name == "" {
+		return -1, nil
+	}
+	if gid, err := strconv.Atoi(name); err == nil {
+		return gid, nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(g.Gid)
+}
@@ -0,0 +1,56 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// NormalizeDomain converts domain to the ASCII (punycode) form used in ACME orders and storage
+// keys, e.g. "münchen.de" to "xn--mnchen-3ya.de", lower-casing it on the way. A leading
+// wildcard label is kept, and IP addresses are returned unchanged.
+func NormalizeDomain(domain string) (string, error) {
+	if net.ParseIP(domain) != nil {
+		return domain, nil
+	}
+	name, wildcard := strings.CutPrefix(domain, "*.")
+	ascii, err := idna.Lookup.ToASCII(name)
+	if err != nil {
+		return "", fmt.Errorf("invalid internationalized domain name %q: %w", domain, err)
+	}
+	if wildcard {
+		ascii = "*." + ascii
+	}
+	return ascii, nil
+}
+
+// normalize rewrites every domain to its NormalizeDomain form, reporting every name that fails
+// IDNA validation.
+func (c *DomainsConfig) normalize() error {
+	var errs []error
+	for i, group := range c.Domains {
+		for j, domain := range group {
+			ascii, err := NormalizeDomain(domain)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("domain group %d: %w", i, err))
+				continue
+			}
+			group[j] = ascii
+		}
+	}
+	for domain, subject := range c.Subjects {
+		ascii, err := NormalizeDomain(domain)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("subjects: %w", err))
+			continue
+		}
+		if ascii != domain {
+			delete(c.Subjects, domain)
+			c.Subjects[ascii] = subject
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,41 @@
+package config
+
+import "testing"
+
+func TestNormalizeDomain(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "example.com", want: "example.com"},
+		{in: "Example.COM", want: "example.com"},
+		{in: "münchen.de", want: "xn--mnchen-3ya.de"},
+		{in: "www.MÜNCHEN.de", want: "www.xn--mnchen-3ya.de"},
+		{in: "xn--mnchen-3ya.de", want: "xn--mnchen-3ya.de"},
+		{in: "*.münchen.de", want: "*.xn--mnchen-3ya.de"},
+		{in: "*.example.com", want: "*.example.com"},
+		{in: "192.0.2.1", want: "192.0.2.1"},
+		{in: "2001:db8::1", want: "2001:db8::1"},
+		{in: "exa mple.com", wantErr: true},
+		{in: "xn--a.com", wantErr: true},
+		{in: "-example.com", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := NormalizeDomain(tt.in)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("NormalizeDomain(%q) = %q, want an error", tt.in, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NormalizeDomain(%q): %v", tt.in, err)
+			}
+			if got != tt.want {
+				t.Errorf("NormalizeDomain(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
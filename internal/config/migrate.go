@@ -0,0 +1,72 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+// CurrentConfigVersion is the config.json schema version this build writes and understands.
+//
+// Version 1 is the layout from before configVersion existed, with a single top-level s3
+// bucket. Version 2 lists storage backends in storage.
+const CurrentConfigVersion = 2
+
+// migrations[v] upgrades a config from version v to v+1 and returns a description of each
+// change it made.
+var migrations = map[int]func(c *AppConfig) []string{
+	1: migrateV1,
+}
+
+// checkConfigVersion rejects a config file whose configVersion is newer than this build
+// supports before it is decoded, so the version error isn't masked by its unknown fields.
+func checkConfigVersion(data []byte) error {
+	var versioned struct {
+		ConfigVersion int `json:"configVersion"`
+	}
+	if err := json.Unmarshal(data, &versioned); err != nil {
+		return nil // reported when the config is decoded
+	}
+	if versioned.ConfigVersion > CurrentConfigVersion {
+		return errTooNew(versioned.ConfigVersion)
+	}
+	return nil
+}
+
+// errTooNew is the error for a config of a version newer than CurrentConfigVersion.
+func errTooNew(version int) error {
+	return fmt.Errorf("configVersion %d is newer than this loadmaster supports (%d); upgrade loadmaster", version, CurrentConfigVersion)
+}
+
+// migrate upgrades config to CurrentConfigVersion, logging what each step changed. A config
+// without configVersion is version 1; one newer than CurrentConfigVersion is an error, since
+// this build would silently ignore the fields it doesn't know.
+func migrate(config *AppConfig) error {
+	if config.ConfigVersion == 0 {
+		config.ConfigVersion = 1
+	}
+	if config.ConfigVersion > CurrentConfigVersion {
+		return errTooNew(config.ConfigVersion)
+	}
+	if config.ConfigVersion < 0 {
+		return fmt.Errorf("configVersion %d must be positive", config.ConfigVersion)
+	}
+	for config.ConfigVersion < CurrentConfigVersion {
+		from := config.ConfigVersion
+		for _, change := range migrations[from](config) {
+			log.Printf("Config migration v%d to v%d: %s", from, from+1, change)
+		}
+		config.ConfigVersion++
+	}
+	return nil
+}
+
+// migrateV1 moves the top-level s3 bucket into storage.
+func migrateV1(c *AppConfig) []string {
+	if c.S3.BucketName == "" || len(c.Storage) > 0 {
+		return nil
+	}
+	c.Storage = []StorageConfig{{Type: "s3", S3: c.S3}}
+	c.S3 = S3Config{}
+	return []string{"moved s3 into storage[0]"}
+}
@@ -0,0 +1,324 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Validate checks the config for values loadmaster cannot use and reports every problem found,
+// joined into one error.
+func (c *AppConfig) Validate() error {
+	var errs []error
+	if c.Email != "" && !strings.Contains(c.Email, "@") {
+		errs = append(errs, fmt.Errorf("email %q is not an email address", c.Email))
+	}
+	if c.CAAuthority != "" {
+		if u, err := url.Parse(c.CAAuthority); err != nil || u.Scheme != "https" || u.Host == "" {
+			errs = append(errs, fmt.Errorf("caAuthority %q must be an https URL", c.CAAuthority))
+		}
+	}
+	if (c.ACMEClientCertFile == "") != (c.ACMEClientKeyFile == "") {
+		errs = append(errs, fmt.Errorf("acmeClientCertFile and acmeClientKeyFile must be set together"))
+	}
+	errs = append(errs, c.S3.validate("s3")...)
+	if len(c.Storage) > 0 && c.S3 != (S3Config{}) {
+		errs = append(errs, fmt.Errorf("s3 is ignored when storage is set; move it into a storage entry (LOADMASTER_S3_* variables can only override a config with at most one s3 storage entry)"))
+	}
+	for i, storage := range c.Storage {
+		switch storage.Type {
+		case "local":
+		case "s3":
+			if storage.S3.BucketName == "" {
+				errs = append(errs, fmt.Errorf("storage[%d]: s3.bucketName is required", i))
+			}
+			errs = append(errs, storage.S3.validate(fmt.Sprintf("storage[%d].s3", i))...)
+		default:
+			errs = append(errs, fmt.Errorf("storage[%d]: unknown type %q", i, storage.Type))
+		}
+	}
+	for host, upstream := range c.Proxy.Routes {
+		if u, err := url.Parse(upstream); err != nil || u.Scheme == "" || u.Host == "" {
+			errs = append(errs, fmt.Errorf("proxy.routes: invalid upstream %q for host %s", upstream, host))
+		}
+	}
+	if c.WebhookURL != "" {
+		if u, err := url.Parse(c.WebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("webhookURL %q must be an http(s) URL", c.WebhookURL))
+		}
+	}
+	if c.HTTPProxy != "" {
+		if u, err := url.Parse(c.HTTPProxy); err != nil || u.Scheme == "" || u.Host == "" {
+			errs = append(errs, fmt.Errorf("httpProxy %q must be a URL such as \"http://proxy:3128\"", c.HTTPProxy))
+		}
+	}
+	if c.PushgatewayURL != "" {
+		if u, err := url.Parse(c.PushgatewayURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("pushgatewayURL %q must be an http(s) URL", c.PushgatewayURL))
+		}
+	}
+	if c.SlackWebhookURL != "" {
+		if u, err := url.Parse(c.SlackWebhookURL); err != nil || u.Scheme != "https" || u.Host == "" {
+			errs = append(errs, fmt.Errorf("slackWebhookURL %q must be an https URL", c.SlackWebhookURL))
+		}
+	}
+	if c.RenewAPIToken != "" && c.StatusListenAddr == "" {
+		errs = append(errs, fmt.Errorf("renewAPIToken requires statusListenAddr"))
+	}
+	if c.CertAPI.ListenAddr != "" && c.CertAPI.Token == "" {
+		errs = append(errs, fmt.Errorf("certAPI.token is required when certAPI.listenAddr is set"))
+	}
+	if c.CertAPI.ListenAddr == "" && (c.CertAPI.Token != "" || c.CertAPI.ClientCAFile != "") {
+		errs = append(errs, fmt.Errorf("certAPI.token and certAPI.clientCAFile require certAPI.listenAddr"))
+	}
+	if c.SMTP.Host != "" {
+		if c.SMTP.From == "" || len(c.SMTP.To) == 0 {
+			errs = append(errs, fmt.Errorf("smtp: from and to are required"))
+		}
+		if c.SMTP.Port < 0 || c.SMTP.Port > 65535 {
+			errs = append(errs, fmt.Errorf("smtp.port %d is not a valid port", c.SMTP.Port))
+		}
+	}
+	if c.Concurrency < 0 {
+		errs = append(errs, fmt.Errorf("concurrency must not be negative"))
+	}
+	if c.CriticalExpiryDays < 0 {
+		errs = append(errs, fmt.Errorf("criticalExpiryDays must not be negative"))
+	}
+	if c.RenewalJitter != "" {
+		if d, err := time.ParseDuration(c.RenewalJitter); err != nil || d < 0 {
+			errs = append(errs, fmt.Errorf("renewalJitter %q must be a non-negative duration such as \"30m\"", c.RenewalJitter))
+		}
+	}
+	if c.MinTimeBetweenRenewals != "" {
+		if d, err := time.ParseDuration(c.MinTimeBetweenRenewals); err != nil || d < 0 {
+			errs = append(errs, fmt.Errorf("minTimeBetweenRenewals %q must be a non-negative duration such as \"24h\"", c.MinTimeBetweenRenewals))
+		}
+	}
+	if c.MaxRenewalBackoff != "" {
+		if d, err := time.ParseDuration(c.MaxRenewalBackoff); err != nil || d < 0 {
+			errs = append(errs, fmt.Errorf("maxRenewalBackoff %q must be a non-negative duration such as \"24h\"", c.MaxRenewalBackoff))
+		}
+	}
+	if c.ObtainTimeout != "" {
+		d, err := time.ParseDuration(c.ObtainTimeout)
+		if err != nil || d < 0 {
+			errs = append(errs, fmt.Errorf("obtainTimeout %q must be a non-negative duration such as \"2m\"", c.ObtainTimeout))
+		} else if propagation, err := time.ParseDuration(c.Challenge.PropagationTimeout); err == nil && d > 0 && propagation >= d {
+			errs = append(errs, fmt.Errorf("obtainTimeout %q must be longer than challenge.propagationTimeout %q", c.ObtainTimeout, c.Challenge.PropagationTimeout))
+		}
+	}
+	if _, err := ParseFileMode(c.CertFileMode, 0644); err != nil {
+		errs = append(errs, fmt.Errorf("certFileMode: %w", err))
+	}
+	if _, err := ParseFileMode(c.KeyFileMode, 0600); err != nil {
+		errs = append(errs, fmt.Errorf("keyFileMode: %w", err))
+	}
+	if _, err := LookupUID(c.CertOwner); err != nil {
+		errs = append(errs, fmt.Errorf("certOwner: %w", err))
+	}
+	if _, err := LookupGID(c.CertGroup); err != nil {
+		errs = append(errs, fmt.Errorf("certGroup: %w", err))
+	}
+	switch c.Challenge.Type {
+	case "", "http-01":
+	case "dns-01":
+		if c.Challenge.DNSProvider == "" {
+			errs = append(errs, fmt.Errorf("challenge.dnsProvider is required for challenge type \"dns-01\""))
+		}
+	case "tls-alpn-01":
+		if len(c.Proxy.Routes) == 0 {
+			errs = append(errs, fmt.Errorf("challenge type \"tls-alpn-01\" requires proxy.routes, whose listener answers the challenge"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("challenge.type %q must be \"http-01\", \"dns-01\" or \"tls-alpn-01\"", c.Challenge.Type))
+	}
+	if c.Challenge.DNSProvider != "" && c.Challenge.Type != "dns-01" {
+		errs = append(errs, fmt.Errorf("challenge.dnsProvider requires challenge type \"dns-01\""))
+	}
+	if acmeDNS := c.Challenge.ACMEDNS; c.Challenge.DNSProvider == "acmedns" {
+		if u, err := url.Parse(acmeDNS.APIBase); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("challenge.acmeDNS.apiBase %q must be an http(s) URL", acmeDNS.APIBase))
+		}
+		for _, cidr := range acmeDNS.AllowFrom {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				errs = append(errs, fmt.Errorf("challenge.acmeDNS.allowFrom %q must be a CIDR such as \"10.0.0.0/8\"", cidr))
+			}
+		}
+		for domain, account := range acmeDNS.Accounts {
+			if account.Username == "" || account.Password == "" || account.Subdomain == "" || account.FullDomain == "" {
+				errs = append(errs, fmt.Errorf("challenge.acmeDNS.accounts[%q] requires username, password, subdomain and fullDomain", domain))
+			}
+		}
+	} else if acmeDNS.APIBase != "" || len(acmeDNS.Accounts) > 0 {
+		errs = append(errs, fmt.Errorf("challenge.acmeDNS requires challenge.dnsProvider \"acmedns\""))
+	}
+	if c.Challenge.PreflightCheck && c.Challenge.Type != "" && c.Challenge.Type != "http-01" {
+		errs = append(errs, fmt.Errorf("challenge.preflightCheck requires challenge type \"http-01\""))
+	}
+	if c.Challenge.BindAddress != "" && net.ParseIP(c.Challenge.BindAddress) == nil {
+		errs = append(errs, fmt.Errorf("challenge.bindAddress %q must be an IP address such as \"10.0.0.5\"", c.Challenge.BindAddress))
+	}
+	for _, addr := range []struct{ name, value string }{
+		{"proxy.listenAddr", c.Proxy.ListenAddr},
+		{"proxy.redirectListenAddr", c.Proxy.RedirectListenAddr},
+	} {
+		if addr.value == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(addr.value); err != nil {
+			errs = append(errs, fmt.Errorf("%s %q must be a host:port address such as \":443\": %w", addr.name, addr.value, err))
+		}
+	}
+	for _, f := range []struct{ name, value string }{
+		{"propagationTimeout", c.Challenge.PropagationTimeout},
+		{"pollingInterval", c.Challenge.PollingInterval},
+		{"dnsTimeout", c.Challenge.DNSTimeout},
+	} {
+		if f.value == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(f.value); err != nil || d <= 0 {
+			errs = append(errs, fmt.Errorf("challenge.%s %q must be a positive duration such as \"2m\"", f.name, f.value))
+		}
+	}
+	switch c.Mode {
+	case "", "issue":
+	case "distribute":
+		if !c.usesS3() {
+			errs = append(errs, fmt.Errorf("mode \"distribute\" requires S3 storage to install certificates from"))
+		}
+		if c.PruneRemovedDomains {
+			errs = append(errs, fmt.Errorf("pruneRemovedDomains would delete the issuer's certificates and is not allowed in mode \"distribute\""))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("mode %q must be \"issue\" or \"distribute\"", c.Mode))
+	}
+	if le := c.LeaderElection; le.Enabled {
+		if !c.usesS3() {
+			errs = append(errs, fmt.Errorf("leaderElection requires S3 storage for followers to install certificates from"))
+		}
+		if c.Mode == "distribute" {
+			errs = append(errs, fmt.Errorf("leaderElection can't be combined with mode \"distribute\", which never renews"))
+		}
+		if le.Lease != "" {
+			if d, err := time.ParseDuration(le.Lease); err != nil || d < 3*time.Second {
+				errs = append(errs, fmt.Errorf("leaderElection.lease %q must be a duration of at least 3s such as \"1m\"", le.Lease))
+			}
+		}
+	} else if le.LockFile != "" || le.Lease != "" {
+		errs = append(errs, fmt.Errorf("leaderElection.lockFile and leaderElection.lease require leaderElection.enabled"))
+	}
+	switch c.RenewalMode {
+	case "", "fixed", "lifetime-fraction":
+	default:
+		errs = append(errs, fmt.Errorf("renewalMode %q must be \"fixed\" or \"lifetime-fraction\"", c.RenewalMode))
+	}
+	switch c.CertBundle {
+	case "", "bundle", "leaf+chain", "leaf":
+	default:
+		errs = append(errs, fmt.Errorf("certBundle %q must be \"bundle\", \"leaf+chain\" or \"leaf\"", c.CertBundle))
+	}
+	switch c.LogFormat {
+	case "", "text", "json":
+	default:
+		errs = append(errs, fmt.Errorf("logFormat %q must be \"text\" or \"json\"", c.LogFormat))
+	}
+	if c.LogLevel != "" {
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+			errs = append(errs, fmt.Errorf("logLevel %q must be debug, info, warn or error", c.LogLevel))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// usesS3 reports whether any configured storage backend is S3.
+func (c *AppConfig) usesS3() bool {
+	return c.S3.BucketName != "" || slices.ContainsFunc(c.Storage, func(s StorageConfig) bool {
+		return s.Type == "s3"
+	})
+}
+
+// validate checks the S3 retry, timeout and credential settings, prefixing problems with field.
+func (c S3Config) validate(field string) []error {
+	var errs []error
+	if c.MaxAttempts < 0 {
+		errs = append(errs, fmt.Errorf("%s.maxAttempts must not be negative", field))
+	}
+	if c.MaxArchiveVersions < 0 {
+		errs = append(errs, fmt.Errorf("%s.maxArchiveVersions must not be negative", field))
+	}
+	if c.Timeout != "" {
+		if d, err := time.ParseDuration(c.Timeout); err != nil || d <= 0 {
+			errs = append(errs, fmt.Errorf("%s.timeout %q must be a positive duration such as \"30s\"", field, c.Timeout))
+		}
+	}
+	if (c.AWSAccessKeyID == "") != (c.AWSSecretAccessKey == "") {
+		errs = append(errs, fmt.Errorf("%s.awsAccessKeyId and %s.awsSecretAccessKey must be set together", field, field))
+	}
+	if c.AWSExternalID != "" && c.AWSRoleARN == "" {
+		errs = append(errs, fmt.Errorf("%s.awsExternalId requires %s.awsRoleArn", field, field))
+	}
+	if c.AWSRoleARN != "" && !strings.HasPrefix(c.AWSRoleARN, "arn:") {
+		errs = append(errs, fmt.Errorf("%s.awsRoleArn %q must be a role ARN such as \"arn:aws:iam::123456789012:role/loadmaster\"", field, c.AWSRoleARN))
+	}
+	if c.AWSProfile != "" && c.AWSAccessKeyID != "" {
+		errs = append(errs, fmt.Errorf("%s.awsProfile and %s.awsAccessKeyId are mutually exclusive", field, field))
+	}
+	return errs
+}
+
+// Validate checks that every domain group is non-empty, every name is a plausible domain,
+// wildcard or IP address, no name belongs to more than one group, and every subject belongs to
+// a group.
+func (c *DomainsConfig) Validate() error {
+	var errs []error
+	seen := make(map[string]int)
+	for i, group := range c.Domains {
+		if len(group) == 0 {
+			errs = append(errs, fmt.Errorf("domain group %d is empty", i))
+			continue
+		}
+		for _, domain := range group {
+			// Colons are only valid in IPv6 addresses.
+			if domain == "" || strings.ContainsAny(domain, " \t/") || (strings.Contains(domain, ":") && net.ParseIP(domain) == nil) {
+				errs = append(errs, fmt.Errorf("domain group %d: invalid domain %q", i, domain))
+				continue
+			}
+			if strings.Contains(strings.TrimPrefix(domain, "*."), "*") {
+				errs = append(errs, fmt.Errorf("domain group %d: %q: a wildcard is only allowed as the leftmost label", i, domain))
+			}
+			if other, ok := seen[domain]; ok {
+				if other == i {
+					errs = append(errs, fmt.Errorf("domain %s is listed twice in group %d", domain, i))
+				} else {
+					errs = append(errs, fmt.Errorf("domain %s is listed in group %d and group %d", domain, other, i))
+				}
+				continue
+			}
+			seen[domain] = i
+		}
+	}
+	subjectGroups := make(map[int]string)
+	for _, domain := range slices.Sorted(maps.Keys(c.Subjects)) {
+		subject := c.Subjects[domain]
+		if i, ok := seen[domain]; !ok {
+			errs = append(errs, fmt.Errorf("subjects: %s is not in any domain group", domain))
+		} else if other, ok := subjectGroups[i]; ok {
+			errs = append(errs, fmt.Errorf("subjects: %s and %s are both in group %d", other, domain, i))
+		} else {
+			subjectGroups[i] = domain
+		}
+		if subject.Country != "" && len(subject.Country) != 2 {
+			errs = append(errs, fmt.Errorf("subjects: %s: C %q must be a two-letter country code", domain, subject.Country))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,57 @@
+// Package metrics holds loadmaster's Prometheus metrics, registered on a dedicated registry so
+// that the /metrics endpoint and a Pushgateway push expose exactly the same set.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// Registry holds every loadmaster metric.
+var Registry = prometheus.NewRegistry()
+
+// S3OpDuration observes the duration of S3 storage operations, labelled by op (e.g.
+// "SaveCert", "DownloadCert").
+var S3OpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "loadmaster_s3_op_duration_seconds",
+	Help:    "Duration of S3 storage operations.",
+	Buckets: prometheus.DefBuckets,
+}, []string{"op"})
+
+// Renewals counts ACME renewal attempts, labelled by result ("success" or "failure").
+var Renewals = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "loadmaster_renewals_total",
+	Help: "ACME renewal attempts by result.",
+}, []string{"result"})
+
+// CertExpiry is the notAfter time of each installed certificate, labelled by domain root.
+var CertExpiry = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "loadmaster_cert_expiry_timestamp_seconds",
+	Help: "Expiry of the installed certificate as a Unix timestamp.",
+}, []string{"domain"})
+
+// Leader is 1 while this instance may renew certificates: always without leader election, and
+// while it holds the lease with it.
+var Leader = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "loadmaster_leader",
+	Help: "Whether this instance is the elected leader.",
+})
+
+func init() {
+	Registry.MustRegister(S3OpDuration, Renewals, CertExpiry, Leader)
+	Leader.Set(1)
+}
+
+// Push replaces the metrics of the "loadmaster" job on the Pushgateway at url with the current
+// values, for one-shot runs that are never scraped.
+func Push(url string) error {
+	return push.New(url, "loadmaster").Gatherer(Registry).Push()
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync/atomic"
+
+	"github.com/go-acme/lego/v4/challenge/tlsalpn01"
+	"github.com/joshuaschlichting/loadmaster/internal/acme"
+	"github.com/joshuaschlichting/loadmaster/internal/config"
+)
+
+// DefaultListenAddr is used for the HTTPS listener when the proxy config does not set one.
+const DefaultListenAddr = ":443"
+
+const acmeChallengePath = "/.well-known/acme-challenge/"
+
+type getCertificateFunc func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+
+// Server terminates TLS with the managed certificates and forwards requests to the upstream
+// configured for the request's host.
+type Server struct {
+	listenAddr     string
+	storage        acme.ACMEStorage
+	routes         map[string]*httputil.ReverseProxy
+	challenge      *httputil.ReverseProxy
+	getCertificate atomic.Pointer[getCertificateFunc]
+}
+
+// New builds a proxy Server from cfg. Certificates are selected by SNI from domainGroups.
+func New(cfg config.ProxyConfig, storage acme.ACMEStorage, domainGroups [][]string) (*Server, error) {
+	s := &Server{
+		listenAddr: cfg.ListenAddr,
+		storage:    storage,
+		routes:     make(map[string]*httputil.ReverseProxy),
+	}
+	if s.listenAddr == "" {
+		s.listenAddr = DefaultListenAddr
+	}
+	for host, upstream := range cfg.Routes {
+		upstreamURL, err := url.Parse(upstream)
+		if err != nil || upstreamURL.Scheme == "" || upstreamURL.Host == "" {
+			return nil, fmt.Errorf("invalid upstream %q for host %s", upstream, host)
+		}
+		s.routes[strings.ToLower(host)] = httputil.NewSingleHostReverseProxy(upstreamURL)
+	}
+	s.challenge = httputil.NewSingleHostReverseProxy(&url.URL{
+		Scheme: "http",
+		Host:   acme.HTTPChallengeAddr(),
+	})
+	s.SetDomains(domainGroups)
+	return s, nil
+}
+
+// SetDomains replaces the set of domain groups certificates are served for.
+func (s *Server) SetDomains(domainGroups [][]string) {
+	fn := getCertificateFunc(acme.GetCertificateFunc(s.storage, domainGroups))
+	s.getCertificate.Store(&fn)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, acmeChallengePath) {
+		s.challenge.ServeHTTP(w, r)
+		return
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	upstream, ok := s.routes[strings.ToLower(host)]
+	if !ok {
+		http.Error(w, "unknown host", http.StatusNotFound)
+		return
+	}
+	upstream.ServeHTTP(w, r)
+}
+
+// ListenAndServeTLS starts the HTTPS listener and blocks until it fails.
+func (s *Server) ListenAndServeTLS() error {
+	server := &http.Server{
+		Addr:    s.listenAddr,
+		Handler: s,
+		TLSConfig: &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			// acme-tls/1 lets TLS-ALPN-01 validation share this listener; ordinary clients never
+			// offer it.
+			NextProtos: []string{"h2", "http/1.1", tlsalpn01.ACMETLS1Protocol},
+			GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+				return (*s.getCertificate.Load())(hello)
+			},
+		},
+	}
+	slog.Info("Starting TLS reverse proxy", "addr", s.listenAddr, "routes", len(s.routes))
+	return server.ListenAndServeTLS("", "")
+}
@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	"github.com/joshuaschlichting/loadmaster/internal/acme"
+)
+
+// RedirectHandler 301-redirects every request to https, except HTTP-01 challenge requests
+// which are forwarded to the internal challenge server on acme.HTTPChallengePort.
+type RedirectHandler struct {
+	// httpsPort is appended to redirect targets when it is not the default 443.
+	httpsPort string
+	challenge *httputil.ReverseProxy
+}
+
+// NewRedirectHandler returns a RedirectHandler that redirects to the port of httpsListenAddr.
+func NewRedirectHandler(httpsListenAddr string) *RedirectHandler {
+	_, port, _ := net.SplitHostPort(httpsListenAddr)
+	if port == "443" {
+		port = ""
+	}
+	return &RedirectHandler{
+		httpsPort: port,
+		challenge: httputil.NewSingleHostReverseProxy(&url.URL{
+			Scheme: "http",
+			Host:   acme.HTTPChallengeAddr(),
+		}),
+	}
+}
+
+func (h *RedirectHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, acmeChallengePath) {
+		h.challenge.ServeHTTP(w, r)
+		return
+	}
+	host := r.Host
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	if h.httpsPort != "" {
+		host = net.JoinHostPort(host, h.httpsPort)
+	}
+	target := url.URL{Scheme: "https", Host: host, Path: r.URL.Path, RawQuery: r.URL.RawQuery}
+	http.Redirect(w, r, target.String(), http.StatusMovedPermanently)
+}
+
+// ListenAndServeRedirect serves a RedirectHandler on addr and blocks until it fails.
+func ListenAndServeRedirect(addr, httpsListenAddr string) error {
+	slog.Info("Starting HTTP to HTTPS redirect listener", "addr", addr)
+	return http.ListenAndServe(addr, NewRedirectHandler(httpsListenAddr))
+}
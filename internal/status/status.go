@@ -0,0 +1,182 @@
+package status
+
+import (
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/joshuaschlichting/loadmaster/internal/acme"
+	"github.com/joshuaschlichting/loadmaster/internal/config"
+	"github.com/joshuaschlichting/loadmaster/internal/metrics"
+)
+
+// DomainStatus is the state of one domain group's certificate as reported by /status.
+type DomainStatus struct {
+	Domains       []string            `json:"domains"`
+	DomainRoot    string              `json:"domainRoot"`
+	Issuer        string              `json:"issuer,omitempty"`
+	NotAfter      time.Time           `json:"notAfter,omitzero"`
+	DaysRemaining int                 `json:"daysRemaining"`
+	Error         string              `json:"error,omitempty"`
+	Renewal       *acme.RenewalRecord `json:"renewal,omitempty"`
+	OCSP          acme.OCSPInfo       `json:"ocsp"`
+}
+
+// Server serves operational endpoints over plain HTTP. It is meant to listen on a private
+// address.
+type Server struct {
+	listenAddr   string
+	storage      acme.ACMEStorage
+	domainGroups atomic.Pointer[[][]string]
+	renewToken   string
+	mux          *http.ServeMux
+}
+
+// New builds a Server reporting on domainGroups.
+func New(listenAddr string, storage acme.ACMEStorage, domainGroups [][]string) *Server {
+	s := &Server{
+		listenAddr: listenAddr,
+		storage:    storage,
+		mux:        http.NewServeMux(),
+	}
+	s.SetDomains(domainGroups)
+	s.mux.HandleFunc("GET /status", s.handleStatus)
+	s.mux.Handle("GET /metrics", metrics.Handler())
+	return s
+}
+
+// EnableRenew serves POST /renew to callers presenting token as a bearer token.
+func (s *Server) EnableRenew(token string) {
+	s.renewToken = token
+	s.mux.HandleFunc("POST /renew", s.handleRenew)
+}
+
+// SetDomains replaces the set of domain groups reported on.
+func (s *Server) SetDomains(domainGroups [][]string) {
+	s.domainGroups.Store(&domainGroups)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// ListenAndServe serves the endpoints on the configured address.
+func (s *Server) ListenAndServe() error {
+	slog.Info("Starting status server", "listenAddr", s.listenAddr)
+	return http.ListenAndServe(s.listenAddr, s)
+}
+
+// Statuses reports the certificate and renewal history of every domain group.
+func Statuses(storage acme.ACMEStorage, domainGroups [][]string) []DomainStatus {
+	history, err := storage.LoadRenewalHistory()
+	if err != nil {
+		slog.Warn("error loading renewal history", "error", err)
+	}
+	statuses := make([]DomainStatus, 0, len(domainGroups))
+	for _, group := range domainGroups {
+		if len(group) == 0 {
+			continue
+		}
+		st := DomainStatus{Domains: group, DomainRoot: acme.DomainRoot(group)}
+		if record, ok := history[st.DomainRoot]; ok {
+			st.Renewal = &record
+		}
+		st.OCSP = acme.InspectOCSP(storage, st.DomainRoot)
+		certData, _, err := storage.DownloadCert(st.DomainRoot)
+		if err == nil {
+			var cert *x509.Certificate
+			if cert, err = acme.ParseCertificate(certData); err == nil {
+				st.Issuer = cert.Issuer.CommonName
+				st.NotAfter = cert.NotAfter
+				st.DaysRemaining = acme.CertRemainingDays(cert)
+			}
+		}
+		if err != nil {
+			st.Error = err.Error()
+		}
+		statuses = append(statuses, st)
+	}
+	return statuses
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(Statuses(s.storage, *s.domainGroups.Load())); err != nil {
+		slog.Warn("error writing status response", "error", err)
+	}
+}
+
+// RenewRequest is the body of POST /renew.
+type RenewRequest struct {
+	Domain string `json:"domain"`
+	Force  bool   `json:"force"`
+}
+
+// RenewResponse is the result of POST /renew: the outcome of UpdateTLS for the group ("ok",
+// "self-signed" or "failed") and the group's status afterwards.
+type RenewResponse struct {
+	Result string       `json:"result"`
+	Error  string       `json:"error,omitempty"`
+	Status DomainStatus `json:"status"`
+}
+
+func (s *Server) handleRenew(w http.ResponseWriter, r *http.Request) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.renewToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var req RenewRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+		http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	domain, err := config.NormalizeDomain(req.Domain)
+	if err != nil || domain == "" {
+		http.Error(w, "invalid domain", http.StatusBadRequest)
+		return
+	}
+	i := slices.IndexFunc(*s.domainGroups.Load(), func(group []string) bool {
+		return slices.Contains(group, domain)
+	})
+	if i < 0 {
+		http.Error(w, "domain "+domain+" is not configured", http.StatusNotFound)
+		return
+	}
+	group := (*s.domainGroups.Load())[i]
+
+	slog.Info("Renewal requested via API", "domains", group, "force", req.Force)
+	resp := RenewResponse{Result: "ok"}
+	code := http.StatusOK
+	if err := acme.RenewNow(s.storage, group, req.Force); err != nil {
+		slog.Error("UpdateTLS error", "domains", group, "error", err)
+		resp.Result, resp.Error = "failed", err.Error()
+		code = http.StatusInternalServerError
+	} else if certPath, _ := s.storage.CertLocation(acme.DomainRoot(group)); isSelfSigned(certPath) {
+		resp.Result, resp.Error = "self-signed", "using a self-signed fallback certificate"
+		code = http.StatusInternalServerError
+	}
+	if err := acme.FlushNotifiers(); err != nil {
+		slog.Warn("error sending renewal notifications", "error", err)
+	}
+	resp.Status = Statuses(s.storage, [][]string{group})[0]
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		slog.Warn("error writing renew response", "error", err)
+	}
+}
+
+// isSelfSigned reports whether the certificate installed at certPath is a self-signed fallback.
+func isSelfSigned(certPath string) bool {
+	certData, err := os.ReadFile(certPath)
+	return err == nil && acme.IsSelfSigned(certData)
+}
@@ -1,140 +1,220 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"log"
 	"log/slog"
 	"os"
-	"path/filepath"
-	"time"
+	"os/signal"
+	"syscall"
 
-	"github.com/fsnotify/fsnotify"
 	"github.com/joshuaschlichting/loadmaster/internal/acme"
+	"github.com/joshuaschlichting/loadmaster/internal/certapi"
 	"github.com/joshuaschlichting/loadmaster/internal/config"
+	"github.com/joshuaschlichting/loadmaster/internal/metrics"
+	"github.com/joshuaschlichting/loadmaster/internal/proxy"
+	"github.com/joshuaschlichting/loadmaster/internal/status"
+	"github.com/joshuaschlichting/loadmaster/manager"
 )
 
-func getS3ParamsFromConfig(config *config.AppConfig) acme.NewS3ACMEStorageParams {
-	return acme.NewS3ACMEStorageParams{
-		BucketName:   config.S3.BucketName,
-		ContactEmail: config.Email,
-		LocalCertDir: config.LocalCertDir,
-		CAAuthority:  config.CAAuthority,
+// newLogger builds the process logger from a format ("text" or "json") and a level name.
+func newLogger(format, level string) (*slog.Logger, error) {
+	var logLevel slog.Level
+	if level == "" {
+		level = "info"
+	}
+	if err := logLevel.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q: %w", level, err)
+	}
+	opts := &slog.HandlerOptions{Level: logLevel}
+	switch format {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(os.Stdout, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stdout, opts)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q: must be \"text\" or \"json\"", format)
 	}
 }
 
 func main() {
+	// Set before dispatching, so subcommands building a manager report the version too.
+	manager.Version = version
 
-	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
-		Level: slog.LevelDebug,
-	}))
+	logger, err := newLogger("text", os.Getenv(config.LogLevelEnv))
+	if err != nil {
+		logger, _ = newLogger("text", "info")
+	}
 	slog.SetDefault(logger)
-	var domainsFile string
-	var configFile string
+
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			os.Exit(cmd(os.Args[2:]))
+		}
+	}
+
 	var port int
-	flag.StringVar(&domainsFile, "domains", filepath.Join(config.DefaultConfigDir, "domains.json"), "Path to domains configuration file")
-	flag.StringVar(&configFile, "config", filepath.Join(config.DefaultConfigDir, "config.json"), "Path to application configuration file")
+	var logFormat string
+	var logLevel string
+	var verbose bool
+	var once bool
+	var verifyWithStaging bool
+	var printVersion bool
+	configFilePtr, domainsFilePtr := pathFlags(flag.CommandLine)
 	flag.IntVar(&port, "port", acme.HTTPChallengePort, "ACME HTTP-01 challenge request port")
+	flag.StringVar(&logFormat, "log-format", "", "Log format: text or json (overrides logFormat in config)")
+	flag.StringVar(&logLevel, "log-level", "", "Log level: debug, info, warn or error (overrides logLevel in config)")
+	flag.BoolVar(&verbose, "v", false, "Log at debug level (shorthand for -log-level debug)")
+	flag.BoolVar(&once, "once", false, "Run a single certificate sweep and exit, with status 1 if any domain group failed or fell back to a self-signed certificate")
+	flag.BoolVar(&verifyWithStaging, "verify-with-staging", false, "Obtain each certificate from the CA's staging directory and verify it before requesting it from production")
+	flag.BoolVar(&printVersion, "version", false, "Print the version, git commit and build date, then exit")
 	flag.Parse()
-	log.Printf("Starting certificate manager")
+	if printVersion {
+		os.Exit(versionCommand(nil))
+	}
+	configFile, domainsFile := *configFilePtr, *domainsFilePtr
+	log.Printf("Starting certificate manager %s", versionString())
 	log.Printf("Domains file: %s", domainsFile)
 	log.Printf("Config file: %s", configFile)
 	acme.HTTPChallengePort = port
 
-	appConfig, err := config.LoadAppConfig(configFile, domainsFile)
+	if err := config.EnsureDefaultConfig(configFile, domainsFile); err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	appConfig, err := config.LoadAppConfig(configFile)
 	if err != nil {
 		log.Fatalf("Error loading application config: %v", err)
 	}
 
-	if _, err := os.Stat(appConfig.LocalCertDir); os.IsNotExist(err) {
-		err := os.MkdirAll(appConfig.LocalCertDir, 0755)
-		if err != nil {
-			log.Fatalf("Error creating local certificate directory: %v", err)
-		}
+	if logFormat == "" {
+		logFormat = appConfig.LogFormat
 	}
+	if verbose {
+		logLevel = "debug"
+	}
+	if logLevel == "" {
+		logLevel = appConfig.LogLevel
+	}
+	logger, err = newLogger(logFormat, logLevel)
+	if err != nil {
+		log.Fatalf("Error configuring logging: %v", err)
+	}
+	slog.SetDefault(logger)
 
-	var storage acme.ACMEStorage
-
-	if appConfig.S3.BucketName != "" {
-		s3Params := getS3ParamsFromConfig(appConfig)
-		storage, err = acme.NewS3ACMEStorage(s3Params)
-		if err != nil {
-			log.Printf("Error creating S3 storage: %v", err)
+	if verifyWithStaging {
+		if err := acme.ValidateVerifyWithStaging(appConfig.CAAuthority); err != nil {
+			log.Fatalf("-verify-with-staging: %v", err)
 		}
-	} else {
-		storage = acme.NewLocalACMEStorage(appConfig.Email, appConfig.CAAuthority)
+		acme.VerifyWithStaging = true
 	}
-
-	domains, err := config.LoadDomainsConfig(domainsFile)
+	domains, err := config.LoadDomains(domainsFile)
 	if err != nil {
-		log.Printf("Error loading domains: %v", err)
-	} else {
-		log.Printf("Loaded %d domain groups", len(domains.Domains))
-		// Boot behavior: retrieve certs from cache and refresh if expiring; fallback to self-signed only if cache missing.
-		for domainGroup := range domains.Domains {
-			updateErr := storage.UpdateTLS(domains.Domains[domainGroup])
-			if updateErr != nil {
-				log.Printf("UpdateTLS error for %v: %v", domains.Domains[domainGroup], updateErr)
-			}
+		if once {
+			log.Fatalf("Error loading domains: %v", err)
 		}
+		log.Printf("Error loading domains: %v", err)
 	}
-
-	// Watch for file changes
-	watcher, err := fsnotify.NewWatcher()
+	m, err := manager.New(appConfig, domains)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer func() {
-		if err := watcher.Close(); err != nil {
-			log.Printf("Error closing watcher: %v", err)
-		}
-	}()
-
-	err = watcher.Add(domainsFile)
-	if err != nil {
-		log.Fatal(err)
+	if acme.Distribute {
+		log.Printf("Distribute mode: installing certificates from storage without ACME renewal")
 	}
+	storage := m.Storage()
 
-	log.Printf("Watching %s for changes...", domainsFile)
-
-	for {
-		select {
-		case event, ok := <-watcher.Events:
-			if !ok {
-				return
+	if once {
+		failed := manager.CountFailed(m.RenewAll(context.Background()))
+		if appConfig.PushgatewayURL != "" {
+			if err := metrics.Push(appConfig.PushgatewayURL); err != nil {
+				log.Printf("Error pushing metrics to %s: %v", appConfig.PushgatewayURL, err)
 			}
-			if event.Op&fsnotify.Write == fsnotify.Write || event.Op&fsnotify.Create == fsnotify.Create {
-				log.Printf("Domains file modified: %s", event.Name)
-
-				// Small delay to ensure file write is complete
-				time.Sleep(100 * time.Millisecond)
+		}
+		if failed > 0 {
+			os.Exit(1)
+		}
+		return
+	}
 
-				domains, err := config.LoadDomainsConfig(domainsFile)
-				if err != nil {
-					log.Printf("Error loading domains: %v", err)
-				} else {
-					log.Printf("Loaded %d domain groups", len(domains.Domains))
+	// The proxy's listener answers TLS-ALPN-01 challenges, so orders can validate on port 443.
+	acme.TLSALPNChallenge = len(appConfig.Proxy.Routes) > 0
 
-					for domainGroup := range domains.Domains {
-						if updateErr := storage.UpdateTLS(domains.Domains[domainGroup]); updateErr != nil {
-							log.Printf("UpdateTLS error for %v: %v", domains.Domains[domainGroup], updateErr)
-						}
-					}
+	var statusServer *status.Server
+	if appConfig.StatusListenAddr != "" {
+		statusServer = status.New(appConfig.StatusListenAddr, storage, m.Domains().Domains)
+		if appConfig.RenewAPIToken != "" {
+			statusServer.EnableRenew(appConfig.RenewAPIToken)
+		}
+		go func() {
+			if err := statusServer.ListenAndServe(); err != nil {
+				log.Fatalf("Status server error: %v", err)
+			}
+		}()
+	}
 
-				}
+	var proxyServer *proxy.Server
+	if len(appConfig.Proxy.Routes) > 0 {
+		proxyServer, err = proxy.New(appConfig.Proxy, storage, m.Domains().Domains)
+		if err != nil {
+			log.Fatalf("Error creating reverse proxy: %v", err)
+		}
+		go func() {
+			if err := proxyServer.ListenAndServeTLS(); err != nil {
+				log.Fatalf("Reverse proxy error: %v", err)
 			}
-		case <-time.After(24 * time.Hour):
-			log.Printf("Refreshing certificates...")
-			for domainGroup := range domains.Domains {
-				updateErr := storage.UpdateTLS(domains.Domains[domainGroup])
-				if updateErr != nil {
-					log.Printf("UpdateTLS error for %v: %v", domains.Domains[domainGroup], updateErr)
-				}
+		}()
+	}
+
+	var certAPIServer *certapi.Server
+	if appConfig.CertAPI.ListenAddr != "" {
+		certAPIServer, err = certapi.New(appConfig.CertAPI, storage, m.Domains().Domains)
+		if err != nil {
+			log.Fatalf("Error creating certificate API: %v", err)
+		}
+		go func() {
+			if err := certAPIServer.ListenAndServeTLS(); err != nil {
+				log.Fatalf("Certificate API error: %v", err)
 			}
-		case err, ok := <-watcher.Errors:
-			if !ok {
-				return
+		}()
+	}
+
+	if appConfig.Proxy.RedirectListenAddr != "" {
+		httpsListenAddr := appConfig.Proxy.ListenAddr
+		if httpsListenAddr == "" {
+			httpsListenAddr = proxy.DefaultListenAddr
+		}
+		go func() {
+			if err := proxy.ListenAndServeRedirect(appConfig.Proxy.RedirectListenAddr, httpsListenAddr); err != nil {
+				log.Fatalf("Redirect listener error: %v", err)
 			}
-			log.Printf("Watcher error: %v", err)
+		}()
+	}
+
+	m.DomainsFile = domainsFile
+	m.OnReload = func(domains *config.DomainsConfig) {
+		if proxyServer != nil {
+			proxyServer.SetDomains(domains.Domains)
+		}
+		if statusServer != nil {
+			statusServer.SetDomains(domains.Domains)
+		}
+		if certAPIServer != nil {
+			certAPIServer.SetDomains(domains.Domains)
 		}
 	}
+	// The scheduler loop answers the watchdog, so systemd restarts the daemon if it hangs.
+	m.Keepalive, m.KeepaliveInterval = pingSystemdWatchdog, systemdWatchdogInterval()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := m.Start(ctx); err != nil {
+		log.Fatal(err)
+	}
+	notifySystemdReady()
+
+	<-ctx.Done()
+	log.Printf("Shutting down")
+	m.Stop()
 }
@@ -0,0 +1,109 @@
+package manager
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/joshuaschlichting/loadmaster/internal/acme"
+	"github.com/joshuaschlichting/loadmaster/internal/metrics"
+)
+
+// defaultLeaderLease is how long a leader's lease lasts when leaderElection.lease is unset.
+const defaultLeaderLease = time.Minute
+
+// leaderElection campaigns for the leader lease on behalf of a started Manager. The lease is
+// renewed every third of its duration, so a follower takes over at most a third of a lease
+// after the leader's lease expired.
+type leaderElection struct {
+	lease  acme.LeaderLease
+	holder string
+	ttl    time.Duration
+	// validUntil is when the lease last acquired expires; a leader that can't reach the lease
+	// keeps leading until then.
+	validUntil time.Time
+	leader     bool
+	campaigned bool
+}
+
+// newLeaderElection builds the leader election configured in appConfig, with the lease kept in
+// the lock file or, by default, in storage.
+func newLeaderElection(appConfig *AppConfig, storage acme.ACMEStorage) (*leaderElection, error) {
+	cfg := appConfig.LeaderElection
+	ttl := defaultLeaderLease
+	if cfg.Lease != "" {
+		var err error
+		if ttl, err = time.ParseDuration(cfg.Lease); err != nil || ttl < 3*time.Second {
+			return nil, fmt.Errorf("leaderElection.lease %q must be a duration of at least 3s such as \"1m\"", cfg.Lease)
+		}
+	}
+	var lease acme.LeaderLease
+	if cfg.LockFile != "" {
+		lease = &acme.FileLease{Path: cfg.LockFile}
+	} else if l, ok := storage.(acme.LeaderLease); ok {
+		lease = l
+	} else {
+		return nil, fmt.Errorf("leaderElection requires S3 storage or leaderElection.lockFile")
+	}
+	hostname, _ := os.Hostname()
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+	return &leaderElection{
+		lease:  lease,
+		holder: fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), hex.EncodeToString(suffix)),
+		ttl:    ttl,
+	}, nil
+}
+
+// campaign acquires or renews the lease and records the outcome with acme.SetLeader. It
+// reports whether this instance has just become the leader.
+func (e *leaderElection) campaign(ctx context.Context) bool {
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, e.ttl/3)
+	defer cancel()
+	acquired, err := e.lease.AcquireLease(ctx, e.holder, e.ttl)
+	if err != nil {
+		slog.Warn("error renewing leader lease", "holder", e.holder, "error", err)
+		acquired = e.leader && time.Now().Before(e.validUntil)
+	} else if acquired {
+		e.validUntil = start.Add(e.ttl)
+	}
+	became := acquired && !e.leader
+	switch {
+	case became:
+		slog.Info("Became leader; renewing certificates", "holder", e.holder, "lease", e.ttl)
+	case e.leader && !acquired:
+		slog.Warn("Lost leadership; only installing certificates from storage", "holder", e.holder)
+	case !acquired && !e.campaigned:
+		slog.Info("Following another leader; only installing certificates from storage", "holder", e.holder)
+	}
+	e.campaigned = true
+	e.leader = acquired
+	acme.SetLeader(acquired)
+	if acquired {
+		metrics.Leader.Set(1)
+	} else {
+		metrics.Leader.Set(0)
+	}
+	return became
+}
+
+// resign releases the lease if this instance holds it, so a follower takes over right away.
+func (e *leaderElection) resign() {
+	if !e.leader {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := e.lease.ReleaseLease(ctx, e.holder); err != nil {
+		slog.Warn("error releasing leader lease", "error", err)
+		return
+	}
+	slog.Info("Released leader lease", "holder", e.holder)
+	e.leader = false
+	acme.SetLeader(false)
+}
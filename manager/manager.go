@@ -0,0 +1,356 @@
+// Package manager runs loadmaster's certificate management: it selects the storage backend,
+// sweeps the domain groups on a schedule and reloads the domains file when it changes. The
+// loadmaster binary is a thin wrapper around a Manager, and other Go services can embed one.
+package manager
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/joshuaschlichting/loadmaster/internal/acme"
+	"github.com/joshuaschlichting/loadmaster/internal/config"
+)
+
+// AppConfig and DomainsConfig are the contents of config.json and domains.json.
+type (
+	AppConfig     = config.AppConfig
+	DomainsConfig = config.DomainsConfig
+)
+
+// ChallengeProvider solves one type of ACME challenge; see SetChallengeProviders.
+type ChallengeProvider = acme.ChallengeProvider
+
+// LoadAppConfig reads the application config from filename; see config.json in the README.
+func LoadAppConfig(filename string) (*AppConfig, error) {
+	return config.LoadAppConfig(filename)
+}
+
+// LoadDomains reads the domain groups from filename, a file or a directory of *.json files.
+func LoadDomains(filename string) (*DomainsConfig, error) {
+	return config.LoadDomains(filename)
+}
+
+// refreshInterval is how often a started Manager sweeps every domain group.
+const refreshInterval = 24 * time.Hour
+
+// Manager keeps the certificates of a set of domain groups issued and installed. The ACME
+// settings it applies are process-wide, so a process runs one Manager at a time.
+type Manager struct {
+	// DomainsFile, when set, is watched once the Manager is started, and its domain groups
+	// replace the managed ones whenever it changes. It is not watched when the domains come
+	// from $LOADMASTER_DOMAINS.
+	DomainsFile string
+	// OnReload, when set, is called with the domain groups after DomainsFile is reloaded and
+	// swept.
+	OnReload func(domains *DomainsConfig)
+	// Keepalive, when set with a positive KeepaliveInterval, is called by the scheduler loop
+	// every KeepaliveInterval, e.g. to ping systemd's watchdog. A hung loop stops calling it.
+	Keepalive         func()
+	KeepaliveInterval time.Duration
+
+	appConfig *AppConfig
+	storage   acme.ACMEStorage
+	jitter    time.Duration
+	election  *leaderElection
+
+	mu      sync.Mutex
+	domains *DomainsConfig
+
+	cancel context.CancelFunc
+	done   chan struct{}
+	sweeps sync.WaitGroup
+
+	preflightOnce sync.Once
+}
+
+// New applies appConfig and builds the storage backend it selects, managing the domain groups in
+// domains, split into one group per name when appConfig sets certPerDomain. Nothing is renewed
+// until Start, RenewAll or Renew is called.
+func New(appConfig *AppConfig, domains *DomainsConfig) (*Manager, error) {
+	if err := appConfig.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	if err := ApplyACMEConfig(appConfig); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	jitter := defaultRenewalJitter
+	if appConfig.RenewalJitter != "" {
+		var err error
+		jitter, err = time.ParseDuration(appConfig.RenewalJitter)
+		if err != nil || jitter < 0 {
+			return nil, fmt.Errorf("invalid renewalJitter %q: must be a non-negative duration such as \"30m\"", appConfig.RenewalJitter)
+		}
+	}
+	if err := os.MkdirAll(appConfig.LocalCertDir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating local certificate directory: %w", err)
+	}
+	storage, err := NewStorage(appConfig)
+	if err != nil {
+		return nil, fmt.Errorf("error creating storage: %w", err)
+	}
+	var election *leaderElection
+	if appConfig.LeaderElection.Enabled {
+		if election, err = newLeaderElection(appConfig, storage); err != nil {
+			return nil, err
+		}
+	}
+	if domains == nil {
+		domains = &DomainsConfig{}
+	} else if appConfig.CertPerDomain {
+		// domains may have been loaded before certPerDomain was applied.
+		domains = domains.PerDomain()
+	}
+	return &Manager{
+		appConfig: appConfig,
+		storage:   storage,
+		jitter:    jitter,
+		election:  election,
+		domains:   domains,
+	}, nil
+}
+
+// SetChallengeProviders replaces the challenge solvers selected by the config, e.g. with a
+// custom HTTP-01 solver publishing tokens to a CDN. Each provider is a lego challenge.Provider
+// with a ChallengeType method returning challenge.HTTP01, challenge.DNS01 or
+// challenge.TLSALPN01. Like the other ACME settings, the solvers are process-wide.
+func (m *Manager) SetChallengeProviders(providers ...ChallengeProvider) {
+	acme.ChallengeProviders = providers
+}
+
+// Storage returns the storage backend the Manager keeps certificates in.
+func (m *Manager) Storage() acme.ACMEStorage {
+	return m.storage
+}
+
+// Domains returns the domain groups currently managed.
+func (m *Manager) Domains() *DomainsConfig {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.domains
+}
+
+func (m *Manager) setDomains(domains *DomainsConfig) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.domains = domains
+}
+
+// prepare readies the acme package for a sweep over domains: certificate directories left by
+// older versions are migrated and the configured subjects applied.
+func (m *Manager) prepare(domains *DomainsConfig) {
+	if err := acme.MigrateCertDirs(m.appConfig.LocalCertDir, domains.Domains); err != nil {
+		slog.Error("Error migrating certificate directories", "error", err)
+	}
+	setSubjects(domains)
+	acme.ResetCAACache()
+}
+
+// Start sweeps the domain groups in the background, spreading groups that already have a valid
+// certificate over the renewal jitter window, then sweeps them again every day and whenever
+// DomainsFile changes, until ctx is done or Stop is called. With leader election, the lease is
+// campaigned for before the first sweep and renewed in the background; while another instance
+// leads, sweeps only install the certificates it keeps in storage.
+func (m *Manager) Start(ctx context.Context) error {
+	if m.done != nil {
+		return fmt.Errorf("manager already started")
+	}
+	var watcher *fsnotify.Watcher
+	var watch domainsWatch
+	if m.DomainsFile != "" {
+		if config.DomainsFromEnv() {
+			slog.Info("Domains loaded from environment; not watching the domains file", "env", config.DomainsEnv, "domainsFile", m.DomainsFile)
+		} else {
+			var err error
+			if watcher, err = fsnotify.NewWatcher(); err != nil {
+				return fmt.Errorf("error creating domains file watcher: %w", err)
+			}
+			watch = newDomainsWatch(m.DomainsFile)
+			if err := watcher.Add(watch.watchPath()); err != nil {
+				_ = watcher.Close()
+				return fmt.Errorf("error watching %s: %w", m.DomainsFile, err)
+			}
+			slog.Info("Watching domains file for changes", "domainsFile", m.DomainsFile)
+		}
+	}
+
+	ctx, m.cancel = context.WithCancel(ctx)
+	m.done = make(chan struct{})
+	// Stop abandons the orders in flight rather than waiting for them.
+	acme.SetObtainContext(ctx)
+	if m.election != nil {
+		m.election.campaign(ctx)
+	}
+	if domains := m.Domains(); hasDomains(domains) {
+		slog.Info("Loaded domain groups", "count", len(domains.Domains))
+		m.prepare(domains)
+		m.preflight(ctx, domains)
+		// Boot behavior: retrieve certs from cache and refresh if expiring; fallback to self-signed only if cache missing.
+		m.sweepInBackground(ctx, domains, m.jitter)
+	}
+	go m.run(ctx, watcher, watch)
+	return nil
+}
+
+// sweepInBackground starts a sweep of domains that Stop waits for.
+func (m *Manager) sweepInBackground(ctx context.Context, domains *DomainsConfig, jitter time.Duration) {
+	m.sweeps.Add(1)
+	go func() {
+		defer m.sweeps.Done()
+		UpdateAll(ctx, m.storage, domains.Domains, m.appConfig.Concurrency, jitter)
+	}()
+}
+
+// run is the scheduler loop of a started Manager.
+func (m *Manager) run(ctx context.Context, watcher *fsnotify.Watcher, watch domainsWatch) {
+	defer close(m.done)
+	var events <-chan fsnotify.Event
+	var watchErrors <-chan error
+	if watcher != nil {
+		defer func() {
+			if err := watcher.Close(); err != nil {
+				slog.Warn("error closing domains file watcher", "error", err)
+			}
+		}()
+		events, watchErrors = watcher.Events, watcher.Errors
+	}
+	refresh := time.NewTicker(refreshInterval)
+	defer refresh.Stop()
+	var leaseRenewals <-chan time.Time
+	if m.election != nil {
+		ticker := time.NewTicker(m.election.ttl / 3)
+		defer ticker.Stop()
+		leaseRenewals = ticker.C
+	}
+	var keepalives <-chan time.Time
+	if m.Keepalive != nil && m.KeepaliveInterval > 0 {
+		ticker := time.NewTicker(m.KeepaliveInterval)
+		defer ticker.Stop()
+		keepalives = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if watch.relevant(event) {
+				slog.Info("Domains file modified", "file", event.Name)
+				// Small delay to ensure file write is complete
+				time.Sleep(100 * time.Millisecond)
+				m.reload(ctx)
+			}
+		case <-refresh.C:
+			domains := m.Domains()
+			if !hasDomains(domains) {
+				continue
+			}
+			slog.Info("Refreshing certificates...")
+			acme.ResetCAACache()
+			m.sweepInBackground(ctx, domains, m.jitter)
+		case <-leaseRenewals:
+			// A new leader sweeps right away, so renewals the previous one left due aren't
+			// put off until the next daily refresh.
+			if m.election.campaign(ctx) {
+				if domains := m.Domains(); hasDomains(domains) {
+					m.sweepInBackground(ctx, domains, 0)
+				}
+			}
+		case <-keepalives:
+			m.Keepalive()
+		case err, ok := <-watchErrors:
+			if !ok {
+				return
+			}
+			slog.Error("Domains file watcher error", "error", err)
+		}
+	}
+}
+
+// reload loads DomainsFile and sweeps the domain groups it lists in the background, so the
+// scheduler loop keeps renewing the leader lease while the sweep runs.
+func (m *Manager) reload(ctx context.Context) {
+	domains, err := config.LoadDomains(m.DomainsFile)
+	if err != nil {
+		slog.Error("Error loading domains", "error", err)
+		return
+	}
+	m.setDomains(domains)
+	sweep := hasDomains(domains)
+	if sweep {
+		slog.Info("Loaded domain groups", "count", len(domains.Domains))
+		m.prepare(domains)
+	}
+	m.sweeps.Add(1)
+	go func() {
+		defer m.sweeps.Done()
+		if sweep {
+			UpdateAll(ctx, m.storage, domains.Domains, m.appConfig.Concurrency, 0)
+			if m.appConfig.PruneRemovedDomains && acme.IsLeader() {
+				PruneRemovedDomains(m.storage, domains.Domains)
+			}
+		}
+		if m.OnReload != nil {
+			m.OnReload(domains)
+		}
+	}()
+}
+
+// Stop ends the scheduler started by Start and waits for running sweeps to finish the domain
+// groups they have already started. A leader then releases its lease.
+func (m *Manager) Stop() {
+	if m.cancel == nil {
+		return
+	}
+	m.cancel()
+	<-m.done
+	m.sweeps.Wait()
+	if m.election != nil {
+		m.election.resign()
+	}
+}
+
+// RenewAll sweeps every domain group once, renewing the certificates that are due, and returns
+// the outcome of each. Groups not yet started when ctx is done are skipped.
+func (m *Manager) RenewAll(ctx context.Context) []SweepResult {
+	domains := m.Domains()
+	if !hasDomains(domains) {
+		return nil
+	}
+	m.prepare(domains)
+	m.preflight(ctx, domains)
+	return UpdateAll(ctx, m.storage, domains.Domains, m.appConfig.Concurrency, 0)
+}
+
+// Renew checks the certificate of the domain group containing domain and renews it if it is
+// due.
+func (m *Manager) Renew(ctx context.Context, domain string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	domain, err := config.NormalizeDomain(domain)
+	if err != nil {
+		return err
+	}
+	domains := m.Domains()
+	i := slices.IndexFunc(domains.Domains, func(group []string) bool {
+		return slices.Contains(group, domain)
+	})
+	if i < 0 {
+		return fmt.Errorf("domain %s is not in any domain group", domain)
+	}
+	setSubjects(domains)
+	err = acme.RenewNow(m.storage, domains.Domains[i], false)
+	if err := acme.FlushNotifiers(); err != nil {
+		slog.Warn("error sending renewal notifications", "error", err)
+	}
+	return err
+}
@@ -0,0 +1,41 @@
+package manager
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"github.com/joshuaschlichting/loadmaster/internal/acme"
+)
+
+// preflight checks, once per Manager and when challenge.preflightCheck is set, that the HTTP-01
+// challenge server can be reached through every name in domains, warning about each name it
+// can't be reached on. Wildcard names, which HTTP-01 can't validate, are skipped, as are
+// instances that don't obtain certificates.
+func (m *Manager) preflight(ctx context.Context, domains *DomainsConfig) {
+	if !m.appConfig.Challenge.PreflightCheck || acme.Distribute || !acme.IsLeader() {
+		return
+	}
+	m.preflightOnce.Do(func() {
+		var wg sync.WaitGroup
+		for _, group := range domains.Domains {
+			for _, name := range group {
+				if strings.HasPrefix(name, "*.") {
+					continue
+				}
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if err := acme.CheckHTTPChallengeReachable(ctx, name); err != nil {
+						slog.Warn("HTTP-01 challenge server unreachable through public name; issuance will fail until port 80 reaches it",
+							"domain", name, "port", acme.HTTPChallengePort, "error", err)
+						return
+					}
+					slog.Info("HTTP-01 challenge server reachable", "domain", name)
+				}()
+			}
+		}
+		wg.Wait()
+	})
+}
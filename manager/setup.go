@@ -0,0 +1,297 @@
+package manager
+
+import (
+	"crypto/tls"
+	"crypto/x509/pkix"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/joshuaschlichting/loadmaster/internal/acme"
+	"github.com/joshuaschlichting/loadmaster/internal/config"
+)
+
+// Version is the loadmaster release, used in the default ACME user agent. The loadmaster binary
+// sets it from its build-time version.
+var Version = "dev"
+
+// hasDomains reports whether domains has any domain groups, logging that there is nothing to do
+// when it doesn't. The daemon keeps watching the domains file either way.
+func hasDomains(domains *config.DomainsConfig) bool {
+	if domains == nil || len(domains.Domains) == 0 {
+		slog.Warn("no domains configured; idling")
+		return false
+	}
+	return true
+}
+
+// setSubjects passes the certificate subject fields configured in domains to the acme package.
+func setSubjects(domains *config.DomainsConfig) {
+	values := func(v string) []string {
+		if v == "" {
+			return nil
+		}
+		return []string{v}
+	}
+	subjects := make(map[string]pkix.Name, len(domains.Subjects))
+	for domain, subject := range domains.Subjects {
+		subjects[domain] = pkix.Name{
+			Organization:       values(subject.Organization),
+			OrganizationalUnit: values(subject.OrganizationalUnit),
+			Country:            values(subject.Country),
+			Province:           values(subject.Province),
+			Locality:           values(subject.Locality),
+		}
+	}
+	acme.SetSubjects(subjects)
+}
+
+func getS3ParamsFromConfig(config *config.AppConfig, s3Config config.S3Config) acme.NewS3ACMEStorageParams {
+	// An invalid timeout is reported by Validate; fall back to the default here.
+	timeout, _ := time.ParseDuration(s3Config.Timeout)
+	return acme.NewS3ACMEStorageParams{
+		BucketName:         s3Config.BucketName,
+		Region:             s3Config.Region,
+		Endpoint:           s3Config.Endpoint,
+		ContactEmail:       config.Email,
+		LocalCertDir:       config.LocalCertDir,
+		CAAuthority:        config.CAAuthority,
+		DistributedLock:    s3Config.DistributedLock,
+		MaxAttempts:        s3Config.MaxAttempts,
+		Timeout:            timeout,
+		Profile:            s3Config.AWSProfile,
+		AccessKeyID:        s3Config.AWSAccessKeyID,
+		SecretAccessKey:    s3Config.AWSSecretAccessKey,
+		RoleARN:            s3Config.AWSRoleARN,
+		ExternalID:         s3Config.AWSExternalID,
+		MaxArchiveVersions: s3Config.MaxArchiveVersions,
+		GzipAccountData:    s3Config.GzipAccountData,
+	}
+}
+
+// NewStorage builds the storage backends listed in appConfig.Storage, replicating across them
+// when there is more than one. Without a list, S3 storage is used when a bucket is configured
+// and local storage otherwise.
+func NewStorage(appConfig *config.AppConfig) (acme.ACMEStorage, error) {
+	storageConfigs := appConfig.Storage
+	if len(storageConfigs) == 0 {
+		storageConfig := config.StorageConfig{Type: "local"}
+		if appConfig.S3.BucketName != "" {
+			storageConfig = config.StorageConfig{Type: "s3", S3: appConfig.S3}
+		}
+		storageConfigs = []config.StorageConfig{storageConfig}
+	}
+
+	var storages []acme.ACMEStorage
+	for _, storageConfig := range storageConfigs {
+		switch storageConfig.Type {
+		case "local":
+			storages = append(storages, acme.NewLocalACMEStorage(acme.NewLocalACMEStorageParams{
+				ContactEmail: appConfig.Email,
+				CAAuthority:  appConfig.CAAuthority,
+				HomeDir:      config.Dir,
+				LocalCertDir: appConfig.LocalCertDir,
+			}))
+		case "s3":
+			storage, err := acme.NewS3ACMEStorage(getS3ParamsFromConfig(appConfig, storageConfig.S3))
+			if err != nil {
+				return nil, err
+			}
+			storages = append(storages, storage)
+		default:
+			return nil, fmt.Errorf("unknown storage type %q", storageConfig.Type)
+		}
+	}
+	if len(storages) == 1 {
+		return storages[0], nil
+	}
+	return acme.NewMultiACMEStorage(appConfig.Email, appConfig.CAAuthority, appConfig.LocalCertDir, storages...)
+}
+
+// ApplyACMEConfig copies the ACME settings from appConfig onto the acme package. The acme
+// settings are process-wide, so they are shared by every Manager in the process.
+func ApplyACMEConfig(appConfig *config.AppConfig) error {
+	switch appConfig.CertBundle {
+	case "":
+	case acme.CertBundleFull, acme.CertBundleLeafAndChain, acme.CertBundleLeaf:
+		acme.CertBundle = appConfig.CertBundle
+	default:
+		return fmt.Errorf("certBundle %q must be %q, %q or %q", appConfig.CertBundle, acme.CertBundleFull, acme.CertBundleLeafAndChain, acme.CertBundleLeaf)
+	}
+	if appConfig.MustStaple {
+		if err := acme.ValidateMustStaple(appConfig.CAAuthority); err != nil {
+			return fmt.Errorf("mustStaple: %w", err)
+		}
+	}
+	var err error
+	if acme.CertFileMode, err = config.ParseFileMode(appConfig.CertFileMode, 0644); err != nil {
+		return fmt.Errorf("certFileMode: %w", err)
+	}
+	if acme.KeyFileMode, err = config.ParseFileMode(appConfig.KeyFileMode, 0600); err != nil {
+		return fmt.Errorf("keyFileMode: %w", err)
+	}
+	if acme.CertFileUID, err = config.LookupUID(appConfig.CertOwner); err != nil {
+		return fmt.Errorf("certOwner: %w", err)
+	}
+	if acme.CertFileGID, err = config.LookupGID(appConfig.CertGroup); err != nil {
+		return fmt.Errorf("certGroup: %w", err)
+	}
+	switch appConfig.RenewalMode {
+	case "":
+		acme.RenewalMode = acme.RenewalModeFixed
+	case acme.RenewalModeFixed, acme.RenewalModeLifetimeFraction:
+		acme.RenewalMode = appConfig.RenewalMode
+	default:
+		return fmt.Errorf("renewalMode %q must be %q or %q", appConfig.RenewalMode, acme.RenewalModeFixed, acme.RenewalModeLifetimeFraction)
+	}
+	acme.MinTimeBetweenRenewals = acme.DefaultMinTimeBetweenRenewals
+	if appConfig.MinTimeBetweenRenewals != "" {
+		if acme.MinTimeBetweenRenewals, err = time.ParseDuration(appConfig.MinTimeBetweenRenewals); err != nil || acme.MinTimeBetweenRenewals < 0 {
+			return fmt.Errorf("minTimeBetweenRenewals %q must be a non-negative duration such as \"24h\"", appConfig.MinTimeBetweenRenewals)
+		}
+	}
+	acme.MaxRenewalBackoff = acme.DefaultMaxRenewalBackoff
+	if appConfig.MaxRenewalBackoff != "" {
+		if acme.MaxRenewalBackoff, err = time.ParseDuration(appConfig.MaxRenewalBackoff); err != nil || acme.MaxRenewalBackoff < 0 {
+			return fmt.Errorf("maxRenewalBackoff %q must be a non-negative duration such as \"24h\"", appConfig.MaxRenewalBackoff)
+		}
+	}
+	config.CertPerDomain = appConfig.CertPerDomain
+	acme.Distribute = appConfig.Mode == "distribute"
+	acme.MustStaple = appConfig.MustStaple
+	acme.PreferredChain = appConfig.PreferredChain
+	acme.PostRenewHook = appConfig.PostRenewHook
+	acme.UserAgent = appConfig.UserAgent
+	if acme.UserAgent == "" {
+		acme.UserAgent = "loadmaster/" + Version
+	}
+	acme.HTTPProxy = appConfig.HTTPProxy
+	acme.NoProxy = appConfig.NoProxy
+	acme.CARootCerts = nil
+	if appConfig.CARootCertFile != "" {
+		pool, err := acme.LoadCARootCerts(appConfig.CARootCertFile)
+		if err != nil {
+			return err
+		}
+		acme.CARootCerts = pool
+	}
+	acme.ClientCertificate = nil
+	if appConfig.ACMEClientCertFile != "" || appConfig.ACMEClientKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(appConfig.ACMEClientCertFile, appConfig.ACMEClientKeyFile)
+		if err != nil {
+			return fmt.Errorf("error loading ACME client certificate: %w", err)
+		}
+		acme.ClientCertificate = &cert
+	}
+	acme.HTTPChallengeBindAddress = appConfig.Challenge.BindAddress
+	switch appConfig.Challenge.Type {
+	case "":
+		acme.ChallengeProviders = nil
+	case "http-01":
+		acme.ChallengeProviders = []acme.ChallengeProvider{acme.HTTP01ChallengeProvider()}
+	case "tls-alpn-01":
+		acme.ChallengeProviders = []acme.ChallengeProvider{acme.TLSALPN01ChallengeProvider()}
+	case "dns-01":
+		var provider acme.ChallengeProvider
+		var err error
+		if appConfig.Challenge.DNSProvider == "acmedns" {
+			provider, err = newACMEDNSProvider(appConfig.Challenge.ACMEDNS)
+		} else {
+			provider, err = acme.DNS01ChallengeProvider(appConfig.Challenge.DNSProvider)
+		}
+		if err != nil {
+			return fmt.Errorf("challenge.dnsProvider: %w", err)
+		}
+		acme.ChallengeProviders = []acme.ChallengeProvider{provider}
+	default:
+		return fmt.Errorf("challenge.type %q must be \"http-01\", \"dns-01\" or \"tls-alpn-01\"", appConfig.Challenge.Type)
+	}
+	if err := applyDNSPropagation(appConfig.Challenge); err != nil {
+		return err
+	}
+	acme.ObtainTimeout = max(acme.DefaultObtainTimeout, acme.DNSPropagationTimeout+time.Minute)
+	if appConfig.ObtainTimeout != "" {
+		if acme.ObtainTimeout, err = time.ParseDuration(appConfig.ObtainTimeout); err != nil || acme.ObtainTimeout < 0 {
+			return fmt.Errorf("obtainTimeout %q must be a non-negative duration such as \"2m\"", appConfig.ObtainTimeout)
+		}
+	}
+	acme.CAACheck = appConfig.CAACheck
+	acme.SCTCheck = appConfig.SCTCheck
+	acme.CAAIdentity = appConfig.CAAIdentity
+	acme.DisableSelfSignedFallback = appConfig.DisableSelfSignedFallback
+	if appConfig.CriticalExpiryDays < 0 {
+		return fmt.Errorf("criticalExpiryDays must not be negative")
+	}
+	if appConfig.CriticalExpiryDays > 0 {
+		acme.CriticalExpiryDays = appConfig.CriticalExpiryDays
+	}
+	acme.Notifiers = nil
+	if appConfig.WebhookURL != "" {
+		acme.Notifiers = append(acme.Notifiers, acme.NewWebhookNotifier(appConfig.WebhookURL))
+	}
+	if appConfig.SlackWebhookURL != "" {
+		acme.Notifiers = append(acme.Notifiers, acme.NewSlackNotifier(appConfig.SlackWebhookURL))
+	}
+	if smtpConfig := appConfig.SMTP; smtpConfig.Host != "" {
+		port := smtpConfig.Port
+		if port == 0 {
+			port = 587
+		}
+		acme.Notifiers = append(acme.Notifiers, &acme.SMTPNotifier{
+			Host:     smtpConfig.Host,
+			Port:     port,
+			From:     smtpConfig.From,
+			To:       smtpConfig.To,
+			Username: smtpConfig.Username,
+			Password: smtpConfig.Password,
+		})
+	}
+	return nil
+}
+
+// newACMEDNSProvider builds the acme-dns DNS-01 solver configured in cfg. Account keys are
+// normalized like the domains they are looked up by.
+func newACMEDNSProvider(cfg config.ACMEDNSConfig) (acme.ChallengeProvider, error) {
+	accounts := make(map[string]acme.ACMEDNSAccount, len(cfg.Accounts))
+	for domain, account := range cfg.Accounts {
+		name, err := config.NormalizeDomain(strings.TrimPrefix(domain, "*."))
+		if err != nil {
+			return nil, fmt.Errorf("acmeDNS.accounts: %w", err)
+		}
+		accounts[name] = acme.ACMEDNSAccount{
+			FullDomain: account.FullDomain,
+			SubDomain:  account.Subdomain,
+			Username:   account.Username,
+			Password:   account.Password,
+			ServerURL:  cfg.APIBase,
+		}
+	}
+	return acme.ACMEDNSChallengeProvider(cfg.APIBase, cfg.AllowFrom, accounts)
+}
+
+// applyDNSPropagation sets the acme package's DNS-01 propagation settings from challenge.
+func applyDNSPropagation(challenge config.ChallengeConfig) error {
+	durations := []struct {
+		name  string
+		value string
+		dst   *time.Duration
+	}{
+		{"propagationTimeout", challenge.PropagationTimeout, &acme.DNSPropagationTimeout},
+		{"pollingInterval", challenge.PollingInterval, &acme.DNSPollingInterval},
+		{"dnsTimeout", challenge.DNSTimeout, &acme.DNSQueryTimeout},
+	}
+	for _, d := range durations {
+		*d.dst = 0
+		if d.value == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.value)
+		if err != nil || v <= 0 {
+			return fmt.Errorf("challenge.%s %q must be a positive duration such as \"2m\"", d.name, d.value)
+		}
+		*d.dst = v
+	}
+	acme.DNSSkipAuthoritativeCheck = challenge.SkipAuthoritativeCheck
+	return nil
+}
@@ -0,0 +1,191 @@
+package manager
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"hash/fnv"
+	"log/slog"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/joshuaschlichting/loadmaster/internal/acme"
+)
+
+// defaultConcurrency is how many domain groups UpdateAll processes at once when the config
+// doesn't say.
+const defaultConcurrency = 4
+
+// defaultRenewalJitter is the default half-width of the window scheduled sweeps are spread over.
+const defaultRenewalJitter = 30 * time.Minute
+
+// jitterDelay returns how long into a sweep domainRoot is processed: a point in [0, 2*window)
+// derived from a hash of the name, so it is the same on every run and every instance. This
+// spreads a sweep ±window around its midpoint.
+func jitterDelay(domainRoot string, window time.Duration) time.Duration {
+	if window <= 0 {
+		return 0
+	}
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(domainRoot))
+	return time.Duration(h.Sum64() % uint64(2*window))
+}
+
+// hasValidCert reports whether a certificate that has not yet expired is installed for
+// domainRoot. Groups without one are not delayed by jitter.
+func hasValidCert(storage acme.ACMEStorage, domainRoot string) bool {
+	certPath, _ := storage.CertLocation(domainRoot)
+	certData, err := os.ReadFile(certPath)
+	if err != nil {
+		return false
+	}
+	cert, err := acme.ParseCertificate(certData)
+	return err == nil && time.Now().Before(cert.NotAfter)
+}
+
+// usingSelfSigned reports whether the certificate installed for domainRoot is a self-signed
+// fallback.
+func usingSelfSigned(storage acme.ACMEStorage, domainRoot string) bool {
+	certPath, _ := storage.CertLocation(domainRoot)
+	certData, err := os.ReadFile(certPath)
+	return err == nil && acme.IsSelfSigned(certData)
+}
+
+// SweepResult is the outcome of one domain group in a sweep. Err is also set when the group was
+// left on a self-signed fallback certificate.
+type SweepResult struct {
+	Group []string
+	Err   error
+}
+
+// CountFailed returns how many results have an error.
+func CountFailed(results []SweepResult) int {
+	failed := 0
+	for _, result := range results {
+		if result.Err != nil {
+			failed++
+		}
+	}
+	return failed
+}
+
+// ErrSelfSigned is the SweepResult error of a group left on a self-signed fallback certificate.
+var ErrSelfSigned = errors.New("using a self-signed fallback certificate")
+
+// UpdateAll runs storage.UpdateTLS for every domain group using a bounded pool of workers and
+// logs a summary once all groups are done. With a jitter window, each group that already has a
+// valid certificate is started at its jitterDelay instead of immediately. S3 reads are cached
+// for the duration of the sweep. Once ctx is done, groups not yet started are skipped; those
+// in progress are finished. It returns the outcome of every group that ran, in the order they
+// finished.
+func UpdateAll(ctx context.Context, storage acme.ACMEStorage, domainGroups [][]string, concurrency int, jitter time.Duration) []SweepResult {
+	if concurrency <= 0 {
+		concurrency = defaultConcurrency
+	}
+	start := time.Now()
+	acme.BeginSweep()
+	defer acme.EndSweep()
+
+	type scheduledGroup struct {
+		group []string
+		delay time.Duration
+	}
+	var schedule []scheduledGroup
+	for _, group := range domainGroups {
+		if len(group) == 0 {
+			continue
+		}
+		var delay time.Duration
+		if domainRoot := acme.DomainRoot(group); hasValidCert(storage, domainRoot) {
+			delay = jitterDelay(domainRoot, jitter)
+		}
+		schedule = append(schedule, scheduledGroup{group: group, delay: delay})
+	}
+	slices.SortStableFunc(schedule, func(a, b scheduledGroup) int {
+		return cmp.Compare(a.delay, b.delay)
+	})
+
+	groups := make(chan []string)
+	var mu sync.Mutex
+	var results []SweepResult
+	var wg sync.WaitGroup
+	for range min(concurrency, len(schedule)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for group := range groups {
+				err := storage.UpdateTLS(group)
+				if err != nil {
+					slog.Error("UpdateTLS error", "domains", group, "error", err)
+				} else if usingSelfSigned(storage, acme.DomainRoot(group)) {
+					slog.Error("Domain group is using a self-signed fallback certificate", "domains", group)
+					err = ErrSelfSigned
+				}
+				mu.Lock()
+				results = append(results, SweepResult{Group: group, Err: err})
+				mu.Unlock()
+			}
+		}()
+	}
+schedule:
+	for _, s := range schedule {
+		if wait := s.delay - time.Since(start); wait > 0 {
+			slog.Debug("Delaying domain group by renewal jitter", "domains", s.group, "delay", wait.Round(time.Second))
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				break schedule
+			}
+		}
+		select {
+		case groups <- s.group:
+		case <-ctx.Done():
+			break schedule
+		}
+	}
+	close(groups)
+	wg.Wait()
+
+	if err := acme.FlushNotifiers(); err != nil {
+		slog.Warn("error sending sweep notifications", "error", err)
+	}
+	slog.Info("Certificate sweep finished", "groups", len(schedule), "failed", CountFailed(results), "duration", time.Since(start).Round(time.Millisecond))
+	return results
+}
+
+// PruneRemovedDomains deletes the certificates storage holds for domain roots that are no longer
+// a name in any of domainGroups. Any name of a group counts as managed, so certificates left
+// under a group's former domain root are kept. Nothing is pruned when domainGroups is empty, so
+// an accidentally emptied domains file doesn't wipe every certificate.
+func PruneRemovedDomains(storage acme.ACMEStorage, domainGroups [][]string) {
+	lister, ok := storage.(acme.CertLister)
+	if !ok {
+		slog.Warn("Storage cannot list its certificates; not pruning removed domains")
+		return
+	}
+	if len(domainGroups) == 0 {
+		return
+	}
+	managed := make(map[string]bool)
+	for _, group := range domainGroups {
+		for _, domain := range group {
+			managed[domain] = true
+		}
+	}
+	domainRoots, err := lister.ListCerts()
+	if err != nil {
+		slog.Error("Error listing stored certificates; not pruning removed domains", "error", err)
+		return
+	}
+	for _, domainRoot := range domainRoots {
+		if managed[domainRoot] {
+			continue
+		}
+		slog.Info("Pruning certificate of removed domain", "domain", domainRoot)
+		if err := storage.DeleteCert(domainRoot); err != nil {
+			slog.Error("Error pruning certificate of removed domain", "domain", domainRoot, "error", err)
+		}
+	}
+}
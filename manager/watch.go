@@ -0,0 +1,44 @@
+package manager
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// domainsWatch decides which fsnotify events concern the domains configuration.
+//
+// A single domains file is watched through its parent directory rather than directly: editors
+// and `mv` replace the file with a new inode, after which a watch on the old inode never fires
+// again. Watching the directory and filtering by name survives any number of replacements.
+type domainsWatch struct {
+	path  string
+	isDir bool
+}
+
+func newDomainsWatch(domainsFile string) domainsWatch {
+	info, err := os.Stat(domainsFile)
+	return domainsWatch{path: filepath.Clean(domainsFile), isDir: err == nil && info.IsDir()}
+}
+
+// watchPath is the path to add to the fsnotify watcher.
+func (w domainsWatch) watchPath() string {
+	if w.isDir {
+		return w.path
+	}
+	return filepath.Dir(w.path)
+}
+
+// relevant reports whether event should trigger a reload of the domains configuration.
+func (w domainsWatch) relevant(event fsnotify.Event) bool {
+	name := filepath.Clean(event.Name)
+	if w.isDir {
+		if filepath.Ext(name) != ".json" {
+			return false
+		}
+		return event.Has(fsnotify.Write) || event.Has(fsnotify.Create) || event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename)
+	}
+	// Renaming a new file over the domains file shows up as a Create for its name.
+	return name == w.path && (event.Has(fsnotify.Write) || event.Has(fsnotify.Create))
+}
@@ -0,0 +1,81 @@
+package manager
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestDomainsWatchRelevant(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "domains.json")
+	if err := os.WriteFile(file, []byte(`{"domains":[]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	watch := newDomainsWatch(file)
+	tests := []struct {
+		name  string
+		event fsnotify.Event
+		want  bool
+	}{
+		{"write", fsnotify.Event{Name: file, Op: fsnotify.Write}, true},
+		{"rename over the file", fsnotify.Event{Name: file, Op: fsnotify.Create}, true},
+		{"chmod", fsnotify.Event{Name: file, Op: fsnotify.Chmod}, false},
+		{"temp file written", fsnotify.Event{Name: file + ".tmp", Op: fsnotify.Write}, false},
+		{"temp file renamed away", fsnotify.Event{Name: file + ".tmp", Op: fsnotify.Rename}, false},
+		{"other file", fsnotify.Event{Name: filepath.Join(dir, "config.json"), Op: fsnotify.Write}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := watch.relevant(tt.event); got != tt.want {
+				t.Errorf("relevant(%v) = %v, want %v", tt.event, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestDomainsWatchAtomicRename replaces the domains file by renaming a temp file over it twice,
+// as editors and config management tools do, and expects a relevant event each time.
+func TestDomainsWatchAtomicRename(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "domains.json")
+	if err := os.WriteFile(file, []byte(`{"domains":[]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	watch := newDomainsWatch(file)
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+	if err := watcher.Add(watch.watchPath()); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range 2 {
+		tmp := filepath.Join(dir, "domains.json.tmp")
+		if err := os.WriteFile(tmp, []byte(`{"domains":[["example.com"]]}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmp, file); err != nil {
+			t.Fatal(err)
+		}
+		timeout := time.After(5 * time.Second)
+	wait:
+		for {
+			select {
+			case event := <-watcher.Events:
+				if watch.relevant(event) {
+					break wait
+				}
+			case err := <-watcher.Errors:
+				t.Fatalf("watcher error: %v", err)
+			case <-timeout:
+				t.Fatalf("rename %d: no relevant event", i+1)
+			}
+		}
+	}
+}
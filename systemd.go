@@ -0,0 +1,40 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/daemon"
+)
+
+// notifySystemdReady tells systemd (Type=notify) that startup is complete. Outside systemd it
+// does nothing.
+func notifySystemdReady() {
+	if sent, err := daemon.SdNotify(false, daemon.SdNotifyReady); err != nil {
+		slog.Warn("error notifying systemd of readiness", "error", err)
+	} else if sent {
+		slog.Debug("Notified systemd of readiness")
+	}
+}
+
+// systemdWatchdogInterval returns how often to answer systemd's watchdog, half its interval,
+// when the watchdog is enabled (WATCHDOG_USEC), and 0 otherwise. Each keepalive is sent with
+// pingSystemdWatchdog.
+func systemdWatchdogInterval() time.Duration {
+	interval, err := daemon.SdWatchdogEnabled(false)
+	if err != nil {
+		slog.Warn("error reading systemd watchdog settings", "error", err)
+		return 0
+	}
+	if interval == 0 {
+		return 0
+	}
+	slog.Info("systemd watchdog enabled", "interval", interval)
+	return interval / 2
+}
+
+func pingSystemdWatchdog() {
+	if _, err := daemon.SdNotify(false, daemon.SdNotifyWatchdog); err != nil {
+		slog.Warn("error sending systemd watchdog keepalive", "error", err)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// Build metadata, set at build time with
+// -ldflags "-X main.version=v1.2.3 -X main.commit=$(git rev-parse HEAD) -X main.date=$(date -u +%FT%TZ)".
+// When commit and date are not set, the VCS information the go command stamps into binaries
+// built from a git checkout is used.
+var (
+	version = "dev"
+	commit  = ""
+	date    = ""
+)
+
+// versionString describes the build, e.g. "v1.2.3 (commit 1a2b3c4d, built 2026-01-02T03:04:05Z,
+// go1.25.0)".
+func versionString() string {
+	commit, date := commit, date
+	if info, ok := debug.ReadBuildInfo(); ok && commit == "" {
+		vcs := make(map[string]string)
+		for _, setting := range info.Settings {
+			vcs[setting.Key] = setting.Value
+		}
+		commit = vcs["vcs.revision"]
+		if commit != "" && vcs["vcs.modified"] == "true" {
+			commit += "-dirty"
+		}
+		if date == "" {
+			date = vcs["vcs.time"]
+		}
+	}
+	if commit == "" {
+		commit = "unknown"
+	}
+	if date == "" {
+		date = "unknown"
+	}
+	return fmt.Sprintf("%s (commit %s, built %s, %s)", version, commit, date, runtime.Version())
+}
+
+// versionCommand prints the version, git commit and build date.
+func versionCommand(args []string) int {
+	fmt.Println("loadmaster " + versionString())
+	return 0
+}